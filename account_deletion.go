@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+)
+
+const (
+	tokenPurposeDeleteAccount    = "delete_account"
+	deleteAccountTokenTTL        = time.Hour
+	defaultDeletionGracePeriod   = 30 * 24 * time.Hour
+	accountDeletionSweepInterval = time.Hour
+)
+
+// sendDeletionConfirmationEmail is how accounts without a password or TOTP
+// re-authenticate: the code in the email has to be sent back to
+// DELETE /api/users/me.
+func (cfg *apiConfig) sendDeletionConfirmationEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.issueUserToken(ctx, user.ID, tokenPurposeDeleteAccount, deleteAccountTokenTTL)
+	if err != nil {
+		return err
+	}
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : user.Email,
+		Subject : "Confirm deleting your Chirpy account",
+		Body : fmt.Sprintf("Someone asked to delete your Chirpy account. To confirm, send this code within an hour:\n\n%s\n\nIf this was not you, you can ignore this email.\n", token),
+	})
+}
+
+func (cfg *apiConfig) sendDeletionScheduledEmail(ctx context.Context, user database.User, deleteAt time.Time) error {
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : user.Email,
+		Subject : "Your Chirpy account will be deleted",
+		Body : fmt.Sprintf("Your Chirpy account and everything in it will be deleted on %s.\n\nIf you change your mind, log in before then and the deletion will be cancelled.\n", deleteAt.Format("January 2, 2006")),
+	})
+}
+
+func (cfg *apiConfig) handleDeleteUser(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		ConfirmationCode string `json:"confirmation_code"`
+	}
+	type deletionResp struct {
+		DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+		ConfirmationSent bool `json:"confirmation_sent,omitempty"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	respond := func(status int, body any) {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(dat)
+	}
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	retryAfter, err := cfg.loginRetryAfter(req.Context(), req, user.Email)
+	if err != nil {
+		log.Printf("Error checking login attempts: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
+		respond(429, errResp{
+			Error : "Too many failed attempts, try again later",
+		})
+		return
+	}
+
+	// A stolen access token alone must not be enough to delete the
+	// account, so the user proves who they are again with every factor
+	// they have set up.
+	if user.HashedPassword.Valid {
+		pwMatch, err := auth.CheckPasswordHash(params.Password, user.HashedPassword.String)
+		if err != nil || !pwMatch {
+			cfg.recordLoginFailure(req.Context(), req, user.Email)
+			respond(403, errResp{
+				Error : "Incorrect password",
+			})
+			return
+		}
+	}
+	totp, hasTOTP, err := cfg.userHasTOTP(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if hasTOTP && !cfg.verifySecondFactor(req.Context(), totp, params.Code, params.RecoveryCode) {
+		cfg.recordLoginFailure(req.Context(), req, user.Email)
+		respond(403, errResp{
+			Error : "Invalid code",
+		})
+		return
+	}
+	if !user.HashedPassword.Valid && !hasTOTP {
+		if params.ConfirmationCode == "" {
+			err = cfg.sendDeletionConfirmationEmail(req.Context(), user)
+			if err != nil {
+				log.Printf("Error sending deletion confirmation email: %s", err)
+				w.WriteHeader(500)
+				return
+			}
+			respond(202, deletionResp{
+				ConfirmationSent : true,
+			})
+			return
+		}
+		userToken, err := cfg.consumeUserToken(req.Context(), params.ConfirmationCode, tokenPurposeDeleteAccount)
+		if err != nil || userToken.UserID != user.ID {
+			cfg.recordLoginFailure(req.Context(), req, user.Email)
+			respond(403, errResp{
+				Error : "This confirmation code is invalid or has expired",
+			})
+			return
+		}
+	}
+
+	deleteAt := time.Now().Add(cfg.deletionGracePeriod)
+	err = cfg.db.ScheduleUserDeletion(req.Context(), database.ScheduleUserDeletionParams{
+		ID : user.ID,
+		DeletionScheduledAt : sql.NullTime{
+			Time : deleteAt,
+			Valid : true,
+		},
+	})
+	if err != nil {
+		log.Printf("Error scheduling account deletion: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	// Signing out everywhere means the next login, which cancels the
+	// deletion, has to be a deliberate one. authenticate refuses API keys
+	// and OAuth access tokens until then.
+	err = cfg.db.RevokeUserRefreshTokens(req.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error revoking refresh tokens: %s", err)
+	}
+	cfg.recordAuditEvent(req.Context(), req, user.ID, "user.deletion_scheduled")
+	err = cfg.sendDeletionScheduledEmail(req.Context(), user, deleteAt)
+	if err != nil {
+		log.Printf("Error sending deletion email: %s", err)
+	}
+
+	respond(202, deletionResp{
+		DeletionScheduledAt : &deleteAt,
+	})
+}
+
+// cancelScheduledDeletion is called on every login, which is how a user
+// takes back a deletion request during the grace period.
+func (cfg *apiConfig) cancelScheduledDeletion(ctx context.Context, user database.User) error {
+	if !user.DeletionScheduledAt.Valid {
+		return nil
+	}
+	rows, err := cfg.db.CancelUserDeletion(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		cfg.recordAuditEvent(ctx, nil, user.ID, "user.deletion_cancelled")
+	}
+	return nil
+}
+
+// deleteScheduledAccounts removes accounts whose grace period has ended.
+// Everything a user owns references users with ON DELETE CASCADE, so
+// deleting the row takes their chirps, tokens, API keys, OAuth clients and
+// linked identities with it. Their audit entries stay, without the user
+// id and with their metadata, which holds email addresses, emptied.
+func (cfg *apiConfig) deleteScheduledAccounts(ctx context.Context) {
+	var deleted []database.DeleteScheduledUsersRow
+	err := cfg.inTx(ctx, func(q *database.Queries) error {
+		err := q.ClearScheduledUsersAuditMetadata(ctx)
+		if err != nil {
+			return err
+		}
+		deleted, err = q.DeleteScheduledUsers(ctx)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error deleting scheduled accounts: %s", err)
+		return
+	}
+	for _, user := range deleted {
+		err = cfg.loginEmailLimiter.Reset(ctx, loginEmailKey(user.Email))
+		if err != nil {
+			log.Printf("Error resetting login attempts: %s", err)
+		}
+		cfg.recordAudit(ctx, nil, auditEntry{
+			ActorType : actorSystem,
+			Event : "user.deleted",
+			Metadata : map[string]string{
+				"user_id" : user.ID.String(),
+			},
+		})
+	}
+}
+
+func (cfg *apiConfig) runAccountDeletion(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cfg.deleteScheduledAccounts(context.Background())
+		<-ticker.C
+	}
+}
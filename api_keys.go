@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/oauth"
+	"github.com/google/uuid"
+)
+
+const maxAPIKeyNameLength = 100
+
+var (
+	errMissingCredentials = errors.New("no bearer token or API key in the request")
+	errInvalidAPIKey      = errors.New("API key is invalid or revoked")
+	errPendingDeletion    = errors.New("account is scheduled for deletion")
+)
+
+type scopeError struct {
+	Scheme string
+	Scope  string
+}
+
+func (e *scopeError) Error() string {
+	if e.Scheme == "Bearer" {
+		return fmt.Sprintf("Token is missing the %s scope", e.Scope)
+	}
+	return fmt.Sprintf("API key is missing the %s scope", e.Scope)
+}
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func mapAPIKey(key database.ApiKey) APIKey {
+	mapped := APIKey{
+		ID : key.ID,
+		CreatedAt : key.CreatedAt,
+		Name : key.Name,
+		Prefix : key.Prefix,
+		Scopes : key.Scopes,
+	}
+	if key.LastUsedAt.Valid {
+		mapped.LastUsedAt = &key.LastUsedAt.Time
+	}
+	return mapped
+}
+
+// authenticate accepts a bearer access token, which may do anything the
+// user can, or a personal API key or OAuth access token, which must carry
+// scope. Keys and OAuth tokens are refused while the account is scheduled
+// for deletion, since logging in again is what cancels it.
+func (cfg *apiConfig) authenticate(req *http.Request, scope string) (uuid.UUID, error) {
+	key, err := auth.GetAPIKey(req.Header)
+	if err == nil {
+		userID, err := cfg.authenticateAPIKey(req.Context(), key, scope)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		return userID, cfg.checkNotPendingDeletion(req.Context(), userID)
+	}
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		return uuid.Nil, errMissingCredentials
+	}
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if !errors.Is(err, auth.ErrTokenAudience) {
+		return userID, err
+	}
+	claims, oauthErr := cfg.keys.ValidateScopedJWT(accessToken, oauth.AccessTokenAudience)
+	if oauthErr != nil {
+		return uuid.Nil, err
+	}
+	if !auth.HasScope(claims.Scopes, scope) {
+		return uuid.Nil, &scopeError{Scheme : "Bearer", Scope : scope}
+	}
+	return claims.UserID, cfg.checkNotPendingDeletion(req.Context(), claims.UserID)
+}
+
+// credentialsExpireAt returns when the access token or OAuth access token
+// on req expires, or the zero time for an API key, which does not.
+func (cfg *apiConfig) credentialsExpireAt(req *http.Request) time.Time {
+	_, err := auth.GetAPIKey(req.Header)
+	if err == nil {
+		return time.Time{}
+	}
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil {
+		return time.Time{}
+	}
+	_, expiresAt, err := cfg.keys.ValidateJWTWithExpiry(accessToken)
+	if err == nil {
+		return expiresAt
+	}
+	claims, err := cfg.keys.ValidateScopedJWT(accessToken, oauth.AccessTokenAudience)
+	if err != nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt
+}
+
+func (cfg *apiConfig) checkNotPendingDeletion(ctx context.Context, userID uuid.UUID) error {
+	user, err := cfg.db.GetUserByID(ctx, userID)
+	if err == sql.ErrNoRows {
+		return errMissingCredentials
+	}
+	if err != nil {
+		return err
+	}
+	if user.DeletionScheduledAt.Valid {
+		return errPendingDeletion
+	}
+	return nil
+}
+
+func (cfg *apiConfig) authenticateAPIKey(ctx context.Context, key, scope string) (uuid.UUID, error) {
+	if !strings.HasPrefix(key, auth.APIKeyPrefix) {
+		return uuid.Nil, errInvalidAPIKey
+	}
+	apiKey, err := cfg.db.GetAPIKeyByHash(ctx, auth.HashToken(key))
+	if err == sql.ErrNoRows {
+		return uuid.Nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if !auth.HasScope(apiKey.Scopes, scope) {
+		return uuid.Nil, &scopeError{Scheme : "ApiKey", Scope : scope}
+	}
+	err = cfg.db.TouchAPIKey(ctx, apiKey.ID)
+	if err != nil {
+		log.Printf("Error updating API key last use: %s", err)
+	}
+	return apiKey.UserID, nil
+}
+
+// authFailure sets the WWW-Authenticate challenge for an authenticate
+// error and returns the status code and message to respond with.
+func authFailure(w http.ResponseWriter, err error) (int, string) {
+	var tokenErr *auth.TokenError
+	var scopeErr *scopeError
+	switch {
+	case errors.Is(err, errMissingCredentials):
+		return 401, "Something went wrong"
+	case errors.Is(err, errInvalidAPIKey):
+		w.Header().Set("WWW-Authenticate", `ApiKey error="invalid_key"`)
+		return 401, "Invalid API key"
+	case errors.Is(err, errPendingDeletion):
+		return 403, "Account is scheduled for deletion. Log in to cancel it"
+	case errors.As(err, &scopeErr):
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s error="insufficient_scope", scope=%q`, scopeErr.Scheme, scopeErr.Scope))
+		return 403, scopeErr.Error()
+	case errors.As(err, &tokenErr):
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		return 401, tokenErrorMessage(err)
+	default:
+		log.Printf("Error authenticating request: %s", err)
+		return 500, "Something went wrong"
+	}
+}
+
+func (cfg *apiConfig) handleCreateAPIKey(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	name := strings.TrimSpace(params.Name)
+	scopes, err := auth.ParseScopes(params.Scopes)
+	if name == "" || len(name) > maxAPIKeyNameLength {
+		err = fmt.Errorf("Name must be between 1 and %d characters", maxAPIKeyNameLength)
+	}
+	if err != nil {
+		respBody := errResp{
+			Error : err.Error(),
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	key, prefix, err := auth.MakeAPIKey()
+	if err != nil {
+		log.Printf("Error generating API key: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	apiKey, err := cfg.db.CreateAPIKey(req.Context(), database.CreateAPIKeyParams{
+		UserID : userID,
+		Name : name,
+		Prefix : prefix,
+		KeyHash : auth.HashToken(key),
+		Scopes : scopes,
+	})
+	if err != nil {
+		log.Printf("Error storing API key: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "api_key.created")
+
+	// The plain key is only ever shown in this response.
+	mapped := mapAPIKey(apiKey)
+	mapped.Key = key
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(201)
+	w.Write(dat)
+	return
+}
+
+func (cfg *apiConfig) handleListAPIKeys(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	apiKeys, err := cfg.db.ListAPIKeys(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing API keys: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped := []APIKey{}
+	for _, apiKey := range apiKeys {
+		mapped = append(mapped, mapAPIKey(apiKey))
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
+
+func (cfg *apiConfig) handleRevokeAPIKey(w http.ResponseWriter, req *http.Request) {
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	keyID, err := uuid.Parse(req.PathValue("keyID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	rows, err := cfg.db.RevokeAPIKey(req.Context(), database.RevokeAPIKeyParams{
+		ID : keyID,
+		UserID : userID,
+	})
+	if err != nil {
+		log.Printf("Error revoking API key: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if rows == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "api_key.revoked")
+
+	w.WriteHeader(204)
+	return
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+// Who caused an audit event. Only user and admin actors have an ID.
+const (
+	actorUser      = "user"
+	actorAdmin     = "admin"
+	actorAnonymous = "anonymous"
+	actorSystem    = "system"
+	actorPolka     = "polka"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+type auditEntry struct {
+	UserID    uuid.UUID
+	ActorType string
+	ActorID   uuid.UUID
+	Event     string
+	Metadata  map[string]string
+}
+
+type SecurityEvent struct {
+	ID        uuid.UUID       `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Event     string          `json:"event"`
+	UserID    *uuid.UUID      `json:"user_id,omitempty"`
+	ActorType string          `json:"actor_type"`
+	ActorID   *uuid.UUID      `json:"actor_id,omitempty"`
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	RequestID string          `json:"request_id"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// mapSecurityEvent leaves out the user and actor IDs unless full is set,
+// so users see what happened to their account but not which admin did it.
+func mapSecurityEvent(event database.AuditEvent, full bool) SecurityEvent {
+	mapped := SecurityEvent{
+		ID : event.ID,
+		CreatedAt : event.CreatedAt,
+		Event : event.Event,
+		ActorType : event.ActorType,
+		IP : event.Ip,
+		UserAgent : event.UserAgent,
+		RequestID : event.RequestID,
+		Metadata : event.Metadata,
+	}
+	if full && event.UserID.Valid {
+		mapped.UserID = &event.UserID.UUID
+	}
+	if full && event.ActorID.Valid {
+		mapped.ActorID = &event.ActorID.UUID
+	}
+	return mapped
+}
+
+// recordAudit appends an entry to the audit log. req is nil for events
+// raised by background jobs, which have no IP or request ID.
+func (cfg *apiConfig) recordAudit(ctx context.Context, req *http.Request, entry auditEntry) {
+	if entry.Metadata == nil {
+		entry.Metadata = map[string]string{}
+	}
+	metadata, err := json.Marshal(entry.Metadata)
+	if err != nil {
+		log.Printf("Error recording audit event %s: %s", entry.Event, err)
+		return
+	}
+	params := database.CreateAuditEventParams{
+		UserID : uuid.NullUUID{
+			UUID : entry.UserID,
+			Valid : entry.UserID != uuid.Nil,
+		},
+		Event : entry.Event,
+		ActorType : entry.ActorType,
+		ActorID : uuid.NullUUID{
+			UUID : entry.ActorID,
+			Valid : entry.ActorID != uuid.Nil,
+		},
+		Metadata : metadata,
+	}
+	if req != nil {
+		params.Ip = clientIP(req)
+		params.UserAgent = req.UserAgent()
+		params.RequestID = requestID(req.Context())
+	}
+	err = cfg.db.CreateAuditEvent(ctx, params)
+	if err != nil {
+		log.Printf("Error recording audit event %s: %s", entry.Event, err)
+	}
+}
+
+// recordAuditEvent records something a user did to their own account.
+func (cfg *apiConfig) recordAuditEvent(ctx context.Context, req *http.Request, userID uuid.UUID, event string) {
+	cfg.recordAudit(ctx, req, auditEntry{
+		UserID : userID,
+		ActorType : actorUser,
+		ActorID : userID,
+		Event : event,
+	})
+}
+
+// recordLogin records a successful sign in and how it was made.
+func (cfg *apiConfig) recordLogin(ctx context.Context, req *http.Request, userID uuid.UUID, method string) {
+	cfg.recordAudit(ctx, req, auditEntry{
+		UserID : userID,
+		ActorType : actorUser,
+		ActorID : userID,
+		Event : "user.login",
+		Metadata : map[string]string{
+			"method" : method,
+		},
+	})
+}
+
+// auditPage reads the limit and before query parameters shared by the
+// audit log endpoints.
+func auditPage(req *http.Request) (int32, sql.NullTime, bool) {
+	limit := int32(defaultAuditPageSize)
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditPageSize {
+			return 0, sql.NullTime{}, false
+		}
+		limit = int32(n)
+	}
+	before := sql.NullTime{}
+	if v := req.URL.Query().Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, sql.NullTime{}, false
+		}
+		before = sql.NullTime{
+			Time : t,
+			Valid : true,
+		}
+	}
+	return limit, before, true
+}
+
+func writeSecurityEvents(w http.ResponseWriter, events []database.AuditEvent, full bool) {
+	mapped := []SecurityEvent{}
+	for _, event := range events {
+		mapped = append(mapped, mapSecurityEvent(event, full))
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handleListSecurityEvents(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	limit, before, ok := auditPage(req)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	events, err := cfg.db.ListAuditEvents(req.Context(), database.ListAuditEventsParams{
+		UserID : uuid.NullUUID{
+			UUID : userID,
+			Valid : true,
+		},
+		Before : before,
+		Limit : limit,
+	})
+	if err != nil {
+		log.Printf("Error listing security events: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	writeSecurityEvents(w, events, false)
+}
+
+// adminUser authenticates a request to an admin endpoint. Only a session
+// access token of a user with is_admin will do; API keys and OAuth tokens
+// never grant admin access.
+func (cfg *apiConfig) adminUser(w http.ResponseWriter, req *http.Request) (database.User, bool) {
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return database.User{}, false
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return database.User{}, false
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil || !user.IsAdmin {
+		w.WriteHeader(403)
+		return database.User{}, false
+	}
+	return user, true
+}
+
+func (cfg *apiConfig) handleListAuditEvents(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	admin, ok := cfg.adminUser(w, req)
+	if !ok {
+		return
+	}
+
+	limit, before, ok := auditPage(req)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	query := req.URL.Query()
+	params := database.ListAuditEventsParams{
+		Event : sql.NullString{
+			String : query.Get("event"),
+			Valid : query.Get("event") != "",
+		},
+		Before : before,
+		Limit : limit,
+	}
+	if v := query.Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		params.UserID = uuid.NullUUID{UUID : id, Valid : true}
+	}
+	if v := query.Get("actor_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		params.ActorID = uuid.NullUUID{UUID : id, Valid : true}
+	}
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		params.Since = sql.NullTime{Time : t, Valid : true}
+	}
+
+	events, err := cfg.db.ListAuditEvents(req.Context(), params)
+	if err != nil {
+		log.Printf("Error listing audit events: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	// Reading the log is itself recorded, so admins are accountable for
+	// looking at other users' activity.
+	cfg.recordAudit(req.Context(), req, auditEntry{
+		ActorType : actorAdmin,
+		ActorID : admin.ID,
+		Event : "admin.audit_log_viewed",
+		Metadata : map[string]string{
+			"query" : req.URL.RawQuery,
+		},
+	})
+	writeSecurityEvents(w, events, true)
+}
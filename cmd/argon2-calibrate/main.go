@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/auth"
+)
+
+// argon2-calibrate benchmarks argon2id on the current machine and prints the
+// ARGON2_* settings that reach the target hashing time.
+func main() {
+	target := flag.Duration("target", 250 * time.Millisecond, "how long one password hash should take")
+	maxMemory := flag.Uint("max-memory", 256 * 1024, "memory ceiling in KiB")
+	parallelism := flag.Uint("parallelism", uint(auth.DefaultPasswordHashParams().Parallelism), "argon2id threads")
+	rounds := flag.Int("rounds", 3, "hashes averaged per measurement")
+	flag.Parse()
+
+	if *parallelism == 0 || *parallelism > 255 || *maxMemory == 0 || *rounds < 1 {
+		fmt.Println("invalid flags")
+		os.Exit(1)
+	}
+
+	params, elapsed, err := auth.CalibratePasswordHashParams(*target, uint32(*maxMemory), uint8(*parallelism), func(p auth.PasswordHashParams) (time.Duration, error) {
+		return auth.MeasurePasswordHash(p, *rounds)
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("# %s per hash\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("ARGON2_MEMORY=%d\n", params.Memory)
+	fmt.Printf("ARGON2_ITERATIONS=%d\n", params.Iterations)
+	fmt.Printf("ARGON2_PARALLELISM=%d\n", params.Parallelism)
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/dataexport"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	dataExportTTL           = 7 * 24 * time.Hour
+	dataExportURLTTL        = 15 * time.Minute
+	dataExportSweepInterval = time.Minute
+)
+
+type DataExport struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Status      string     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+func (cfg *apiConfig) mapDataExport(export database.DataExport) DataExport {
+	mapped := DataExport{
+		ID : export.ID,
+		CreatedAt : export.CreatedAt,
+		Status : export.Status,
+	}
+	if export.CompletedAt.Valid {
+		mapped.CompletedAt = &export.CompletedAt.Time
+	}
+	if export.ExpiresAt.Valid {
+		mapped.ExpiresAt = &export.ExpiresAt.Time
+	}
+	if export.Status == "ready" && export.ExpiresAt.Valid && export.ExpiresAt.Time.After(time.Now()) {
+		path := fmt.Sprintf("/api/exports/%s/download", export.ID)
+		mapped.DownloadURL = cfg.baseURL + auth.SignURL(cfg.exportKey, path, time.Now().Add(dataExportURLTTL))
+	}
+	return mapped
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatNullTime(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return formatTime(t.Time)
+}
+
+// dataExportSections collects everything stored about a user. Token
+// values, password hashes and TOTP secrets are left out: they are
+// credentials rather than personal data, and the archive may end up
+// somewhere less safe than the database.
+func (cfg *apiConfig) dataExportSections(ctx context.Context, userID uuid.UUID) ([]dataexport.Section, error) {
+	type profile struct {
+		ID                  uuid.UUID  `json:"id"`
+		CreatedAt           time.Time  `json:"created_at"`
+		UpdatedAt           time.Time  `json:"updated_at"`
+		Email               string     `json:"email"`
+		EmailVerified       bool       `json:"email_verified"`
+		IsChirpyRed         bool       `json:"is_chirpy_red"`
+		HasPassword         bool       `json:"has_password"`
+		TwoFactorEnabled    bool       `json:"two_factor_enabled"`
+		DeletionScheduledAt *time.Time `json:"deletion_scheduled_at"`
+	}
+	type session struct {
+		CreatedAt     time.Time     `json:"created_at"`
+		ExpiresAt     time.Time     `json:"expires_at"`
+		RevokedAt     *time.Time    `json:"revoked_at"`
+		OAuthClientID uuid.NullUUID `json:"oauth_client_id"`
+		Scopes        []string      `json:"scopes"`
+	}
+	type identity struct {
+		CreatedAt time.Time `json:"created_at"`
+		Issuer    string    `json:"issuer"`
+		Subject   string    `json:"subject"`
+		Email     string    `json:"email"`
+	}
+	type subscriptionPeriod struct {
+		StartsAt        time.Time  `json:"starts_at"`
+		EndsAt          *time.Time `json:"ends_at"`
+		PaymentFailedAt *time.Time `json:"payment_failed_at"`
+	}
+	type securityEvent struct {
+		CreatedAt time.Time `json:"created_at"`
+		Event     string    `json:"event"`
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"user_agent"`
+	}
+
+	user, err := cfg.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	totp, err := cfg.db.GetUserTOTP(ctx, userID)
+	p := profile{
+		ID : user.ID,
+		CreatedAt : user.CreatedAt,
+		UpdatedAt : user.UpdatedAt,
+		Email : user.Email,
+		EmailVerified : user.EmailVerifiedAt.Valid,
+		IsChirpyRed : user.IsChirpyRed,
+		HasPassword : user.HashedPassword.Valid,
+		TwoFactorEnabled : err == nil && totp.ConfirmedAt.Valid,
+	}
+	if user.DeletionScheduledAt.Valid {
+		p.DeletionScheduledAt = &user.DeletionScheduledAt.Time
+	}
+
+	dbChirps, err := cfg.db.GetChirpsByAuthor(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	chirpRows := [][]string{}
+	for _, chirp := range dbChirps {
+		chirps = append(chirps, Chirp{
+			ID : chirp.ID,
+			CreatedAt : chirp.CreatedAt,
+			UpdatedAt : chirp.UpdatedAt,
+			Body : chirp.Body,
+			UserID : chirp.UserID,
+		})
+		chirpRows = append(chirpRows, []string{formatTime(chirp.CreatedAt), chirp.Body})
+	}
+
+	dbMessages, err := cfg.db.ListMessagesBySender(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	messages := []Message{}
+	messageRows := [][]string{}
+	for _, message := range dbMessages {
+		messages = append(messages, mapMessage(message))
+		messageRows = append(messageRows, []string{formatTime(message.CreatedAt), message.ConversationID.String(), message.Body})
+	}
+
+	dbBlocks, err := cfg.db.ListBlockedUsers(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []BlockedUser{}
+	blockRows := [][]string{}
+	for _, block := range dbBlocks {
+		blocks = append(blocks, BlockedUser{
+			UserID : block.BlockedID,
+			CreatedAt : block.CreatedAt,
+		})
+		blockRows = append(blockRows, []string{formatTime(block.CreatedAt), block.BlockedID.String()})
+	}
+
+	refreshTokens, err := cfg.db.ListUserRefreshTokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []session{}
+	sessionRows := [][]string{}
+	for _, token := range refreshTokens {
+		s := session{
+			CreatedAt : token.CreatedAt,
+			ExpiresAt : token.ExpiresAt,
+			OAuthClientID : token.ClientID,
+			Scopes : token.Scopes,
+		}
+		if token.RevokedAt.Valid {
+			s.RevokedAt = &token.RevokedAt.Time
+		}
+		client := ""
+		if token.ClientID.Valid {
+			client = token.ClientID.UUID.String()
+		}
+		sessions = append(sessions, s)
+		sessionRows = append(sessionRows, []string{formatTime(token.CreatedAt), formatTime(token.ExpiresAt), formatNullTime(token.RevokedAt), client})
+	}
+
+	dbAPIKeys, err := cfg.db.ListAPIKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := []APIKey{}
+	apiKeyRows := [][]string{}
+	for _, key := range dbAPIKeys {
+		apiKeys = append(apiKeys, mapAPIKey(key))
+		apiKeyRows = append(apiKeyRows, []string{formatTime(key.CreatedAt), key.Name, key.Prefix, strings.Join(key.Scopes, " ")})
+	}
+
+	dbClients, err := cfg.db.ListOAuthClients(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	clients := []OAuthClient{}
+	clientRows := [][]string{}
+	for _, client := range dbClients {
+		clients = append(clients, mapOAuthClient(client))
+		clientRows = append(clientRows, []string{formatTime(client.CreatedAt), client.ID.String(), client.Name, strings.Join(client.RedirectUris, " ")})
+	}
+
+	dbEndpoints, err := cfg.db.ListWebhookEndpoints(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []WebhookEndpoint{}
+	endpointRows := [][]string{}
+	for _, endpoint := range dbEndpoints {
+		endpoints = append(endpoints, mapWebhookEndpoint(endpoint))
+		endpointRows = append(endpointRows, []string{formatTime(endpoint.CreatedAt), endpoint.Url, strings.Join(endpoint.Events, " "), endpoint.Description})
+	}
+
+	dbIdentities, err := cfg.db.ListUserIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	identities := []identity{}
+	identityRows := [][]string{}
+	for _, i := range dbIdentities {
+		identities = append(identities, identity{
+			CreatedAt : i.CreatedAt,
+			Issuer : i.Issuer,
+			Subject : i.Subject,
+			Email : i.Email,
+		})
+		identityRows = append(identityRows, []string{formatTime(i.CreatedAt), i.Issuer, i.Subject, i.Email})
+	}
+
+	dbPeriods, err := cfg.db.ListUserSubscriptionPeriods(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	periods := []subscriptionPeriod{}
+	periodRows := [][]string{}
+	for _, period := range dbPeriods {
+		sp := subscriptionPeriod{
+			StartsAt : period.StartsAt,
+		}
+		if period.EndsAt.Valid {
+			sp.EndsAt = &period.EndsAt.Time
+		}
+		if period.PaymentFailedAt.Valid {
+			sp.PaymentFailedAt = &period.PaymentFailedAt.Time
+		}
+		periods = append(periods, sp)
+		periodRows = append(periodRows, []string{formatTime(period.StartsAt), formatNullTime(period.EndsAt), formatNullTime(period.PaymentFailedAt)})
+	}
+
+	dbEvents, err := cfg.db.ListUserAuditEvents(ctx, uuid.NullUUID{
+		UUID : userID,
+		Valid : true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := []securityEvent{}
+	eventRows := [][]string{}
+	for _, event := range dbEvents {
+		events = append(events, securityEvent{
+			CreatedAt : event.CreatedAt,
+			Event : event.Event,
+			IP : event.Ip,
+			UserAgent : event.UserAgent,
+		})
+		eventRows = append(eventRows, []string{formatTime(event.CreatedAt), event.Event, event.Ip, event.UserAgent})
+	}
+
+	return []dataexport.Section{
+		{
+			Name : "profile",
+			Title : "Profile",
+			Columns : []string{"Email", "Created", "Email verified", "Chirpy Red", "Two-factor authentication"},
+			Rows : [][]string{{p.Email, formatTime(p.CreatedAt), fmt.Sprint(p.EmailVerified), fmt.Sprint(p.IsChirpyRed), fmt.Sprint(p.TwoFactorEnabled)}},
+			Data : p,
+		},
+		{
+			Name : "chirps",
+			Title : "Chirps",
+			Columns : []string{"Posted", "Chirp"},
+			Rows : chirpRows,
+			Data : chirps,
+		},
+		{
+			Name : "messages",
+			Title : "Sent messages",
+			Columns : []string{"Sent", "Conversation", "Message"},
+			Rows : messageRows,
+			Data : messages,
+		},
+		{
+			Name : "blocked_users",
+			Title : "Blocked users",
+			Columns : []string{"Blocked", "User ID"},
+			Rows : blockRows,
+			Data : blocks,
+		},
+		{
+			Name : "sessions",
+			Title : "Sessions",
+			Columns : []string{"Signed in", "Expires", "Revoked", "OAuth client"},
+			Rows : sessionRows,
+			Data : sessions,
+		},
+		{
+			Name : "api_keys",
+			Title : "API keys",
+			Columns : []string{"Created", "Name", "Prefix", "Scopes"},
+			Rows : apiKeyRows,
+			Data : apiKeys,
+		},
+		{
+			Name : "oauth_clients",
+			Title : "OAuth clients",
+			Columns : []string{"Created", "Client ID", "Name", "Redirect URIs"},
+			Rows : clientRows,
+			Data : clients,
+		},
+		{
+			Name : "webhook_endpoints",
+			Title : "Webhook endpoints",
+			Columns : []string{"Created", "URL", "Events", "Description"},
+			Rows : endpointRows,
+			Data : endpoints,
+		},
+		{
+			Name : "identities",
+			Title : "Linked identities",
+			Columns : []string{"Linked", "Issuer", "Subject", "Email"},
+			Rows : identityRows,
+			Data : identities,
+		},
+		{
+			Name : "subscription",
+			Title : "Chirpy Red subscription",
+			Columns : []string{"Starts", "Ends", "Payment failed"},
+			Rows : periodRows,
+			Data : periods,
+		},
+		{
+			Name : "security_events",
+			Title : "Security events",
+			Columns : []string{"Time", "Event", "IP", "User agent"},
+			Rows : eventRows,
+			Data : events,
+		},
+	}, nil
+}
+
+func (cfg *apiConfig) buildDataExport(ctx context.Context, export database.DataExport) error {
+	sections, err := cfg.dataExportSections(ctx, export.UserID)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	err = dataexport.Write(buf, time.Now(), sections)
+	if err != nil {
+		return err
+	}
+	err = cfg.db.SaveDataExportArchive(ctx, database.SaveDataExportArchiveParams{
+		ExportID : export.ID,
+		Archive : buf.Bytes(),
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.db.CompleteDataExport(ctx, database.CompleteDataExportParams{
+		ID : export.ID,
+		ExpiresAt : sql.NullTime{
+			Time : time.Now().Add(dataExportTTL),
+			Valid : true,
+		},
+	})
+}
+
+func (cfg *apiConfig) sendDataExportReadyEmail(ctx context.Context, userID uuid.UUID) error {
+	user, err := cfg.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : user.Email,
+		Subject : "Your Chirpy data export is ready",
+		Body : "The copy of your Chirpy data you asked for is ready. Log in to download it within the next 7 days.\n",
+	})
+}
+
+// buildDataExports builds every pending export. Exports are claimed with
+// SKIP LOCKED, so several instances can run this at once, and an export
+// left building by a crashed instance is picked up again after a while.
+func (cfg *apiConfig) buildDataExports(ctx context.Context) {
+	err := cfg.db.DeleteExpiredDataExports(ctx)
+	if err != nil {
+		log.Printf("Error deleting expired data exports: %s", err)
+	}
+	for {
+		export, err := cfg.db.ClaimDataExport(ctx)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Error claiming data export: %s", err)
+			return
+		}
+		err = cfg.buildDataExport(ctx, export)
+		if err != nil {
+			log.Printf("Error building data export %s: %s", export.ID, err)
+			err = cfg.db.FailDataExport(ctx, export.ID)
+			if err != nil {
+				log.Printf("Error marking data export %s failed: %s", export.ID, err)
+			}
+			continue
+		}
+		err = cfg.sendDataExportReadyEmail(ctx, export.UserID)
+		if err != nil {
+			log.Printf("Error sending data export email: %s", err)
+		}
+	}
+}
+
+func (cfg *apiConfig) runDataExports(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cfg.buildDataExports(context.Background())
+		select {
+		case <-ticker.C:
+		case <-cfg.exportWake:
+		}
+	}
+}
+
+func (cfg *apiConfig) handleCreateDataExport(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	// Only one export is built per user at a time; asking again while it
+	// is in progress returns the same one.
+	export, err := cfg.db.GetUnfinishedDataExport(req.Context(), userID)
+	if err == sql.ErrNoRows {
+		export, err = cfg.db.CreateDataExport(req.Context(), userID)
+		if err == nil {
+			cfg.recordAuditEvent(req.Context(), req, userID, "user.data_export_requested")
+			select {
+			case cfg.exportWake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error creating data export: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	dat, err := json.Marshal(cfg.mapDataExport(export))
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(202)
+	w.Write(dat)
+	return
+}
+
+func (cfg *apiConfig) handleGetDataExport(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	exportID, err := uuid.Parse(req.PathValue("exportID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	export, err := cfg.db.GetDataExport(req.Context(), database.GetDataExportParams{
+		ID : exportID,
+		UserID : userID,
+	})
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	dat, err := json.Marshal(cfg.mapDataExport(export))
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
+
+// handleDownloadDataExport needs no credentials: the signed URL handed
+// out by handleGetDataExport is the credential, so it can be opened
+// directly in a browser.
+func (cfg *apiConfig) handleDownloadDataExport(w http.ResponseWriter, req *http.Request) {
+	err := auth.VerifySignedURL(cfg.exportKey, req.URL.Path, req.URL.Query(), time.Now())
+	if err != nil {
+		w.WriteHeader(403)
+		return
+	}
+	exportID, err := uuid.Parse(req.PathValue("exportID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	archive, err := cfg.db.GetDataExportArchive(req.Context(), exportID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading data export: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%s.zip"`, time.Now().Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(200)
+	w.Write(archive)
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	maxMessageLength            = 2000
+	maxConversationParticipants = 10
+)
+
+const (
+	eventMessageCreated = "message.created"
+	eventMessageDeleted = "message.deleted"
+)
+
+type Conversation struct {
+	ID           uuid.UUID                 `json:"id"`
+	CreatedAt    time.Time                 `json:"created_at"`
+	UpdatedAt    time.Time                 `json:"updated_at"`
+	Type         string                    `json:"type"`
+	Participants []ConversationParticipant `json:"participants"`
+	UnreadCount  int64                     `json:"unread_count"`
+}
+
+type ConversationParticipant struct {
+	UserID            uuid.UUID  `json:"user_id"`
+	JoinedAt          time.Time  `json:"joined_at"`
+	LastReadMessageID *uuid.UUID `json:"last_read_message_id"`
+}
+
+type Message struct {
+	ID             uuid.UUID  `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	ConversationID uuid.UUID  `json:"conversation_id"`
+	SenderID       uuid.UUID  `json:"sender_id"`
+	Body           string     `json:"body"`
+	DeletedAt      *time.Time `json:"deleted_at"`
+}
+
+func mapMessage(message database.Message) Message {
+	mapped := Message{
+		ID : message.ID,
+		CreatedAt : message.CreatedAt,
+		UpdatedAt : message.UpdatedAt,
+		ConversationID : message.ConversationID,
+		SenderID : message.SenderID,
+		Body : message.Body,
+	}
+	if message.DeletedAt.Valid {
+		mapped.DeletedAt = &message.DeletedAt.Time
+	}
+	return mapped
+}
+
+// directKey names the one-to-one conversation between two users, whichever
+// of them starts it.
+func directKey(a, b uuid.UUID) string {
+	if b.String() < a.String() {
+		a, b = b, a
+	}
+	return a.String() + ":" + b.String()
+}
+
+// mapConversations adds the participants and the user's unread count to
+// each conversation.
+func (cfg *apiConfig) mapConversations(ctx context.Context, userID uuid.UUID, conversations []database.Conversation) ([]Conversation, error) {
+	ids := []uuid.UUID{}
+	for _, conversation := range conversations {
+		ids = append(ids, conversation.ID)
+	}
+	participants, err := cfg.db.ListConversationParticipants(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := cfg.db.CountUnreadMessages(ctx, database.CountUnreadMessagesParams{
+		UserID : userID,
+		ConversationIds : ids,
+	})
+	if err != nil {
+		return nil, err
+	}
+	unreadCounts := map[uuid.UUID]int64{}
+	for _, row := range unread {
+		unreadCounts[row.ConversationID] = row.UnreadCount
+	}
+
+	mapped := []Conversation{}
+	for _, conversation := range conversations {
+		c := Conversation{
+			ID : conversation.ID,
+			CreatedAt : conversation.CreatedAt,
+			UpdatedAt : conversation.UpdatedAt,
+			Type : "group",
+			Participants : []ConversationParticipant{},
+			UnreadCount : unreadCounts[conversation.ID],
+		}
+		if conversation.DirectKey.Valid {
+			c.Type = "direct"
+		}
+		for _, participant := range participants {
+			if participant.ConversationID != conversation.ID {
+				continue
+			}
+			p := ConversationParticipant{
+				UserID : participant.UserID,
+				JoinedAt : participant.JoinedAt,
+			}
+			if participant.LastReadMessageID.Valid {
+				p.LastReadMessageID = &participant.LastReadMessageID.UUID
+			}
+			c.Participants = append(c.Participants, p)
+		}
+		mapped = append(mapped, c)
+	}
+	return mapped, nil
+}
+
+// writeMessageEvent tells the conversation's participants, the sender
+// included for their other devices, about a message. Participants who
+// blocked the sender are left out, as they are from the history.
+func writeMessageEvent(ctx context.Context, q *database.Queries, eventType string, message database.Message) error {
+	participants, err := q.ListConversationParticipants(ctx, []uuid.UUID{message.ConversationID})
+	if err != nil {
+		return err
+	}
+	userIDs := []uuid.UUID{}
+	for _, participant := range participants {
+		userIDs = append(userIDs, participant.UserID)
+	}
+	blockers, err := q.ListBlockersAmong(ctx, database.ListBlockersAmongParams{
+		BlockedID : message.SenderID,
+		UserIds : userIDs,
+	})
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if slices.Contains(blockers, userID) {
+			continue
+		}
+		err = writeOutboxEvent(ctx, q, userID, eventType, mapMessage(message))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userConversation loads a conversation from the path if the authenticated
+// user takes part in it, writing the error response if that fails.
+func (cfg *apiConfig) userConversation(w http.ResponseWriter, req *http.Request, scope string) (uuid.UUID, database.Conversation, bool) {
+	userID, err := cfg.authenticate(req, scope)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return uuid.Nil, database.Conversation{}, false
+	}
+
+	conversationID, err := uuid.Parse(req.PathValue("conversationID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return uuid.Nil, database.Conversation{}, false
+	}
+	conversation, err := cfg.db.GetConversationForUser(req.Context(), database.GetConversationForUserParams{
+		ID : conversationID,
+		UserID : userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(404)
+		return uuid.Nil, database.Conversation{}, false
+	}
+	if err != nil {
+		log.Printf("Error loading conversation: %s", err)
+		w.WriteHeader(500)
+		return uuid.Nil, database.Conversation{}, false
+	}
+	return userID, conversation, true
+}
+
+// handleCreateConversation starts a conversation with one other user, or
+// returns the one they already have, or starts a group with several.
+func (cfg *apiConfig) handleCreateConversation(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		ParticipantIDs []uuid.UUID `json:"participant_ids"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	respond := func(status int, body any) {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(dat)
+	}
+
+	userID, err := cfg.authenticate(req, auth.ScopeMessagesWrite)
+	if err != nil {
+		status, message := authFailure(w, err)
+		respond(status, errResp{
+			Error : message,
+		})
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	others := []uuid.UUID{}
+	for _, id := range params.ParticipantIDs {
+		if id != userID && !slices.Contains(others, id) {
+			others = append(others, id)
+		}
+	}
+	if len(others) == 0 {
+		respond(400, errResp{
+			Error : "At least one other participant is required",
+		})
+		return
+	}
+	if len(others) >= maxConversationParticipants {
+		respond(400, errResp{
+			Error : fmt.Sprintf("A conversation can have at most %d participants", maxConversationParticipants),
+		})
+		return
+	}
+	for _, id := range others {
+		_, err := cfg.db.GetUserByID(req.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			respond(400, errResp{
+				Error : fmt.Sprintf("User %s does not exist", id),
+			})
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading user: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	blocked, err := cfg.db.HasBlockBetween(req.Context(), database.HasBlockBetweenParams{
+		UserID : userID,
+		OtherIds : others,
+	})
+	if err != nil {
+		log.Printf("Error checking blocks: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if blocked {
+		respond(403, errResp{
+			Error : "You cannot message this user",
+		})
+		return
+	}
+
+	directKeyValue := sql.NullString{}
+	if len(others) == 1 {
+		directKeyValue = sql.NullString{
+			String : directKey(userID, others[0]),
+			Valid : true,
+		}
+	}
+
+	// Two users can start the same direct conversation at once. The insert
+	// waits for the other one to commit and then does nothing, and the
+	// conversation it created is returned instead.
+	var conversation database.Conversation
+	created := true
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		conversation, err = q.CreateConversation(req.Context(), directKeyValue)
+		if errors.Is(err, sql.ErrNoRows) {
+			created = false
+			conversation, err = q.GetDirectConversation(req.Context(), directKeyValue)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		for _, id := range append([]uuid.UUID{userID}, others...) {
+			err = q.AddConversationParticipant(req.Context(), database.AddConversationParticipantParams{
+				ConversationID : conversation.ID,
+				UserID : id,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error creating conversation: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped, err := cfg.mapConversations(req.Context(), userID, []database.Conversation{conversation})
+	if err != nil {
+		log.Printf("Error loading conversation: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if !created {
+		respond(200, mapped[0])
+		return
+	}
+	respond(201, mapped[0])
+}
+
+func (cfg *apiConfig) handleListConversations(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeMessagesRead)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	limit, before, ok := auditPage(req)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	conversations, err := cfg.db.ListConversations(req.Context(), database.ListConversationsParams{
+		UserID : userID,
+		Before : before,
+		Limit : limit,
+	})
+	if err != nil {
+		log.Printf("Error listing conversations: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped, err := cfg.mapConversations(req.Context(), userID, conversations)
+	if err != nil {
+		log.Printf("Error loading conversations: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handleGetConversation(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, conversation, ok := cfg.userConversation(w, req, auth.ScopeMessagesRead)
+	if !ok {
+		return
+	}
+	mapped, err := cfg.mapConversations(req.Context(), userID, []database.Conversation{conversation})
+	if err != nil {
+		log.Printf("Error loading conversation: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(mapped[0])
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handleLeaveConversation takes the user out of a group. One-to-one
+// conversations cannot be left; blocking the other user ends them.
+func (cfg *apiConfig) handleLeaveConversation(w http.ResponseWriter, req *http.Request) {
+	userID, conversation, ok := cfg.userConversation(w, req, auth.ScopeMessagesWrite)
+	if !ok {
+		return
+	}
+	if conversation.DirectKey.Valid {
+		w.WriteHeader(400)
+		return
+	}
+
+	err := cfg.inTx(req.Context(), func(q *database.Queries) error {
+		_, err := q.RemoveConversationParticipant(req.Context(), database.RemoveConversationParticipantParams{
+			ConversationID : conversation.ID,
+			UserID : userID,
+		})
+		if err != nil {
+			return err
+		}
+		return q.DeleteEmptyConversation(req.Context(), conversation.ID)
+	})
+	if err != nil {
+		log.Printf("Error leaving conversation: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handleListMessages returns a page of the history, newest first. The
+// cursor is a message ID rather than a time, since messages can share one.
+func (cfg *apiConfig) handleListMessages(w http.ResponseWriter, req *http.Request) {
+	type messagesResp struct {
+		Messages   []Message  `json:"messages"`
+		NextBefore *uuid.UUID `json:"next_before"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, conversation, ok := cfg.userConversation(w, req, auth.ScopeMessagesRead)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	limit := int32(defaultAuditPageSize)
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditPageSize {
+			w.WriteHeader(400)
+			return
+		}
+		limit = int32(n)
+	}
+	beforeID := uuid.NullUUID{}
+	if v := query.Get("before"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		_, err = cfg.db.GetMessage(req.Context(), database.GetMessageParams{
+			ID : id,
+			ConversationID : conversation.ID,
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(400)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading message: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		beforeID = uuid.NullUUID{
+			UUID : id,
+			Valid : true,
+		}
+	}
+
+	messages, err := cfg.db.ListMessages(req.Context(), database.ListMessagesParams{
+		ConversationID : conversation.ID,
+		ReaderID : userID,
+		BeforeID : beforeID,
+		Limit : limit,
+	})
+	if err != nil {
+		log.Printf("Error listing messages: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	resp := messagesResp{
+		Messages : []Message{},
+	}
+	for _, message := range messages {
+		resp.Messages = append(resp.Messages, mapMessage(message))
+	}
+	if len(messages) == int(limit) {
+		resp.NextBefore = &messages[len(messages) - 1].ID
+	}
+	dat, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handleSendMessage(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	respond := func(status int, body any) {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(dat)
+	}
+
+	userID, conversation, ok := cfg.userConversation(w, req, auth.ScopeMessagesWrite)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if strings.TrimSpace(params.Body) == "" {
+		respond(400, errResp{
+			Error : "Message is empty",
+		})
+		return
+	}
+	if len(params.Body) > maxMessageLength {
+		respond(400, errResp{
+			Error : "Message is too long",
+		})
+		return
+	}
+
+	// In a group a block only hides the blocked user's messages from the
+	// user who blocked them; between two users it stops the conversation.
+	if conversation.DirectKey.Valid {
+		participants, err := cfg.db.ListConversationParticipants(req.Context(), []uuid.UUID{conversation.ID})
+		if err != nil {
+			log.Printf("Error loading participants: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		others := []uuid.UUID{}
+		for _, participant := range participants {
+			if participant.UserID != userID {
+				others = append(others, participant.UserID)
+			}
+		}
+		blocked, err := cfg.db.HasBlockBetween(req.Context(), database.HasBlockBetweenParams{
+			UserID : userID,
+			OtherIds : others,
+		})
+		if err != nil {
+			log.Printf("Error checking blocks: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		if blocked {
+			respond(403, errResp{
+				Error : "You cannot message this user",
+			})
+			return
+		}
+	}
+
+	var message database.Message
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		message, err = q.CreateMessage(req.Context(), database.CreateMessageParams{
+			ConversationID : conversation.ID,
+			SenderID : userID,
+			Body : censorString(params.Body),
+		})
+		if err != nil {
+			return err
+		}
+		err = q.TouchConversation(req.Context(), conversation.ID)
+		if err != nil {
+			return err
+		}
+		return writeMessageEvent(req.Context(), q, eventMessageCreated, message)
+	})
+	if err != nil {
+		log.Printf("Error sending message: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	respond(201, mapMessage(message))
+}
+
+// handleDeleteMessage lets the sender take back a message. Its text is
+// erased, but it stays in the history as deleted.
+func (cfg *apiConfig) handleDeleteMessage(w http.ResponseWriter, req *http.Request) {
+	userID, conversation, ok := cfg.userConversation(w, req, auth.ScopeMessagesWrite)
+	if !ok {
+		return
+	}
+
+	messageID, err := uuid.Parse(req.PathValue("messageID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	message, err := cfg.db.GetMessage(req.Context(), database.GetMessageParams{
+		ID : messageID,
+		ConversationID : conversation.ID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading message: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if message.SenderID != userID {
+		w.WriteHeader(403)
+		return
+	}
+	if message.DeletedAt.Valid {
+		w.WriteHeader(204)
+		return
+	}
+
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		rows, err := q.DeleteMessage(req.Context(), database.DeleteMessageParams{
+			ID : message.ID,
+			ConversationID : conversation.ID,
+			SenderID : userID,
+		})
+		if err != nil {
+			return err
+		}
+		// Deleted by another request in the meantime.
+		if rows == 0 {
+			return nil
+		}
+		message, err = q.GetMessage(req.Context(), database.GetMessageParams{
+			ID : message.ID,
+			ConversationID : conversation.ID,
+		})
+		if err != nil {
+			return err
+		}
+		return writeMessageEvent(req.Context(), q, eventMessageDeleted, message)
+	})
+	if err != nil {
+		log.Printf("Error deleting message: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// handleMarkConversationRead moves the user's read marker up to a message,
+// or the newest one if none is given. It never moves back.
+func (cfg *apiConfig) handleMarkConversationRead(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+
+	userID, conversation, ok := cfg.userConversation(w, req, auth.ScopeMessagesWrite)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(400)
+		return
+	}
+
+	var message database.Message
+	if params.MessageID == uuid.Nil {
+		message, err = cfg.db.GetLatestMessage(req.Context(), conversation.ID)
+	} else {
+		message, err = cfg.db.GetMessage(req.Context(), database.GetMessageParams{
+			ID : params.MessageID,
+			ConversationID : conversation.ID,
+		})
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		if params.MessageID == uuid.Nil {
+			w.WriteHeader(204)
+			return
+		}
+		w.WriteHeader(400)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading message: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	err = cfg.db.MarkConversationRead(req.Context(), database.MarkConversationReadParams{
+		ConversationID : conversation.ID,
+		UserID : userID,
+		MessageID : message.ID,
+	})
+	if err != nil {
+		log.Printf("Error marking conversation read: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
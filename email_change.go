@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+	"github.com/lib/pq"
+)
+
+const (
+	confirmEmailChangeTTL = 24 * time.Hour
+	revertEmailChangeTTL  = 7 * 24 * time.Hour
+)
+
+// The revert link is opened with GET, which mail scanners follow on their
+// own, so it only shows this form and the revert happens on POST.
+var revertEmailTemplate = template.Must(template.New("revert").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Restore your Chirpy email address</title>
+</head>
+<body>
+<h1>Restore your Chirpy email address</h1>
+<p>The email address on your Chirpy account was changed from {{.OldEmail}} to {{.NewEmail}}.</p>
+<p>If you did not make this change, restore {{.OldEmail}}. You will be signed out everywhere and sent a link to choose a new password.</p>
+<form method="post" action="/api/users/email/revert">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Restore {{.OldEmail}}</button>
+</form>
+</body>
+</html>
+`))
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// requestEmailChange leaves the account's email alone until the new
+// address confirms it, so a typo or a stolen session cannot move the
+// account to an address the owner does not control.
+func (cfg *apiConfig) requestEmailChange(ctx context.Context, user database.User, newEmail string) error {
+	err := cfg.db.CancelEmailChanges(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	token, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateEmailChange(ctx, database.CreateEmailChangeParams{
+		UserID : user.ID,
+		OldEmail : user.Email,
+		NewEmail : newEmail,
+		ConfirmTokenHash : auth.HashToken(token),
+		ConfirmExpiresAt : time.Now().Add(confirmEmailChangeTTL),
+	})
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/api/users/email/confirm?token=%s", cfg.baseURL, url.QueryEscape(token))
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : newEmail,
+		Subject : "Confirm your new Chirpy email address",
+		Body : fmt.Sprintf("Someone asked to use this address for the Chirpy account %s.\n\nConfirm the change by opening this link within 24 hours:\n\n%s\n\nIf this wasn't you, you can ignore this email.\n", user.Email, link),
+	})
+}
+
+func (cfg *apiConfig) sendEmailChangedNotice(ctx context.Context, change database.EmailChange, revertToken string) error {
+	link := fmt.Sprintf("%s/api/users/email/revert?token=%s", cfg.baseURL, url.QueryEscape(revertToken))
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : change.OldEmail,
+		Subject : "Your Chirpy email address was changed",
+		Body : fmt.Sprintf("The email address on your Chirpy account was changed to %s.\n\nIf you did not make this change, open this link within 7 days to restore this address and sign out everywhere:\n\n%s\n", change.NewEmail, link),
+	})
+}
+
+func (cfg *apiConfig) handleConfirmEmailChange(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("Missing confirmation token"))
+		return
+	}
+
+	revertToken, err := auth.MakeOneTimeToken()
+	if err != nil {
+		log.Printf("Error making revert token: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	// The token is only spent if the email actually changes, so a clash
+	// with another account leaves the link usable once that is resolved.
+	var change database.EmailChange
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		change, err = q.ConfirmEmailChange(req.Context(), database.ConfirmEmailChangeParams{
+			ConfirmTokenHash : auth.HashToken(token),
+			RevertTokenHash : sql.NullString{
+				String : auth.HashToken(revertToken),
+				Valid : true,
+			},
+			RevertExpiresAt : sql.NullTime{
+				Time : time.Now().Add(revertEmailChangeTTL),
+				Valid : true,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return q.UpdateUserEmail(req.Context(), database.UpdateUserEmailParams{
+			ID : change.UserID,
+			Email : change.NewEmail,
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("This confirmation link is invalid or has expired"))
+		return
+	}
+	if isUniqueViolation(err) {
+		w.WriteHeader(409)
+		_, _ = w.Write([]byte("This email address is already used by another account"))
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing email: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAudit(req.Context(), req, auditEntry{
+		UserID : change.UserID,
+		ActorType : actorUser,
+		ActorID : change.UserID,
+		Event : "user.email_changed",
+		Metadata : map[string]string{
+			"old_email" : change.OldEmail,
+			"new_email" : change.NewEmail,
+		},
+	})
+	err = cfg.sendEmailChangedNotice(req.Context(), change, revertToken)
+	if err != nil {
+		log.Printf("Error sending email change notice: %s", err)
+	}
+
+	w.WriteHeader(200)
+	_, _ = w.Write([]byte("Your email address has been changed"))
+}
+
+func (cfg *apiConfig) handleRevertEmailChangePage(w http.ResponseWriter, req *http.Request) {
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("Missing token"))
+		return
+	}
+
+	change, err := cfg.db.GetRevertableEmailChange(req.Context(), sql.NullString{
+		String : auth.HashToken(token),
+		Valid : true,
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("This link is invalid or has expired"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err = revertEmailTemplate.Execute(w, struct {
+		OldEmail string
+		NewEmail string
+		Token    string
+	}{change.OldEmail, change.NewEmail, token})
+	if err != nil {
+		log.Printf("Error rendering revert page: %s", err)
+	}
+}
+
+// handleRevertEmailChange undoes a confirmed change from the old address.
+// Whoever made the change knew the password, so every session is signed
+// out, any other outstanding changes are cancelled and the owner is sent a
+// password reset.
+func (cfg *apiConfig) handleRevertEmailChange(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	token := req.FormValue("token")
+	if token == "" {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("Missing token"))
+		return
+	}
+
+	var change database.EmailChange
+	err := cfg.inTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		change, err = q.RevertEmailChange(req.Context(), sql.NullString{
+			String : auth.HashToken(token),
+			Valid : true,
+		})
+		if err != nil {
+			return err
+		}
+		err = q.UpdateUserEmail(req.Context(), database.UpdateUserEmailParams{
+			ID : change.UserID,
+			Email : change.OldEmail,
+		})
+		if err != nil {
+			return err
+		}
+		err = q.ExpireEmailChangeReverts(req.Context(), change.UserID)
+		if err != nil {
+			return err
+		}
+		err = q.CancelEmailChanges(req.Context(), change.UserID)
+		if err != nil {
+			return err
+		}
+		return q.RevokeUserRefreshTokens(req.Context(), change.UserID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("This link is invalid or has expired"))
+		return
+	}
+	if isUniqueViolation(err) {
+		w.WriteHeader(409)
+		_, _ = w.Write([]byte("This email address is already used by another account"))
+		return
+	}
+	if err != nil {
+		log.Printf("Error reverting email change: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAudit(req.Context(), req, auditEntry{
+		UserID : change.UserID,
+		ActorType : actorUser,
+		ActorID : change.UserID,
+		Event : "user.email_change_reverted",
+		Metadata : map[string]string{
+			"old_email" : change.OldEmail,
+			"new_email" : change.NewEmail,
+		},
+	})
+	err = cfg.sendPasswordResetEmail(req.Context(), change.OldEmail)
+	if err != nil {
+		log.Printf("Error sending password reset email: %s", err)
+	}
+
+	w.WriteHeader(200)
+	_, _ = w.Write([]byte(fmt.Sprintf("%s is the email address on your account again. You have been signed out everywhere, and we sent you a link to choose a new password.", change.OldEmail)))
+}
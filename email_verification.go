@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	tokenPurposeVerifyEmail = "verify_email"
+	verifyEmailTokenTTL     = 24 * time.Hour
+)
+
+// issueUserToken stores the hash of a fresh one-time token and returns the
+// plain token, which only ever leaves the server inside an email.
+func (cfg *apiConfig) issueUserToken(ctx context.Context, userID uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	token, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = cfg.db.CreateUserToken(ctx, database.CreateUserTokenParams{
+		TokenHash : auth.HashToken(token),
+		UserID : userID,
+		Purpose : purpose,
+		ExpiresAt : time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (cfg *apiConfig) consumeUserToken(ctx context.Context, token, purpose string) (database.UserToken, error) {
+	return cfg.db.ConsumeUserToken(ctx, database.ConsumeUserTokenParams{
+		TokenHash : auth.HashToken(token),
+		Purpose : purpose,
+	})
+}
+
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.issueUserToken(ctx, user.ID, tokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/api/users/verify?token=%s", cfg.baseURL, url.QueryEscape(token))
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : user.Email,
+		Subject : "Verify your Chirpy account",
+		Body : fmt.Sprintf("Welcome to Chirpy!\n\nConfirm your email address by opening this link within 24 hours:\n\n%s\n\nIf you did not sign up, you can ignore this email.\n", link),
+	})
+}
+
+func (cfg *apiConfig) handleVerifyEmail(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("Missing verification token"))
+		return
+	}
+
+	userToken, err := cfg.consumeUserToken(req.Context(), token, tokenPurposeVerifyEmail)
+	if err != nil {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("This verification link is invalid or has expired"))
+		return
+	}
+
+	err = cfg.db.VerifyUserEmail(req.Context(), userToken.UserID)
+	if err != nil {
+		log.Printf("Error verifying email: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(200)
+	_, _ = w.Write([]byte("Your email address has been verified"))
+}
+
+func (cfg *apiConfig) handleResendVerification(w http.ResponseWriter, req *http.Request) {
+	userID, err := cfg.authenticate(req, auth.ScopeProfileWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	if user.EmailVerifiedAt.Valid {
+		w.WriteHeader(204)
+		return
+	}
+
+	err = cfg.sendVerificationEmail(req.Context(), user)
+	if err != nil {
+		log.Printf("Error sending verification email: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(204)
+	return
+}
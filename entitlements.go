@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/entitlements"
+)
+
+func userPlan(user database.User) string {
+	if user.IsChirpyRed {
+		return entitlements.PlanRed
+	}
+	return entitlements.PlanFree
+}
+
+func (cfg *apiConfig) userLimit(user database.User, limit entitlements.Limit) int {
+	return cfg.entitlements.Limit(userPlan(user), limit)
+}
+
+// chirpRetryAfter counts a chirp against the user's chirps_per_minute
+// limit, if the plan has one, and returns how long to wait if it is over. It shares the login
+// attempt tracker so the count holds across replicas.
+func (cfg *apiConfig) chirpRetryAfter(ctx context.Context, user database.User) (time.Duration, error) {
+	limit := cfg.userLimit(user, entitlements.ChirpsPerMinute)
+	if limit == 0 {
+		return 0, nil
+	}
+	rec, err := cfg.rateTracker.RecordFailure(ctx, "chirps:" + user.ID.String(), time.Minute)
+	if err != nil {
+		return 0, err
+	}
+	if rec.Failures <= limit {
+		return 0, nil
+	}
+	return time.Minute, nil
+}
+
+func (cfg *apiConfig) handleGetEntitlements(w http.ResponseWriter, req *http.Request) {
+	type entitlementsResp struct {
+		Plan   string                     `json:"plan"`
+		Limits map[entitlements.Limit]int `json:"limits"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsRead)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	plan := cfg.entitlements.Plan(userPlan(user))
+	dat, err := json.Marshal(entitlementsResp{
+		Plan : userPlan(user),
+		Limits : plan.Limits,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
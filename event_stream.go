@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/stream"
+	"github.com/andrei-himself/chirpy/internal/webhooks"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	streamChannel           = "chirpy_events"
+	streamBuffer            = 64
+	streamHeartbeatInterval = 15 * time.Second
+	streamWriteTimeout      = 10 * time.Second
+	streamPollInterval      = 30 * time.Second
+	maxStreamResume         = 500
+)
+
+// streamEventTypes are the outbox events sent to stream clients.
+var streamEventTypes = []string{
+	webhooks.EventChirpCreated,
+	webhooks.EventChirpDeleted,
+	eventNotificationCreated,
+	eventMessageCreated,
+	eventMessageDeleted,
+}
+
+var messageEventTypes = []string{
+	eventMessageCreated,
+	eventMessageDeleted,
+}
+
+func toStreamEvent(event database.OutboxEvent) stream.Event {
+	e := stream.Event{
+		ID : event.StreamID.Int64,
+		Type : event.EventType,
+		UserID : event.UserID,
+		Data : event.Payload,
+	}
+	if event.EventType == webhooks.EventChirpCreated || event.EventType == webhooks.EventChirpDeleted {
+		chirp := Chirp{}
+		err := json.Unmarshal(event.Payload, &chirp)
+		if err == nil {
+			e.ChirpID = chirp.ID
+			e.Hashtags = stream.Hashtags(chirp.Body)
+		}
+	}
+	return e
+}
+
+// forwardStreamEvents hands the published events after the given stream
+// ID to this replica's clients, and returns the last one it handed over.
+func (cfg *apiConfig) forwardStreamEvents(ctx context.Context, after int64) int64 {
+	for {
+		events, err := cfg.db.ListStreamEvents(ctx, database.ListStreamEventsParams{
+			After : after,
+			EventTypes : streamEventTypes,
+			Limit : maxStreamResume,
+		})
+		if err != nil {
+			log.Printf("Error listing stream events: %s", err)
+			return after
+		}
+		for _, event := range events {
+			cfg.streamHub.Publish(toStreamEvent(event))
+			after = event.StreamID.Int64
+		}
+		if len(events) < maxStreamResume {
+			return after
+		}
+	}
+}
+
+// runEventStream forwards events published by any replica. NOTIFY only
+// says that something was published; the events themselves are read from
+// the outbox, so nothing is missed while the listener reconnects. The poll
+// covers a notification lost with the connection. Signals, which are not
+// stored, travel in the notification itself.
+func (cfg *apiConfig) runEventStream(dbURL string) {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Error listening for stream events: %s", err)
+		}
+	})
+	for _, channel := range []string{streamChannel, signalChannel} {
+		err := listener.Listen(channel)
+		if err != nil {
+			log.Printf("Error listening for stream events: %s", err)
+		}
+	}
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	last := int64(-1)
+	for {
+		if last < 0 {
+			var err error
+			last, err = cfg.db.GetLatestStreamID(context.Background())
+			if err != nil {
+				log.Printf("Error loading latest stream event: %s", err)
+				last = -1
+			}
+		} else {
+			last = cfg.forwardStreamEvents(context.Background(), last)
+		}
+		cfg.waitForStreamEvents(listener, ticker)
+	}
+}
+
+// waitForStreamEvents passes signals on until there may be new events:
+// one was published, the listener reconnected, or it is time to poll.
+func (cfg *apiConfig) waitForStreamEvents(listener *pq.Listener, ticker *time.Ticker) {
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil || n.Channel != signalChannel {
+				return
+			}
+			cfg.forwardSignal(n.Extra)
+		case <-ticker.C:
+			return
+		}
+	}
+}
+
+func (cfg *apiConfig) handleStream(w http.ResponseWriter, req *http.Request) {
+	// Anyone can watch chirps; notifications need the user's credentials,
+	// and messages credentials that may read them.
+	userID := uuid.Nil
+	readMessages := false
+	if req.Header.Get("Authorization") != "" {
+		id, err := cfg.authenticate(req, auth.ScopeChirpsRead)
+		if err != nil {
+			status, _ := authFailure(w, err)
+			w.WriteHeader(status)
+			return
+		}
+		userID = id
+		_, err = cfg.authenticate(req, auth.ScopeMessagesRead)
+		readMessages = err == nil
+	}
+
+	query := req.URL.Query()
+	authorID := uuid.Nil
+	if v := query.Get("author_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		authorID = id
+	}
+	hashtag := strings.ToLower(strings.TrimPrefix(query.Get("hashtag"), "#"))
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+	last := int64(0)
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		last = id
+	}
+
+	filter := func(e stream.Event) bool {
+		if !slices.Contains(streamEventTypes, e.Type) {
+			return false
+		}
+		if e.Type == eventNotificationCreated {
+			return userID != uuid.Nil && e.UserID == userID
+		}
+		if slices.Contains(messageEventTypes, e.Type) {
+			return readMessages && e.UserID == userID
+		}
+		if authorID != uuid.Nil && e.UserID != authorID {
+			return false
+		}
+		return hashtag == "" || slices.Contains(e.Hashtags, hashtag)
+	}
+
+	// Subscribing before reading missed events means none fall in between;
+	// any seen twice are skipped by ID.
+	sub := cfg.streamHub.Subscribe(filter)
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	send := func(write func() error) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if write() != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	ok := send(func() error {
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	// Missed events are read a page at a time until the client has caught
+	// up. Live events meanwhile queue on the subscription; if too many do,
+	// it is closed and the client resumes from where this left off.
+	for lastEventID != "" {
+		events, err := cfg.db.ListStreamEvents(req.Context(), database.ListStreamEventsParams{
+			After : last,
+			EventTypes : streamEventTypes,
+			Limit : maxStreamResume,
+		})
+		if err != nil {
+			log.Printf("Error listing stream events: %s", err)
+			return
+		}
+		for _, event := range events {
+			e := toStreamEvent(event)
+			last = e.ID
+			if filter(e) && !send(func() error { return stream.WriteEvent(w, e) }) {
+				return
+			}
+		}
+		if len(events) < maxStreamResume {
+			break
+		}
+	}
+
+	// Like the WebSocket, the stream ends when the token it was opened
+	// with expires. API keys do not expire, so the credentials are also
+	// checked again with every heartbeat in case they were revoked.
+	var expired <-chan time.Time
+	if userID != uuid.Nil {
+		expiresAt := cfg.credentialsExpireAt(req)
+		if !expiresAt.IsZero() {
+			expiry := time.NewTimer(time.Until(expiresAt))
+			defer expiry.Stop()
+			expired = expiry.C
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-expired:
+			return
+		case e, ok := <-sub.C:
+			// A closed channel means the client fell too far behind. It
+			// reconnects with Last-Event-ID and catches up from the outbox.
+			if !ok {
+				return
+			}
+			if e.ID <= last {
+				continue
+			}
+			last = e.ID
+			if !send(func() error { return stream.WriteEvent(w, e) }) {
+				return
+			}
+		case <-heartbeat.C:
+			if userID != uuid.Nil {
+				_, err := cfg.authenticate(req, auth.ScopeChirpsRead)
+				if err != nil {
+					return
+				}
+			}
+			if !send(func() error { return stream.WriteComment(w, "heartbeat") }) {
+				return
+			}
+		}
+	}
+}
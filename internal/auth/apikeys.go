@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	ScopeChirpsRead    = "chirps:read"
+	ScopeChirpsWrite   = "chirps:write"
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeProfileWrite  = "profile:write"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+// APIKeyScopes lists every scope a personal API key can be granted.
+var APIKeyScopes = []string{
+	ScopeChirpsRead,
+	ScopeChirpsWrite,
+	ScopeMessagesRead,
+	ScopeMessagesWrite,
+	ScopeProfileWrite,
+	ScopeWebhooksWrite,
+}
+
+// APIKeyPrefix marks personal API keys so they are recognisable in logs and
+// secret scanners, and can be told apart from the Polka webhook key.
+const APIKeyPrefix = "chirpy_"
+
+// MakeAPIKey returns a new personal API key and the short prefix of it that
+// is safe to store and show in listings. Only HashToken(key) is stored.
+func MakeAPIKey() (string, string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", "", err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(bytes)
+	return key, key[:len(APIKeyPrefix) + 8], nil
+}
+
+// ParseScopes checks that every requested scope exists and returns them
+// sorted with duplicates removed.
+func ParseScopes(scopes []string) ([]string, error) {
+	parsed := []string{}
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if !slices.Contains(APIKeyScopes, scope) {
+			return nil, fmt.Errorf("Unknown scope %q", scope)
+		}
+		parsed = append(parsed, scope)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("At least one scope is required")
+	}
+	slices.Sort(parsed)
+	return slices.Compact(parsed), nil
+}
+
+func HasScope(scopes []string, scope string) bool {
+	return slices.Contains(scopes, scope)
+}
@@ -8,11 +8,22 @@ import (
 	"fmt"
 	"net/http"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
 )
 
 func HashPassword(password string) (string, error) {
-	hash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+	return HashPasswordWithParams(password, DefaultPasswordHashParams())
+}
+
+func HashPasswordWithParams(password string, params PasswordHashParams) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("Password must not be empty")
+	}
+	hash, err := argon2id.CreateHash(password, params.argon2id())
 	if err != nil {
 		return "", err
 	}
@@ -27,15 +38,79 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 	return match, err
 }
 
+var (
+	ErrTokenMalformed        = errors.New("token is malformed")
+	ErrTokenAlgorithm        = errors.New("token signing algorithm is not allowed")
+	ErrTokenUnknownKey       = errors.New("token is signed with an unknown key")
+	ErrTokenSignatureInvalid = errors.New("token signature is invalid")
+	ErrTokenExpired          = errors.New("token is expired")
+	ErrTokenNotYetValid      = errors.New("token is not valid yet")
+	ErrTokenIssuer           = errors.New("token has invalid issuer")
+	ErrTokenAudience         = errors.New("token has invalid audience")
+	ErrTokenSubject          = errors.New("token has invalid subject")
+	ErrTokenMissingClaim     = errors.New("token is missing a required claim")
+	ErrTokenInvalid          = errors.New("token is invalid")
+)
+
+// TokenError is returned by every JWT validation failure. Reason is one of
+// the ErrToken* values so callers can use errors.Is to pick a response.
+type TokenError struct {
+	Reason error
+	Err    error
+}
+
+func (e *TokenError) Error() string {
+	if e.Err == nil {
+		return e.Reason.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func (e *TokenError) Unwrap() []error {
+	return []error{e.Reason, e.Err}
+}
+
+type ValidationOptions struct {
+	Algorithms []string
+	Issuer     string
+	Audience   string
+	Leeway     time.Duration
+}
+
+func DefaultValidationOptions() ValidationOptions {
+	return ValidationOptions{
+		Algorithms : []string{jwt.SigningMethodHS256.Alg()},
+		Issuer : "chirpy",
+	}
+}
+
 func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	return makeJWT(userID, jwt.SigningMethodHS256, []byte(tokenSecret), "", "", expiresIn)
+}
+
+func makeJWT(userID uuid.UUID, method jwt.SigningMethod, key any, kid, audience string, expiresIn time.Duration) (string, error) {
+	return signJWT(registeredClaims(userID, audience, expiresIn), method, key, kid)
+}
+
+func registeredClaims(userID uuid.UUID, audience string, expiresIn time.Duration) jwt.RegisteredClaims {
 	claims := jwt.RegisteredClaims{
 		Issuer : "chirpy",
 		IssuedAt : jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt : jwt.NewNumericDate(time.Now().Add(expiresIn).UTC()),
 		Subject : userID.String(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString([]byte(tokenSecret))
+	if audience != "" {
+		claims.Audience = jwt.ClaimStrings{audience}
+	}
+	return claims
+}
+
+func signJWT(claims jwt.Claims, method jwt.SigningMethod, key any, kid string) (string, error) {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
@@ -43,37 +118,92 @@ func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (str
 }
 
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	return ValidateJWTWithOptions(tokenString, tokenSecret, DefaultValidationOptions())
+}
+
+func ValidateJWTWithOptions(tokenString, tokenSecret string, opts ValidationOptions) (uuid.UUID, error) {
+	return parseJWT(tokenString, opts, func(t *jwt.Token) (interface{}, error) {
+		return []byte(tokenSecret), nil
+	})
+}
+
+func parseJWT(tokenString string, opts ValidationOptions, keyfunc jwt.Keyfunc) (uuid.UUID, error) {
 	claims := &jwt.RegisteredClaims{}
+	return parseClaims(tokenString, claims, claims, opts, keyfunc)
+}
+
+// parseClaims validates tokenString into claims, which must embed
+// registered, and returns the subject.
+func parseClaims(tokenString string, claims jwt.Claims, registered *jwt.RegisteredClaims, opts ValidationOptions, keyfunc jwt.Keyfunc) (uuid.UUID, error) {
+	parserOpts := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
 	_, err := jwt.ParseWithClaims(
-		tokenString, 
-		claims, 
+		tokenString,
+		claims,
 		func(t *jwt.Token) (interface{}, error) {
-			return []byte(tokenSecret), nil
-		})
+			if !slices.Contains(opts.Algorithms, t.Method.Alg()) {
+				return nil, ErrTokenAlgorithm
+			}
+			return keyfunc(t)
+		},
+		parserOpts...)
 	if err != nil {
-		var zeroUUID uuid.UUID
-		return zeroUUID, err
+		return uuid.Nil, newTokenError(err)
 	}
 
-	uuidString, err := claims.GetSubject()
-	if err != nil {
-		var zeroUUID uuid.UUID
-		return zeroUUID, err
+	// Tokens minted for a specific audience, like MFA challenges, must never
+	// pass as plain access tokens.
+	if opts.Audience == "" && len(registered.Audience) > 0 {
+		return uuid.Nil, &TokenError{Reason : ErrTokenAudience}
 	}
-	uuidParsed, err := uuid.Parse(uuidString)
+
+	uuidParsed, err := uuid.Parse(registered.Subject)
 	if err != nil {
-		var zeroUUID uuid.UUID
-		return zeroUUID, err
+		return uuid.Nil, &TokenError{Reason : ErrTokenSubject, Err : err}
 	}
 	return uuidParsed, nil
 }
 
+func newTokenError(err error) *TokenError {
+	reasons := []struct {
+		cause  error
+		reason error
+	}{
+		{ErrTokenAlgorithm, ErrTokenAlgorithm},
+		{ErrTokenUnknownKey, ErrTokenUnknownKey},
+		{jwt.ErrTokenMalformed, ErrTokenMalformed},
+		{jwt.ErrTokenSignatureInvalid, ErrTokenSignatureInvalid},
+		{jwt.ErrTokenExpired, ErrTokenExpired},
+		{jwt.ErrTokenNotValidYet, ErrTokenNotYetValid},
+		{jwt.ErrTokenUsedBeforeIssued, ErrTokenNotYetValid},
+		{jwt.ErrTokenInvalidIssuer, ErrTokenIssuer},
+		{jwt.ErrTokenInvalidAudience, ErrTokenAudience},
+		{jwt.ErrTokenRequiredClaimMissing, ErrTokenMissingClaim},
+	}
+	for _, r := range reasons {
+		if errors.Is(err, r.cause) {
+			return &TokenError{Reason : r.reason, Err : err}
+		}
+	}
+	return &TokenError{Reason : ErrTokenInvalid, Err : err}
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
-	v, ok := headers["Authorization"]
-	if !ok || v[0][0:7] != "Bearer " {
+	token, ok := strings.CutPrefix(headers.Get("Authorization"), "Bearer ")
+	if !ok {
 		return "", fmt.Errorf("No authorization header or no bearer token in the request")
 	}
-	return v[0][7:], nil
+	return token, nil
 }
 
 func MakeRefreshToken() (string, error) {
@@ -86,10 +216,26 @@ func MakeRefreshToken() (string, error) {
 	return s, nil
 }
 
+func MakeOneTimeToken() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// HashToken is used for one-time tokens that are stored server side. They
+// are random enough that a plain SHA-256 is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
-	v, ok := headers["Authorization"]
-	if !ok || v[0][0:7] != "ApiKey " {
+	key, ok := strings.CutPrefix(headers.Get("Authorization"), "ApiKey ")
+	if !ok {
 		return "", fmt.Errorf("No authorization header or no apikey in the request")
 	}
-	return v[0][7:], nil
+	return key, nil
 }
\ No newline at end of file
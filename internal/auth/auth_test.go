@@ -5,6 +5,23 @@ import (
 	"time"
 	"github.com/google/uuid"
 	"net/http"
+	"net/url"
+	"strconv"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"errors"
+	"strings"
+	"crypto/sha1"
+	"crypto/sha256"
+	"bytes"
+	"encoding/hex"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestGetBearerToken(t *testing.T) { 
@@ -86,4 +103,639 @@ func TestValidateJWT(t *testing.T) {
     if err == nil {
         t.Fatal("expected error for malformed token")
     }
-}
\ No newline at end of file
+}
+
+func writeTestKey(t *testing.T, dir, name string, key any) (string, string) {
+	t.Helper()
+	privDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.(crypto.Signer).Public())
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	privPath := filepath.Join(dir, name + ".pem")
+	pubPath := filepath.Join(dir, name + ".pub.pem")
+	err = os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type : "PRIVATE KEY", Bytes : privDER}), 0600)
+	if err != nil {
+		t.Fatalf("write private key: %v", err)
+	}
+	err = os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type : "PUBLIC KEY", Bytes : pubDER}), 0644)
+	if err != nil {
+		t.Fatalf("write public key: %v", err)
+	}
+	return privPath, pubPath
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, oldEd, _ := ed25519.GenerateKey(rand.Reader)
+	newRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+	oldPriv, oldPub := writeTestKey(t, dir, "old", oldEd)
+	newPriv, _ := writeTestKey(t, dir, "new", newRSA)
+
+	oldSet, err := LoadKeySet(oldPriv, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	userID := uuid.New()
+	oldToken, _ := oldSet.MakeJWT(userID, time.Minute)
+
+	rotated, err := LoadKeySet(newPriv, []string{oldPub})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := rotated.ValidateJWT(oldToken)
+	if err != nil || got != userID {
+		t.Fatalf("expected token signed with retired key to validate, got %v, %v", got, err)
+	}
+	newToken, _ := rotated.MakeJWT(userID, time.Minute)
+	got, err = rotated.ValidateJWT(newToken)
+	if err != nil || got != userID {
+		t.Fatalf("expected token signed with current key to validate, got %v, %v", got, err)
+	}
+	_, err = oldSet.ValidateJWT(newToken)
+	if err == nil {
+		t.Fatal("expected error for token signed with unknown key")
+	}
+
+	jwks := rotated.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kty != "RSA" || jwks.Keys[0].Alg != "RS256" || jwks.Keys[1].Kty != "OKP" {
+		t.Fatalf("unexpected JWKS: %+v", jwks)
+	}
+}
+
+func TestHMACKeySetHasNoJWKS(t *testing.T) {
+	ks := NewHMACKeySet("test-secret-1")
+	userID := uuid.New()
+	token, _ := ks.MakeJWT(userID, time.Minute)
+	got, err := ValidateJWT(token, "test-secret-1")
+	if err != nil || got != userID {
+		t.Fatalf("expected HS256 token, got %v, %v", got, err)
+	}
+	if len(ks.JWKS().Keys) != 0 {
+		t.Fatal("expected shared secret to stay out of the JWKS")
+	}
+}
+
+func TestValidateJWTRejections(t *testing.T) {
+	secret := "test-secret-1"
+	now := time.Now()
+	sign := func(method jwt.SigningMethod, claims jwt.RegisteredClaims) string {
+		var key any = []byte(secret)
+		if method == jwt.SigningMethodNone {
+			key = jwt.UnsafeAllowNoneSignatureType
+		}
+		signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return signed
+	}
+	valid := func() jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Issuer : "chirpy",
+			Subject : uuid.New().String(),
+			Audience : jwt.ClaimStrings{"chirpy-api"},
+			IssuedAt : jwt.NewNumericDate(now),
+			ExpiresAt : jwt.NewNumericDate(now.Add(time.Minute)),
+		}
+	}
+	opts := ValidationOptions{
+		Algorithms : []string{"HS256"},
+		Issuer : "chirpy",
+		Audience : "chirpy-api",
+		Leeway : 5 * time.Second,
+	}
+
+	tests := []struct {
+		name   string
+		token  func() string
+		secret string
+		want   error
+	}{
+		{"valid", func() string { return sign(jwt.SigningMethodHS256, valid()) }, secret, nil},
+		{"malformed", func() string { return "not.a.jwt" }, secret, ErrTokenMalformed},
+		{"wrong secret", func() string { return sign(jwt.SigningMethodHS256, valid()) }, "other", ErrTokenSignatureInvalid},
+		{"algorithm not allowed", func() string { return sign(jwt.SigningMethodHS512, valid()) }, secret, ErrTokenAlgorithm},
+		{"none algorithm", func() string { return sign(jwt.SigningMethodNone, valid()) }, secret, ErrTokenAlgorithm},
+		{"wrong issuer", func() string {
+			c := valid()
+			c.Issuer = "someone-else"
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenIssuer},
+		{"wrong audience", func() string {
+			c := valid()
+			c.Audience = jwt.ClaimStrings{"other-api"}
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenAudience},
+		{"expired", func() string {
+			c := valid()
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenExpired},
+		{"expired within leeway", func() string {
+			c := valid()
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-2 * time.Second))
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, nil},
+		{"missing expiry", func() string {
+			c := valid()
+			c.ExpiresAt = nil
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenMissingClaim},
+		{"not valid yet", func() string {
+			c := valid()
+			c.NotBefore = jwt.NewNumericDate(now.Add(time.Minute))
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenNotYetValid},
+		{"issued in the future", func() string {
+			c := valid()
+			c.IssuedAt = jwt.NewNumericDate(now.Add(time.Minute))
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenNotYetValid},
+		{"bad subject", func() string {
+			c := valid()
+			c.Subject = "not-a-uuid"
+			return sign(jwt.SigningMethodHS256, c)
+		}, secret, ErrTokenSubject},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateJWTWithOptions(tt.token(), tt.secret, opts)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) || !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestKeySetRejectsUnknownKeyAndAlgorithmSwap(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	priv, pub := writeTestKey(t, dir, "current", edKey)
+	otherPriv, _ := writeTestKey(t, dir, "other", otherKey)
+	ks, _ := LoadKeySet(priv, nil)
+	other, _ := LoadKeySet(otherPriv, nil)
+
+	token, _ := other.MakeJWT(uuid.New(), time.Minute)
+	_, err := ks.ValidateJWT(token)
+	if !errors.Is(err, ErrTokenUnknownKey) {
+		t.Fatalf("expected unknown key error, got %v", err)
+	}
+
+	// A token "signed" with HS256 using the public key as the secret must
+	// not be accepted just because its kid matches.
+	pubPEM, _ := os.ReadFile(pub)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer : "chirpy",
+		Subject : uuid.New().String(),
+		ExpiresAt : jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	forged.Header["kid"] = ks.signing.ID
+	forgedString, _ := forged.SignedString(pubPEM)
+	_, err = ks.ValidateJWT(forgedString)
+	if !errors.Is(err, ErrTokenAlgorithm) {
+		t.Fatalf("expected algorithm error, got %v", err)
+	}
+}
+
+func TestOneTimeToken(t *testing.T) {
+	token1, err1 := MakeOneTimeToken()
+	token2, err2 := MakeOneTimeToken()
+	if err1 != nil || err2 != nil || token1 == token2 || len(token1) != 64 {
+		t.Fatalf("MakeOneTimeToken not working")
+	}
+	if HashToken(token1) != HashToken(token1) || HashToken(token1) == HashToken(token2) || HashToken(token1) == token1 {
+		t.Fatalf("HashToken not working")
+	}
+}
+
+func TestAudienceScopedTokens(t *testing.T) {
+	ks := NewHMACKeySet("test-secret-1")
+	userID := uuid.New()
+	challenge, _ := ks.MakeJWTForAudience(userID, "chirpy-mfa", time.Minute)
+	_, err := ks.ValidateJWT(challenge)
+	if !errors.Is(err, ErrTokenAudience) {
+		t.Fatalf("expected challenge token to be rejected as access token, got %v", err)
+	}
+	got, err := ks.ValidateJWTForAudience(challenge, "chirpy-mfa")
+	if err != nil || got != userID {
+		t.Fatalf("expected challenge token to validate, got %v, %v", got, err)
+	}
+	access, _ := ks.MakeJWT(userID, time.Minute)
+	_, err = ks.ValidateJWTForAudience(access, "chirpy-mfa")
+	if !errors.Is(err, ErrTokenMissingClaim) {
+		t.Fatalf("expected access token to be rejected as challenge token, got %v", err)
+	}
+}
+
+func TestValidateJWTWithExpiry(t *testing.T) {
+	ks := NewHMACKeySet("test-secret-1")
+	userID := uuid.New()
+	token, _ := ks.MakeJWT(userID, time.Hour)
+	got, expiresAt, err := ks.ValidateJWTWithExpiry(token)
+	if err != nil || got != userID {
+		t.Fatalf("expected token to validate, got %v, %v", got, err)
+	}
+	if d := time.Until(expiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected expiry in an hour, got %v", expiresAt)
+	}
+	challenge, _ := ks.MakeJWTForAudience(userID, "chirpy-mfa", time.Minute)
+	_, _, err = ks.ValidateJWTWithExpiry(challenge)
+	if !errors.Is(err, ErrTokenAudience) {
+		t.Fatalf("expected challenge token to be rejected, got %v", err)
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B vectors, truncated to six digits.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil || got != tt.want {
+			t.Errorf("TOTPCode at %d: expected %s, got %s (%v)", tt.unix, tt.want, got, err)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	code, _ := TOTPCode(secret, TOTPStep(now))
+	step, ok := ValidateTOTP(secret, code, now)
+	if !ok || step != TOTPStep(now) {
+		t.Fatalf("expected current code to validate")
+	}
+	previous, _ := TOTPCode(secret, TOTPStep(now) - 1)
+	if _, ok := ValidateTOTP(secret, previous, now); !ok {
+		t.Fatalf("expected previous code to validate within drift window")
+	}
+	old, _ := TOTPCode(secret, TOTPStep(now) - 3)
+	if _, ok := ValidateTOTP(secret, old, now); ok {
+		t.Fatalf("expected old code to be rejected")
+	}
+	if _, ok := ValidateTOTP(secret, "12345", now); ok {
+		t.Fatalf("expected short code to be rejected")
+	}
+	uri := TOTPProvisioningURI("Chirpy", "test@test.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:test@test.com?") || !strings.Contains(uri, "secret=" + secret) {
+		t.Fatalf("unexpected provisioning URI %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil || len(codes) != 10 {
+		t.Fatalf("GenerateRecoveryCodes not working")
+	}
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if len(c) != 19 || seen[c] {
+			t.Fatalf("unexpected recovery code %s", c)
+		}
+		seen[c] = true
+	}
+	if NormalizeRecoveryCode(strings.ToUpper(codes[0])) != NormalizeRecoveryCode(strings.ReplaceAll(codes[0], "-", "")) {
+		t.Fatalf("NormalizeRecoveryCode not working")
+	}
+}
+
+func TestHashPasswordRejectsEmpty(t *testing.T) {
+	_, err := HashPassword("")
+	if err == nil {
+		t.Fatal("expected error for empty password")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("correct horse battery staple"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	os.WriteFile(filepath.Join(dir, hash[:5] + ".txt"), []byte("0000000000000000000000000000000000A:3\r\n" + hash[5:] + ":42\r\n"), 0644)
+
+	policy := DefaultPasswordPolicy()
+	policy.Breaches = &BreachCorpus{Dir : dir, MinCount : 1}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"ok", "a perfectly fine passphrase", nil},
+		{"empty", "", []string{RuleMinLength}},
+		{"short", "abc", []string{RuleMinLength}},
+		{"too long", strings.Repeat("a", 129), []string{RuleMaxLength}},
+		{"banned ignores case", "PassWord123", []string{RuleBanned}},
+		{"breached", "correct horse battery staple", []string{RuleBreached}},
+		{"short and banned", "chirpy", []string{RuleMinLength, RuleBanned}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.password)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var policyErr *PasswordPolicyError
+			if !errors.As(err, &policyErr) || strings.Join(policyErr.Violations, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected violations %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestBreachCorpusMinCount(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("rarely seen password"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	os.WriteFile(filepath.Join(dir, hash[:5] + ".txt"), []byte(strings.ToLower(hash[5:]) + ":2\n"), 0644)
+
+	corpus := &BreachCorpus{Dir : dir, MinCount : 1}
+	found, err := corpus.Contains("rarely seen password")
+	if err != nil || !found {
+		t.Fatalf("expected password to be found, got %v, %v", found, err)
+	}
+	corpus.MinCount = 10
+	found, _ = corpus.Contains("rarely seen password")
+	if found {
+		t.Fatal("expected password below MinCount to be ignored")
+	}
+	found, err = corpus.Contains("not in the corpus at all")
+	if err != nil || found {
+		t.Fatalf("expected missing range file to mean not breached, got %v, %v", found, err)
+	}
+}
+
+func TestBreachCorpusCheck(t *testing.T) {
+	dir := t.TempDir()
+	corpus := &BreachCorpus{Dir : dir, MinCount : 1}
+	if corpus.Check() == nil {
+		t.Fatal("expected an empty directory to be rejected")
+	}
+	err := os.WriteFile(filepath.Join(dir, "0A1B2.txt"), []byte("0000000000000000000000000000000000A:3\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := corpus.Check(); err != nil {
+		t.Fatalf("expected corpus to be accepted, got %v", err)
+	}
+	corpus.Dir = filepath.Join(dir, "missing")
+	if corpus.Check() == nil {
+		t.Fatal("expected a missing directory to be rejected")
+	}
+}
+
+func TestPasswordHashNeedsUpgrade(t *testing.T) {
+	weak := PasswordHashParams{Memory : 8 * 1024, Iterations : 1, Parallelism : 1}
+	current := PasswordHashParams{Memory : 16 * 1024, Iterations : 2, Parallelism : 1}
+	oldHash, _ := HashPasswordWithParams("testpassword1122334455", weak)
+	newHash, _ := HashPasswordWithParams("testpassword1122334455", current)
+
+	needs, err := PasswordHashNeedsUpgrade(oldHash, current)
+	if err != nil || !needs {
+		t.Fatalf("expected hash with old parameters to need an upgrade, got %v, %v", needs, err)
+	}
+	needs, err = PasswordHashNeedsUpgrade(newHash, current)
+	if err != nil || needs {
+		t.Fatalf("expected hash with current parameters not to need an upgrade, got %v, %v", needs, err)
+	}
+	match, err := CheckPasswordHash("testpassword1122334455", oldHash)
+	if err != nil || !match {
+		t.Fatal("expected old hash to keep verifying")
+	}
+	needs, err = PasswordHashNeedsUpgrade(newHash, weak)
+	if err != nil || needs {
+		t.Fatalf("expected lower settings not to downgrade a hash, got %v, %v", needs, err)
+	}
+	_, err = PasswordHashNeedsUpgrade("not-a-hash", current)
+	if err == nil {
+		t.Fatal("expected error for malformed hash")
+	}
+}
+
+func TestPasswordHashParamsValidate(t *testing.T) {
+	if err := DefaultPasswordHashParams().Validate(); err != nil {
+		t.Fatalf("expected defaults to be valid, got %v", err)
+	}
+	tests := []PasswordHashParams{
+		{Memory : 64 * 1024, Iterations : 0, Parallelism : 2},
+		{Memory : 64 * 1024, Iterations : 1, Parallelism : 0},
+		{Memory : 0, Iterations : 1, Parallelism : 2},
+		{Memory : 15, Iterations : 1, Parallelism : 2},
+	}
+	for _, params := range tests {
+		if params.Validate() == nil {
+			t.Errorf("expected %+v to be rejected", params)
+		}
+	}
+}
+
+func TestCalibratePasswordHashParams(t *testing.T) {
+	// Pretend each MiB of memory costs 1ms per iteration.
+	measure := func(p PasswordHashParams) (time.Duration, error) {
+		return time.Duration(p.Memory / 1024 * p.Iterations) * time.Millisecond, nil
+	}
+	params, elapsed, err := CalibratePasswordHashParams(100 * time.Millisecond, 256 * 1024, 2, measure)
+	if err != nil || params.Memory != 152 * 1024 || params.Iterations != 1 || elapsed < 100 * time.Millisecond {
+		t.Fatalf("unexpected calibration %+v, %v, %v", params, elapsed, err)
+	}
+	params, _, _ = CalibratePasswordHashParams(500 * time.Millisecond, 64 * 1024, 1, measure)
+	if params.Memory != 64 * 1024 || params.Iterations != 8 || params.Parallelism != 1 {
+		t.Fatalf("expected iterations to grow once memory is capped, got %+v", params)
+	}
+}
+
+func TestGetBearerTokenShortHeader(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Basic")
+	_, err := GetBearerToken(headers)
+	if err == nil {
+		t.Errorf("expected error for non-bearer header")
+	}
+	_, err = GetAPIKey(headers)
+	if err == nil {
+		t.Errorf("expected error for non-apikey header")
+	}
+}
+
+func TestMakeAPIKey(t *testing.T) {
+	key, prefix, err := MakeAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, APIKeyPrefix) || len(key) != len(APIKeyPrefix) + 64 {
+		t.Errorf("unexpected key format %q", key)
+	}
+	if !strings.HasPrefix(key, prefix) || len(prefix) != len(APIKeyPrefix) + 8 {
+		t.Errorf("prefix %q does not match key %q", prefix, key)
+	}
+	other, _, _ := MakeAPIKey()
+	if other == key {
+		t.Errorf("expected distinct keys")
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes([]string{ScopeProfileWrite, ScopeChirpsWrite, ScopeChirpsWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(scopes, " ") != "chirps:write profile:write" {
+		t.Errorf("got %v", scopes)
+	}
+	if !HasScope(scopes, ScopeChirpsWrite) || HasScope(scopes, ScopeChirpsRead) {
+		t.Errorf("HasScope mismatch for %v", scopes)
+	}
+	_, err = ParseScopes([]string{"admin"})
+	if err == nil {
+		t.Errorf("expected unknown scope to be rejected")
+	}
+	_, err = ParseScopes(nil)
+	if err == nil {
+		t.Errorf("expected empty scopes to be rejected")
+	}
+}
+
+func TestScopedJWT(t *testing.T) {
+	ks := NewHMACKeySet("secret")
+	userID := uuid.New()
+	token, err := ks.MakeScopedJWT(ScopedClaims{
+		UserID : userID,
+		ClientID : "client",
+		Scopes : []string{ScopeChirpsRead},
+	}, "chirpy-oauth", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := ks.ValidateScopedJWT(token, "chirpy-oauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != userID || claims.ClientID != "client" || !HasScope(claims.Scopes, ScopeChirpsRead) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	_, err = ks.ValidateJWT(token)
+	if !errors.Is(err, ErrTokenAudience) {
+		t.Errorf("scoped token accepted as access token: %v", err)
+	}
+	_, err = ks.ValidateScopedJWT(token, "other")
+	if !errors.Is(err, ErrTokenAudience) {
+		t.Errorf("expected audience error, got %v", err)
+	}
+	_, err = ks.MakeScopedJWT(ScopedClaims{UserID : userID}, "", time.Minute)
+	if err == nil {
+		t.Errorf("expected empty audience to be rejected")
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	key := []byte("test-secret-1")
+	now := time.Now()
+	signed := SignURL(key, "/api/exports/1/download", now.Add(time.Minute))
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySignedURL(key, u.Path, u.Query(), now)
+	if err != nil {
+		t.Fatalf("expected signed URL to verify, got %v", err)
+	}
+
+	err = VerifySignedURL(key, "/api/exports/2/download", u.Query(), now)
+	if !errors.Is(err, ErrURLSignatureInvalid) {
+		t.Errorf("expected other path to be rejected, got %v", err)
+	}
+	err = VerifySignedURL([]byte("test-secret-2"), u.Path, u.Query(), now)
+	if !errors.Is(err, ErrURLSignatureInvalid) {
+		t.Errorf("expected other key to be rejected, got %v", err)
+	}
+	query := u.Query()
+	query.Set("expires", "9999999999")
+	err = VerifySignedURL(key, u.Path, query, now)
+	if !errors.Is(err, ErrURLSignatureInvalid) {
+		t.Errorf("expected extended expiry to be rejected, got %v", err)
+	}
+	err = VerifySignedURL(key, u.Path, u.Query(), now.Add(2 * time.Minute))
+	if !errors.Is(err, ErrURLExpired) {
+		t.Errorf("expected expired URL to be rejected, got %v", err)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	key := DeriveKey("secret", "export-url")
+	if bytes.Equal(key, []byte("secret")) || len(key) != sha256.Size {
+		t.Errorf("unexpected derived key %x", key)
+	}
+	if !bytes.Equal(key, DeriveKey("secret", "export-url")) {
+		t.Errorf("expected the same key for the same secret and purpose")
+	}
+	if bytes.Equal(key, DeriveKey("secret", "other")) || bytes.Equal(key, DeriveKey("other", "export-url")) {
+		t.Errorf("expected different keys for another purpose or secret")
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	oldSecret := []byte("whsec-old")
+	newSecret := []byte("whsec-new")
+	body := []byte(`{"event":"user.upgraded"}`)
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := SignWebhook(oldSecret, now, body)
+
+	err := VerifyWebhook([][]byte{newSecret, oldSecret}, timestamp, signature, body, now, 5 * time.Minute)
+	if err != nil {
+		t.Fatalf("expected signature from a rotated out secret to verify, got %v", err)
+	}
+	err = VerifyWebhook([][]byte{newSecret}, timestamp, "v1=00ff, " + SignWebhook(newSecret, now, body), body, now, 5 * time.Minute)
+	if err != nil {
+		t.Errorf("expected any of several signatures to verify, got %v", err)
+	}
+
+	err = VerifyWebhook([][]byte{newSecret}, timestamp, signature, body, now, 5 * time.Minute)
+	if !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("expected unknown secret to be rejected, got %v", err)
+	}
+	err = VerifyWebhook([][]byte{oldSecret}, timestamp, signature, []byte(`{"event":"user.downgraded"}`), now, 5 * time.Minute)
+	if !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("expected modified body to be rejected, got %v", err)
+	}
+	err = VerifyWebhook([][]byte{oldSecret}, strconv.FormatInt(now.Unix() + 1, 10), signature, body, now, 5 * time.Minute)
+	if !errors.Is(err, ErrWebhookSignatureInvalid) {
+		t.Errorf("expected modified timestamp to be rejected, got %v", err)
+	}
+	err = VerifyWebhook([][]byte{oldSecret}, timestamp, signature, body, now.Add(6 * time.Minute), 5 * time.Minute)
+	if !errors.Is(err, ErrWebhookTimestamp) {
+		t.Errorf("expected replayed delivery to be rejected, got %v", err)
+	}
+	err = VerifyWebhook([][]byte{oldSecret}, "", "", body, now, 5 * time.Minute)
+	if !errors.Is(err, ErrWebhookSignatureMissing) {
+		t.Errorf("expected missing headers to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Key is one asymmetric JWT key. Keys loaded from a public key file can
+// only verify; the signing key also carries its private half.
+type Key struct {
+	ID        string
+	Algorithm string
+	Public    crypto.PublicKey
+	private   crypto.Signer
+}
+
+// KeySet signs access tokens with a single current key and verifies them
+// against every key it holds, so old keys can stay around during rotation.
+// Without an asymmetric signing key it falls back to HS256 with a shared
+// secret.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	secret  string
+	opts    ValidationOptions
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{
+		keys : map[string]*Key{},
+		secret : secret,
+		opts : DefaultValidationOptions(),
+	}
+}
+
+func LoadKeySet(signingKeyFile string, verificationKeyFiles []string) (*KeySet, error) {
+	ks := &KeySet{
+		keys : map[string]*Key{},
+		opts : DefaultValidationOptions(),
+	}
+	ks.opts.Algorithms = []string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()}
+
+	dat, err := os.ReadFile(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signing, err := ParsePrivateKey(dat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+	}
+	ks.signing = signing
+	ks.keys[signing.ID] = signing
+
+	for _, path := range verificationKeyFiles {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePublicKey(dat)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ks.keys[key.ID] = key
+	}
+	return ks, nil
+}
+
+func ParsePrivateKey(pemBytes []byte) (*Key, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", parsed)
+	}
+	key, err := newKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.private = signer
+	return key, nil
+}
+
+func ParsePublicKey(pemBytes []byte) (*Key, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newKey(parsed)
+}
+
+func newKey(pub crypto.PublicKey) (*Key, error) {
+	key := &Key{
+		Public : pub,
+	}
+	switch p := pub.(type) {
+	case ed25519.PublicKey:
+		key.Algorithm = jwt.SigningMethodEdDSA.Alg()
+	case *rsa.PublicKey:
+		if p.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		key.Algorithm = jwt.SigningMethodRS256.Alg()
+	default:
+		return nil, fmt.Errorf("Unsupported public key type %T", pub)
+	}
+	key.ID = key.thumbprint()
+	return key, nil
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint, used as the key's kid so it
+// never has to be configured by hand.
+func (k *Key) thumbprint() string {
+	jwk := k.JWK()
+	var canonical string
+	switch jwk.Kty {
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (k *Key) JWK() JWK {
+	jwk := JWK{
+		Use : "sig",
+		Alg : k.Algorithm,
+		Kid : k.ID,
+	}
+	switch p := k.Public.(type) {
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(p)
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(p.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.E)).Bytes())
+	}
+	return jwk
+}
+
+func (k *Key) signingMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// SetValidationOptions overrides the issuer, audience and leeway. The
+// allowed algorithms are kept as they follow from the keys in the set.
+func (ks *KeySet) SetValidationOptions(opts ValidationOptions) {
+	opts.Algorithms = ks.opts.Algorithms
+	ks.opts = opts
+}
+
+func (ks *KeySet) MakeJWT(userID uuid.UUID, expiresIn time.Duration) (string, error) {
+	return ks.MakeJWTForAudience(userID, ks.opts.Audience, expiresIn)
+}
+
+func (ks *KeySet) ValidateJWT(tokenString string) (uuid.UUID, error) {
+	return ks.ValidateJWTForAudience(tokenString, ks.opts.Audience)
+}
+
+// ValidateJWTWithExpiry is ValidateJWT for callers that hold on to the
+// token, like a WebSocket connection, and must stop trusting it when it
+// expires.
+func (ks *KeySet) ValidateJWTWithExpiry(tokenString string) (uuid.UUID, time.Time, error) {
+	claims := &jwt.RegisteredClaims{}
+	userID, err := parseClaims(tokenString, claims, claims, ks.opts, ks.keyfunc)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+	return userID, claims.ExpiresAt.Time, nil
+}
+
+// MakeJWTForAudience mints a token for something other than API access,
+// such as an MFA challenge. ValidateJWT rejects it because of its audience.
+func (ks *KeySet) MakeJWTForAudience(userID uuid.UUID, audience string, expiresIn time.Duration) (string, error) {
+	return ks.sign(registeredClaims(userID, audience, expiresIn))
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.signing == nil {
+		return signJWT(claims, jwt.SigningMethodHS256, []byte(ks.secret), "")
+	}
+	return signJWT(claims, ks.signing.signingMethod(), ks.signing.private, ks.signing.ID)
+}
+
+func (ks *KeySet) ValidateJWTForAudience(tokenString, audience string) (uuid.UUID, error) {
+	opts := ks.opts
+	opts.Audience = audience
+	return parseJWT(tokenString, opts, ks.keyfunc)
+}
+
+func (ks *KeySet) keyfunc(t *jwt.Token) (interface{}, error) {
+	if ks.signing == nil {
+		return []byte(ks.secret), nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrTokenUnknownKey
+	}
+	if t.Method.Alg() != key.Algorithm {
+		return nil, ErrTokenAlgorithm
+	}
+	return key.Public, nil
+}
+
+// JWKS lists the public halves of all verification keys. It is empty in
+// HS256 mode since the shared secret must never be published.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{
+		Keys : []JWK{},
+	}
+	if ks.signing != nil {
+		set.Keys = append(set.Keys, ks.signing.JWK())
+	}
+	kids := []string{}
+	for kid := range ks.keys {
+		if ks.signing != nil && kid == ks.signing.ID {
+			continue
+		}
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		set.Keys = append(set.Keys, ks.keys[kid].JWK())
+	}
+	return set
+}
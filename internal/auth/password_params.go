@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/alexedwards/argon2id"
+	"time"
+)
+
+// PasswordHashParams are the tunable argon2id costs. Salt and key length
+// stay fixed at the argon2id package defaults.
+type PasswordHashParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultPasswordHashParams pins parallelism instead of using the CPU
+// count, so replicas on different hardware agree on what is current and
+// don't keep re-hashing each other's work.
+func DefaultPasswordHashParams() PasswordHashParams {
+	return PasswordHashParams{
+		Memory : 64 * 1024,
+		Iterations : 1,
+		Parallelism : 2,
+	}
+}
+
+// Validate rejects parameters argon2 cannot use: it panics on zero
+// iterations or threads, and needs at least 8 KiB of memory per thread.
+func (p PasswordHashParams) Validate() error {
+	if p.Iterations < 1 {
+		return fmt.Errorf("argon2 iterations must be at least 1")
+	}
+	if p.Parallelism < 1 {
+		return fmt.Errorf("argon2 parallelism must be at least 1")
+	}
+	if p.Memory < 8 * uint32(p.Parallelism) {
+		return fmt.Errorf("argon2 memory must be at least %d KiB for %d threads", 8 * uint32(p.Parallelism), p.Parallelism)
+	}
+	return nil
+}
+
+func (p PasswordHashParams) argon2id() *argon2id.Params {
+	return &argon2id.Params{
+		Memory : p.Memory,
+		Iterations : p.Iterations,
+		Parallelism : p.Parallelism,
+		SaltLength : argon2id.DefaultParams.SaltLength,
+		KeyLength : argon2id.DefaultParams.KeyLength,
+	}
+}
+
+// PasswordHashNeedsUpgrade reports whether hash was created with a lower
+// memory or iteration cost than params, meaning it should be replaced next
+// time the plain password is available. Lowering the settings never
+// rehashes anyone to weaker parameters.
+func PasswordHashNeedsUpgrade(hash string, params PasswordHashParams) (bool, error) {
+	stored, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return false, err
+	}
+	want := params.argon2id()
+	return stored.Memory < want.Memory || stored.Iterations < want.Iterations || stored.KeyLength < want.KeyLength, nil
+}
+
+// CalibratePasswordHashParams searches for the cheapest parameters that take
+// at least target to hash, doubling memory first (up to maxMemory KiB) and
+// then adding iterations. measure returns how long one hash takes.
+func CalibratePasswordHashParams(target time.Duration, maxMemory uint32, parallelism uint8, measure func(PasswordHashParams) (time.Duration, error)) (PasswordHashParams, time.Duration, error) {
+	params := PasswordHashParams{
+		Memory : 19 * 1024,
+		Iterations : 1,
+		Parallelism : parallelism,
+	}
+	if params.Memory > maxMemory {
+		params.Memory = maxMemory
+	}
+	elapsed, err := measure(params)
+	if err != nil {
+		return params, 0, err
+	}
+	for elapsed < target && params.Memory < maxMemory {
+		params.Memory = min(params.Memory * 2, maxMemory)
+		elapsed, err = measure(params)
+		if err != nil {
+			return params, 0, err
+		}
+	}
+	for elapsed < target && params.Iterations < 64 {
+		params.Iterations++
+		elapsed, err = measure(params)
+		if err != nil {
+			return params, 0, err
+		}
+	}
+	return params, elapsed, nil
+}
+
+func MeasurePasswordHash(params PasswordHashParams, rounds int) (time.Duration, error) {
+	var total time.Duration
+	for i := 0; i < rounds; i++ {
+		start := time.Now()
+		_, err := HashPasswordWithParams("calibration-password", params)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Since(start)
+	}
+	return total / time.Duration(rounds), nil
+}
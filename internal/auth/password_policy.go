@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	RuleMinLength = "min_length"
+	RuleMaxLength = "max_length"
+	RuleBanned    = "banned"
+	RuleBreached  = "breached"
+)
+
+var defaultBannedPasswords = []string{
+	"password",
+	"password1",
+	"password123",
+	"12345678",
+	"123456789",
+	"1234567890",
+	"qwerty123",
+	"qwertyuiop",
+	"iloveyou",
+	"letmein1",
+	"chirpy",
+	"chirpy123",
+	"chirpyred",
+}
+
+// PasswordPolicyError lists every rule a password failed, so clients can
+// show all problems at once instead of one per attempt.
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return fmt.Sprintf("password violates policy: %s", strings.Join(e.Violations, ", "))
+}
+
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	Banned    map[string]bool
+	Breaches  *BreachCorpus
+}
+
+func DefaultPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength : 8,
+		MaxLength : 128,
+		Banned : map[string]bool{},
+	}
+	for _, pw := range defaultBannedPasswords {
+		policy.Banned[pw] = true
+	}
+	return policy
+}
+
+// LoadBannedPasswords adds one password per line from path to the banned
+// list. Matching ignores case.
+func (p *PasswordPolicy) LoadBannedPasswords(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.Banned[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+// Check returns a *PasswordPolicyError when the password breaks any rule,
+// or a plain error if the breach corpus could not be read.
+func (p *PasswordPolicy) Check(password string) error {
+	violations := []string{}
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, RuleMinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, RuleMaxLength)
+	}
+	if p.Banned[strings.ToLower(password)] {
+		violations = append(violations, RuleBanned)
+	}
+	if p.Breaches != nil && password != "" {
+		breached, err := p.Breaches.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, RuleBreached)
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations : violations}
+	}
+	return nil
+}
+
+// BreachCorpus looks passwords up in a local copy of a k-anonymity breach
+// corpus: one file per 5 character SHA-1 prefix, named PREFIX.txt, holding
+// "SUFFIX:COUNT" lines, as produced by the Have I Been Pwned downloader.
+// Only the file for the password's prefix is read, and no network is used.
+type BreachCorpus struct {
+	Dir      string
+	MinCount int
+}
+
+// Check makes sure Dir holds a corpus. Contains treats a missing prefix
+// file as "not breached", so a wrong or empty directory would otherwise
+// turn the check off without a word.
+func (c *BreachCorpus) Check() error {
+	f, err := os.Open(c.Dir)
+	if err != nil {
+		return fmt.Errorf("breach corpus: %w", err)
+	}
+	defer f.Close()
+	for {
+		entries, err := f.ReadDir(256)
+		for _, entry := range entries {
+			name := entry.Name()
+			if len(name) == 9 && strings.HasSuffix(name, ".txt") && !entry.IsDir() {
+				return nil
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return fmt.Errorf("breach corpus: no PREFIX.txt files in %s", c.Dir)
+}
+
+func (c *BreachCorpus) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(c.Dir, prefix + ".txt"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, countString, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(countString)
+		if err != nil {
+			count = 1
+		}
+		return count >= c.MinCount, nil
+	}
+	return false, scanner.Err()
+}
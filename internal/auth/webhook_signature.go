@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebhookSignatureMissing = errors.New("webhook signature is missing")
+	ErrWebhookSignatureInvalid = errors.New("webhook signature is invalid")
+	ErrWebhookTimestamp        = errors.New("webhook timestamp is outside the tolerance window")
+)
+
+// SignWebhook returns a signature header value for body sent at timestamp.
+// The timestamp is signed with the body, so an old delivery cannot be
+// replayed with a fresh timestamp.
+func SignWebhook(secret []byte, timestamp time.Time, body []byte) string {
+	return "v1=" + hex.EncodeToString(webhookSignature(secret, strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+// VerifyWebhook checks a signature header made by SignWebhook. Any of
+// secrets may match, and the header may carry several comma separated
+// signatures, so either side can rotate secrets without downtime.
+func VerifyWebhook(secrets [][]byte, timestamp, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	if timestamp == "" || signature == "" {
+		return ErrWebhookSignatureMissing
+	}
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrWebhookSignatureInvalid
+	}
+	age := now.Sub(time.Unix(sentAt, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrWebhookTimestamp
+	}
+
+	for _, part := range strings.Split(signature, ",") {
+		encoded, ok := strings.CutPrefix(strings.TrimSpace(part), "v1=")
+		if !ok {
+			continue
+		}
+		got, err := hex.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		for _, secret := range secrets {
+			if hmac.Equal(got, webhookSignature(secret, timestamp, body)) {
+				return nil
+			}
+		}
+	}
+	return ErrWebhookSignatureInvalid
+}
+
+func webhookSignature(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -12,6 +12,23 @@ import (
 	"github.com/google/uuid"
 )
 
+const cancelUserDeletion = `-- name: CancelUserDeletion :execrows
+UPDATE users
+SET
+deletion_scheduled_at = NULL,
+updated_at = NOW()
+WHERE id = $1
+AND deletion_scheduled_at IS NOT NULL
+`
+
+func (q *Queries) CancelUserDeletion(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, cancelUserDeletion, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const createUser = `-- name: CreateUser :one
 INSERT INTO users (id, created_at, updated_at, email, hashed_password)
 VALUES (
@@ -21,7 +38,7 @@ VALUES (
     $1,
     $2
 )
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, deletion_scheduled_at, is_admin
 `
 
 type CreateUserParams struct {
@@ -39,10 +56,47 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.DeletionScheduledAt,
+		&i.IsAdmin,
 	)
 	return i, err
 }
 
+const deleteScheduledUsers = `-- name: DeleteScheduledUsers :many
+DELETE FROM users
+WHERE deletion_scheduled_at <= NOW()
+RETURNING id, email
+`
+
+type DeleteScheduledUsersRow struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) DeleteScheduledUsers(ctx context.Context) ([]DeleteScheduledUsersRow, error) {
+	rows, err := q.db.QueryContext(ctx, deleteScheduledUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []DeleteScheduledUsersRow
+	for rows.Next() {
+		var i DeleteScheduledUsersRow
+		if err := rows.Scan(&i.ID, &i.Email); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const deleteUsers = `-- name: DeleteUsers :exec
 DELETE FROM users
 `
@@ -53,7 +107,7 @@ func (q *Queries) DeleteUsers(ctx context.Context) error {
 }
 
 const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users WHERE email = $1
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, deletion_scheduled_at, is_admin FROM users WHERE email = $1
 `
 
 func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error) {
@@ -66,28 +120,19 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.DeletionScheduledAt,
+		&i.IsAdmin,
 	)
 	return i, err
 }
 
-const updateUserPwAndEmail = `-- name: UpdateUserPwAndEmail :one
-UPDATE users
-SET 
-hashed_password = $2,
-email = $3,
-updated_at = NOW()
-WHERE id = $1
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+const getUserByID = `-- name: GetUserByID :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, deletion_scheduled_at, is_admin FROM users WHERE id = $1
 `
 
-type UpdateUserPwAndEmailParams struct {
-	ID             uuid.UUID
-	HashedPassword sql.NullString
-	Email          string
-}
-
-func (q *Queries) UpdateUserPwAndEmail(ctx context.Context, arg UpdateUserPwAndEmailParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, updateUserPwAndEmail, arg.ID, arg.HashedPassword, arg.Email)
+func (q *Queries) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByID, id)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -96,17 +141,96 @@ func (q *Queries) UpdateUserPwAndEmail(ctx context.Context, arg UpdateUserPwAndE
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.DeletionScheduledAt,
+		&i.IsAdmin,
 	)
 	return i, err
 }
 
-const upgradeUser = `-- name: UpgradeUser :exec
+const rehashUserPassword = `-- name: RehashUserPassword :exec
 UPDATE users
-SET is_chirpy_red = true
+SET
+hashed_password = $2,
+updated_at = NOW()
+WHERE id = $1 AND hashed_password = $3
+`
+
+type RehashUserPasswordParams struct {
+	ID               uuid.UUID
+	HashedPassword   sql.NullString
+	HashedPassword_2 sql.NullString
+}
+
+func (q *Queries) RehashUserPassword(ctx context.Context, arg RehashUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, rehashUserPassword, arg.ID, arg.HashedPassword, arg.HashedPassword_2)
+	return err
+}
+
+const scheduleUserDeletion = `-- name: ScheduleUserDeletion :exec
+UPDATE users
+SET
+deletion_scheduled_at = $2,
+updated_at = NOW()
+WHERE id = $1
+`
+
+type ScheduleUserDeletionParams struct {
+	ID                  uuid.UUID
+	DeletionScheduledAt sql.NullTime
+}
+
+func (q *Queries) ScheduleUserDeletion(ctx context.Context, arg ScheduleUserDeletionParams) error {
+	_, err := q.db.ExecContext(ctx, scheduleUserDeletion, arg.ID, arg.DeletionScheduledAt)
+	return err
+}
+
+const updateUserEmail = `-- name: UpdateUserEmail :exec
+UPDATE users
+SET
+email = $2,
+email_verified_at = NOW(),
+updated_at = NOW()
+WHERE id = $1
+`
+
+type UpdateUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) UpdateUserEmail(ctx context.Context, arg UpdateUserEmailParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserEmail, arg.ID, arg.Email)
+	return err
+}
+
+const updateUserPassword = `-- name: UpdateUserPassword :exec
+UPDATE users
+SET
+hashed_password = $2,
+updated_at = NOW()
+WHERE id = $1
+`
+
+type UpdateUserPasswordParams struct {
+	ID             uuid.UUID
+	HashedPassword sql.NullString
+}
+
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPassword, arg.ID, arg.HashedPassword)
+	return err
+}
+
+const verifyUserEmail = `-- name: VerifyUserEmail :exec
+UPDATE users
+SET
+email_verified_at = NOW(),
+updated_at = NOW()
 WHERE id = $1
 `
 
-func (q *Queries) UpgradeUser(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, upgradeUser, id)
+func (q *Queries) VerifyUserEmail(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, verifyUserEmail, id)
 	return err
 }
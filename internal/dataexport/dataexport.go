@@ -0,0 +1,90 @@
+// Package dataexport writes a user's data as a ZIP archive with one JSON
+// file per section and an HTML index that a person can read without any
+// tooling.
+package dataexport
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+)
+
+// Section is one kind of data in the archive. Data is written as
+// Name.json; Columns and Rows are the same data as a table for the index.
+type Section struct {
+	Name    string
+	Title   string
+	Columns []string
+	Rows    [][]string
+	Data    any
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Your Chirpy data</title>
+<style>
+body { font-family: sans-serif; margin: 2rem; }
+table { border-collapse: collapse; margin-bottom: 2rem; }
+th, td { border: 1px solid #ccc; padding: 0.25rem 0.5rem; text-align: left; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Your Chirpy data</h1>
+<p>Exported {{.GeneratedAt.Format "January 2, 2006 15:04 MST"}}. Every section is also included as a JSON file.</p>
+<ul>
+{{range .Sections}}<li><a href="#{{.Name}}">{{.Title}}</a> ({{len .Rows}}, <a href="{{.Name}}.json">{{.Name}}.json</a>)</li>
+{{end}}</ul>
+{{range .Sections}}
+<h2 id="{{.Name}}">{{.Title}}</h2>
+{{if .Rows}}<table>
+<tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{else}}<p>Nothing here.</p>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+// Write writes the archive for sections to w.
+func Write(w io.Writer, generatedAt time.Time, sections []Section) error {
+	archive := zip.NewWriter(w)
+	for _, section := range sections {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name : section.Name + ".json",
+			Method : zip.Deflate,
+			Modified : generatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(section.Data)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", section.Name, err)
+		}
+	}
+
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name : "index.html",
+		Method : zip.Deflate,
+		Modified : generatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	err = indexTemplate.Execute(f, struct {
+		GeneratedAt time.Time
+		Sections    []Section
+	}{generatedAt, sections})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
@@ -0,0 +1,67 @@
+package dataexport
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	type chirp struct {
+		Body string `json:"body"`
+	}
+	buf := &bytes.Buffer{}
+	err := Write(buf, time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), []Section{
+		{
+			Name : "chirps",
+			Title : "Chirps",
+			Columns : []string{"Body"},
+			Rows : [][]string{{"<script>alert(1)</script>"}},
+			Data : []chirp{{Body : "<script>alert(1)</script>"}},
+		},
+		{
+			Name : "sessions",
+			Title : "Sessions",
+			Data : []string{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(dat)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", len(files))
+	}
+
+	chirps := []chirp{}
+	err = json.Unmarshal([]byte(files["chirps.json"]), &chirps)
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "<script>alert(1)</script>" {
+		t.Errorf("unexpected chirps.json %q", files["chirps.json"])
+	}
+
+	index := files["index.html"]
+	if strings.Contains(index, "<script>") || !strings.Contains(index, "&lt;script&gt;") {
+		t.Errorf("expected chirp body to be escaped in the index")
+	}
+	if !strings.Contains(index, `href="sessions.json"`) || !strings.Contains(index, "Nothing here.") {
+		t.Errorf("expected empty sections to be listed")
+	}
+}
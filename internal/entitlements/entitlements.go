@@ -0,0 +1,115 @@
+// Package entitlements maps plans to what their members may do. Handlers
+// ask how high one of a plan's limits is, so what a plan includes can
+// change through configuration rather than code.
+package entitlements
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+type Limit string
+
+const (
+	ChirpLength     Limit = "chirp_length"
+	ChirpsPerMinute Limit = "chirps_per_minute"
+)
+
+const (
+	PlanFree = "free"
+	PlanRed  = "red"
+)
+
+var knownLimits = map[Limit]bool{
+	ChirpLength : true,
+	ChirpsPerMinute : true,
+}
+
+type Plan struct {
+	Limits map[Limit]int `json:"limits"`
+}
+
+type Config struct {
+	plans map[string]Plan
+}
+
+// Default is what the plans include when nothing is configured.
+func Default() *Config {
+	return &Config{
+		plans : map[string]Plan{
+			PlanFree : {
+				Limits : map[Limit]int{
+					ChirpLength : 140,
+					ChirpsPerMinute : 10,
+				},
+			},
+			PlanRed : {
+				Limits : map[Limit]int{
+					ChirpLength : 1000,
+					ChirpsPerMinute : 60,
+				},
+			},
+		},
+	}
+}
+
+// Parse reads a JSON object of plans on top of the defaults. Limits a plan
+// leaves out keep their default value. Unknown fields are rejected so a
+// setting the server does not understand is not silently ignored.
+func Parse(r io.Reader) (*Config, error) {
+	overrides := map[string]Plan{}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	for name, override := range overrides {
+		plan := cfg.plans[name]
+		limits := map[Limit]int{}
+		for limit, value := range plan.Limits {
+			limits[limit] = value
+		}
+		for limit, value := range override.Limits {
+			if !knownLimits[limit] {
+				return nil, fmt.Errorf("plan %s: unknown limit %q", name, limit)
+			}
+			if value < 0 {
+				return nil, fmt.Errorf("plan %s: limit %s must not be negative", name, limit)
+			}
+			limits[limit] = value
+		}
+		plan.Limits = limits
+		cfg.plans[name] = plan
+	}
+	return cfg, nil
+}
+
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Plan returns the named plan, falling back to the free plan for names
+// that are not configured.
+func (c *Config) Plan(name string) Plan {
+	plan, ok := c.plans[name]
+	if !ok {
+		return c.plans[PlanFree]
+	}
+	return plan
+}
+
+// Limit returns how much of something a plan allows. 0 means there is no
+// limit, which is also what a plan that does not set one gets.
+func (c *Config) Limit(plan string, limit Limit) int {
+	return c.Plan(plan).Limits[limit]
+}
@@ -0,0 +1,53 @@
+package entitlements
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	cfg := Default()
+	if cfg.Limit(PlanFree, ChirpLength) != 140 {
+		t.Errorf("expected free chirps to be limited to 140 characters, got %v", cfg.Limit(PlanFree, ChirpLength))
+	}
+	if cfg.Limit(PlanRed, ChirpLength) <= cfg.Limit(PlanFree, ChirpLength) {
+		t.Errorf("expected red chirps to be longer")
+	}
+	if cfg.Limit("gold", ChirpLength) != 140 {
+		t.Errorf("expected unknown plans to get the free plan")
+	}
+}
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{
+		"free": {"limits": {"chirp_length": 280}},
+		"red": {"limits": {"chirps_per_minute": 0}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Limit(PlanFree, ChirpLength) != 280 {
+		t.Errorf("expected overridden limit, got %v", cfg.Limit(PlanFree, ChirpLength))
+	}
+	if cfg.Limit(PlanFree, ChirpsPerMinute) != 10 || cfg.Limit(PlanRed, ChirpLength) != 1000 {
+		t.Errorf("expected limits that are not overridden to keep their default")
+	}
+	if cfg.Limit(PlanRed, ChirpsPerMinute) != 0 {
+		t.Errorf("expected a limit of 0 to remove the limit, got %v", cfg.Limit(PlanRed, ChirpsPerMinute))
+	}
+	if Default().Limit(PlanFree, ChirpLength) != 140 {
+		t.Errorf("expected parsing not to change the defaults")
+	}
+
+	for _, config := range []string{
+		`{"red": {"features": ["edit_chirps"]}}`,
+		`{"red": {"limits": {"followers": 10}}}`,
+		`{"red": {"limits": {"chirp_length": -1}}}`,
+		`not json`,
+	} {
+		_, err := Parse(strings.NewReader(config))
+		if err == nil {
+			t.Errorf("expected %s to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Record is the failure history kept for one key, such as an email address
+// or a client IP.
+type Record struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// Tracker stores failure records. The in-memory tracker is enough for a
+// single instance; PostgresTracker shares records between replicas.
+type Tracker interface {
+	Get(ctx context.Context, key string) (Record, error)
+	RecordFailure(ctx context.Context, key string, window time.Duration) (Record, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+type Policy struct {
+	// FreeAttempts failures are allowed before delays start.
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// LockAfter failures within Window lock the key for LockDuration.
+	LockAfter    int
+	LockDuration time.Duration
+	Window       time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		FreeAttempts : 3,
+		BaseDelay : time.Second,
+		MaxDelay : 30 * time.Second,
+		LockAfter : 10,
+		LockDuration : 15 * time.Minute,
+		Window : 15 * time.Minute,
+	}
+}
+
+// Delay is how long a caller has to wait after the last failure before
+// trying again. It doubles with every failure past the free attempts.
+func (p Policy) Delay(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+type Limiter struct {
+	Tracker Tracker
+	Policy  Policy
+	Now     func() time.Time
+}
+
+func NewLimiter(tracker Tracker, policy Policy) *Limiter {
+	return &Limiter{
+		Tracker : tracker,
+		Policy : policy,
+		Now : time.Now,
+	}
+}
+
+// Check returns how long the caller must wait before key may try again,
+// and whether that is because the key is locked rather than just delayed.
+func (l *Limiter) Check(ctx context.Context, key string) (time.Duration, bool, error) {
+	rec, err := l.Tracker.Get(ctx, key)
+	if err != nil {
+		return 0, false, err
+	}
+	now := l.Now()
+	if rec.LockedUntil.After(now) {
+		return rec.LockedUntil.Sub(now), true, nil
+	}
+	if rec.LastFailureAt.Before(now.Add(-l.Policy.Window)) {
+		return 0, false, nil
+	}
+	wait := rec.LastFailureAt.Add(l.Policy.Delay(rec.Failures)).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, false, nil
+}
+
+// Fail records a failure for key and reports whether it just caused the
+// key to be locked.
+func (l *Limiter) Fail(ctx context.Context, key string) (bool, error) {
+	rec, err := l.Tracker.RecordFailure(ctx, key, l.Policy.Window)
+	if err != nil {
+		return false, err
+	}
+	if l.Policy.LockAfter <= 0 || rec.Failures < l.Policy.LockAfter {
+		return false, nil
+	}
+	err = l.Tracker.Lock(ctx, key, l.Now().Add(l.Policy.LockDuration))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.Tracker.Reset(ctx, key)
+}
+
+const maxMemoryRecords = 10000
+
+type MemoryTracker struct {
+	mu      sync.Mutex
+	records map[string]*memoryRecord
+	now     func() time.Time
+}
+
+type memoryRecord struct {
+	Record
+	windowStartedAt time.Time
+}
+
+func NewMemoryTracker() *MemoryTracker {
+	return &MemoryTracker{
+		records : map[string]*memoryRecord{},
+		now : time.Now,
+	}
+}
+
+func (m *MemoryTracker) Get(ctx context.Context, key string) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok {
+		return Record{}, nil
+	}
+	return rec.Record, nil
+}
+
+func (m *MemoryTracker) RecordFailure(ctx context.Context, key string, window time.Duration) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if len(m.records) >= maxMemoryRecords {
+		m.prune(now.Add(-window))
+	}
+	rec, ok := m.records[key]
+	if !ok {
+		rec = &memoryRecord{}
+		m.records[key] = rec
+	}
+	if rec.windowStartedAt.Before(now.Add(-window)) {
+		rec.Failures = 0
+		rec.windowStartedAt = now
+	}
+	rec.Failures++
+	rec.LastFailureAt = now
+	return rec.Record, nil
+}
+
+// prune drops records that are neither locked nor recent, so a stream of
+// failures from many IPs cannot grow the map forever.
+func (m *MemoryTracker) prune(cutoff time.Time) {
+	now := m.now()
+	for key, rec := range m.records {
+		if rec.LastFailureAt.Before(cutoff) && !rec.LockedUntil.After(now) {
+			delete(m.records, key)
+		}
+	}
+}
+
+func (m *MemoryTracker) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.records[key]
+	if !ok {
+		rec = &memoryRecord{}
+		m.records[key] = rec
+	}
+	rec.LockedUntil = until
+	return nil
+}
+
+func (m *MemoryTracker) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	return nil
+}
@@ -0,0 +1,91 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	p := DefaultPolicy()
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{9, 30 * time.Second},
+		{50, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d): expected %v, got %v", tt.failures, tt.want, got)
+		}
+	}
+}
+
+func TestLimiterLocksAfterRepeatedFailures(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	tracker := NewMemoryTracker()
+	tracker.now = func() time.Time { return now }
+	limiter := NewLimiter(tracker, DefaultPolicy())
+	limiter.Now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		locked, err := limiter.Fail(ctx, "email:test@test.com")
+		if err != nil || locked {
+			t.Fatalf("failure %d: unexpected lock or error %v", i, err)
+		}
+	}
+	wait, locked, _ := limiter.Check(ctx, "email:test@test.com")
+	if wait != 0 || locked {
+		t.Fatalf("expected free attempts to have no delay, got %v", wait)
+	}
+
+	limiter.Fail(ctx, "email:test@test.com")
+	wait, locked, _ = limiter.Check(ctx, "email:test@test.com")
+	if wait != time.Second || locked {
+		t.Fatalf("expected one second delay, got %v, locked %v", wait, locked)
+	}
+
+	for i := 5; i < 10; i++ {
+		limiter.Fail(ctx, "email:test@test.com")
+	}
+	locked, _ = limiter.Fail(ctx, "email:test@test.com")
+	if !locked {
+		t.Fatal("expected tenth failure to lock the key")
+	}
+	wait, locked, _ = limiter.Check(ctx, "email:test@test.com")
+	if !locked || wait != 15 * time.Minute {
+		t.Fatalf("expected 15 minute lock, got %v, locked %v", wait, locked)
+	}
+
+	other, _, _ := limiter.Check(ctx, "email:other@test.com")
+	if other != 0 {
+		t.Fatal("expected other keys to be unaffected")
+	}
+
+	limiter.Reset(ctx, "email:test@test.com")
+	wait, locked, _ = limiter.Check(ctx, "email:test@test.com")
+	if wait != 0 || locked {
+		t.Fatal("expected reset to clear the lock")
+	}
+}
+
+func TestMemoryTrackerWindowExpires(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	tracker := NewMemoryTracker()
+	tracker.now = func() time.Time { return now }
+	tracker.RecordFailure(ctx, "ip:127.0.0.1", time.Minute)
+	tracker.RecordFailure(ctx, "ip:127.0.0.1", time.Minute)
+	now = now.Add(2 * time.Minute)
+	rec, _ := tracker.RecordFailure(ctx, "ip:127.0.0.1", time.Minute)
+	if rec.Failures != 1 {
+		t.Fatalf("expected failures to restart after the window, got %d", rec.Failures)
+	}
+}
@@ -0,0 +1,65 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+)
+
+type PostgresTracker struct {
+	db *database.Queries
+}
+
+func NewPostgresTracker(db *database.Queries) *PostgresTracker {
+	return &PostgresTracker{
+		db : db,
+	}
+}
+
+func toRecord(attempt database.LoginAttempt) Record {
+	rec := Record{
+		Failures : int(attempt.Failures),
+		LastFailureAt : attempt.LastFailureAt,
+	}
+	if attempt.LockedUntil.Valid {
+		rec.LockedUntil = attempt.LockedUntil.Time
+	}
+	return rec
+}
+
+func (p *PostgresTracker) Get(ctx context.Context, key string) (Record, error) {
+	attempt, err := p.db.GetLoginAttempt(ctx, key)
+	if err == sql.ErrNoRows {
+		return Record{}, nil
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return toRecord(attempt), nil
+}
+
+func (p *PostgresTracker) RecordFailure(ctx context.Context, key string, window time.Duration) (Record, error) {
+	attempt, err := p.db.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+		Key : key,
+		WindowStart : time.Now().Add(-window),
+	})
+	if err != nil {
+		return Record{}, err
+	}
+	return toRecord(attempt), nil
+}
+
+func (p *PostgresTracker) Lock(ctx context.Context, key string, until time.Time) error {
+	return p.db.LockLoginAttempt(ctx, database.LockLoginAttemptParams{
+		Key : key,
+		LockedUntil : sql.NullTime{
+			Time : until,
+			Valid : true,
+		},
+	})
+}
+
+func (p *PostgresTracker) Reset(ctx context.Context, key string) error {
+	return p.db.DeleteLoginAttempt(ctx, key)
+}
@@ -0,0 +1,137 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Config struct {
+	Backend  string
+	From     string
+	SMTPAddr string
+	Username string
+	Password string
+	Dir      string
+}
+
+// New picks a backend from cfg.Backend: "smtp", "file" or "log". Anything
+// else, including an empty string, logs messages instead of sending them.
+func New(cfg Config) (Mailer, error) {
+	switch cfg.Backend {
+	case "smtp":
+		if cfg.SMTPAddr == "" || cfg.From == "" {
+			return nil, fmt.Errorf("SMTP mailer needs an address and a from address")
+		}
+		return &SMTPMailer{
+			Addr : cfg.SMTPAddr,
+			From : cfg.From,
+			Username : cfg.Username,
+			Password : cfg.Password,
+		}, nil
+	case "file":
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("File mailer needs a directory")
+		}
+		return &FileMailer{
+			Dir : cfg.Dir,
+			From : cfg.From,
+		}, nil
+	default:
+		return &LogMailer{
+			From : cfg.From,
+		}, nil
+	}
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func validHeader(s string) bool {
+	return !strings.ContainsAny(s, "\r\n")
+}
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if !validHeader(msg.To) || !validHeader(msg.Subject) {
+		return fmt.Errorf("Invalid message header")
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FileMailer writes each message to its own .eml file, which is handy for
+// local development and tests that need to read the links back out.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if !validHeader(msg.To) || !validHeader(msg.Subject) {
+		return fmt.Errorf("Invalid message header")
+	}
+	err := os.MkdirAll(m.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(msg.To, "/", "_"))
+	return os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0644)
+}
+
+type LogMailer struct {
+	From string
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPicksBackend(t *testing.T) {
+	m, err := New(Config{})
+	if _, ok := m.(*LogMailer); err != nil || !ok {
+		t.Errorf("expected log mailer by default, got %T, %v", m, err)
+	}
+	m, err = New(Config{Backend : "file", Dir : t.TempDir()})
+	if _, ok := m.(*FileMailer); err != nil || !ok {
+		t.Errorf("expected file mailer, got %T, %v", m, err)
+	}
+	m, err = New(Config{Backend : "smtp", SMTPAddr : "localhost:25", From : "chirpy@example.com"})
+	if _, ok := m.(*SMTPMailer); err != nil || !ok {
+		t.Errorf("expected smtp mailer, got %T, %v", m, err)
+	}
+	_, err = New(Config{Backend : "smtp"})
+	if err == nil {
+		t.Errorf("expected error for smtp mailer without address")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir : dir, From : "chirpy@example.com"}
+	err := m.Send(context.Background(), Message{
+		To : "test@test.com",
+		Subject : "Verify your email",
+		Body : "Open http://localhost:8080/api/users/verify?token=abc\n",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected one message, got %d", len(files))
+	}
+	dat, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(dat), "To: test@test.com\r\n") || !strings.Contains(string(dat), "verify?token=abc") {
+		t.Fatalf("unexpected message: %s", dat)
+	}
+
+	err = m.Send(context.Background(), Message{To : "a@test.com\r\nBcc: b@test.com", Subject : "x"})
+	if err == nil {
+		t.Fatal("expected error for header injection")
+	}
+}
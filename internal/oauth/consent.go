@@ -0,0 +1,112 @@
+package oauth
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"github.com/andrei-himself/chirpy/internal/auth"
+)
+
+var scopeDescriptions = map[string]string{
+	auth.ScopeChirpsRead : "Read chirps on your behalf",
+	auth.ScopeChirpsWrite : "Post and delete chirps as you",
+	auth.ScopeMessagesRead : "Read your private messages",
+	auth.ScopeMessagesWrite : "Send private messages as you and manage who you block",
+	auth.ScopeProfileWrite : "Change your email address and password",
+	auth.ScopeWebhooksWrite : "Manage webhooks that receive your account's events",
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.Client.Name}} - Chirpy</title>
+</head>
+<body>
+<h1>{{.Client.Name}} wants to access your Chirpy account</h1>
+{{if .Message}}<p><strong>{{.Message}}</strong></p>{{end}}
+<p>It will be able to:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+<p>You will be sent back to <code>{{.RedirectURI}}</code>.</p>
+<form method="post">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.Client.ID}}">
+{{if .RedirectURIGiven}}<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+{{end}}<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<p><label>Email <input type="email" name="email" autocomplete="username"></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password"></label></p>
+<p><label>Two-factor code (if enabled) <input type="text" name="code" autocomplete="one-time-code"></label></p>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorization failed - Chirpy</title>
+</head>
+<body>
+<h1>Authorization failed</h1>
+<p>{{.}}</p>
+</body>
+</html>
+`))
+
+// setPageHeaders keeps the consent page out of frames and caches, so it
+// cannot be used for clickjacking or replayed from history.
+func setPageHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+}
+
+func renderConsent(w http.ResponseWriter, status int, ar authorizeRequest, message string) {
+	scopes := []string{}
+	for _, scope := range ar.Scopes {
+		scopes = append(scopes, scopeDescriptions[scope])
+	}
+	setPageHeaders(w)
+	w.WriteHeader(status)
+	err := consentTemplate.Execute(w, struct {
+		Client        Client
+		Message       string
+		Scopes        []string
+		Scope         string
+		RedirectURI   string
+		RedirectURIGiven bool
+		State         string
+		CodeChallenge string
+	}{
+		Client : ar.Client,
+		Message : message,
+		Scopes : scopes,
+		Scope : strings.Join(ar.Scopes, " "),
+		RedirectURI : ar.RedirectURI,
+		RedirectURIGiven : ar.RedirectURIGiven,
+		State : ar.State,
+		CodeChallenge : ar.CodeChallenge,
+	})
+	if err != nil {
+		log.Printf("Error rendering consent page: %s", err)
+	}
+}
+
+func renderError(w http.ResponseWriter, status int, message string) {
+	setPageHeaders(w)
+	w.WriteHeader(status)
+	err := errorTemplate.Execute(w, message)
+	if err != nil {
+		log.Printf("Error rendering error page: %s", err)
+	}
+}
@@ -0,0 +1,565 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+// AccessTokenAudience is the aud claim of access tokens issued to OAuth
+// clients. Plain access token validation rejects them; resource handlers
+// accept them through KeySet.ValidateScopedJWT with a scope check.
+const AccessTokenAudience = "chirpy-oauth"
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrLoginThrottled is returned by a LoginFunc when the user has to
+	// wait before trying again.
+	ErrLoginThrottled = errors.New("too many failed login attempts")
+)
+
+type Client struct {
+	ID           uuid.UUID
+	Name         string
+	RedirectURIs []string
+	// SecretHash is empty for public clients, which rely on PKCE alone.
+	SecretHash string
+}
+
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	// RedirectURI is empty when the authorization request left it out, in
+	// which case the token request need not repeat it.
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+type RefreshToken struct {
+	Token     string
+	ClientID  uuid.UUID
+	UserID    uuid.UUID
+	Scopes    []string
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// Store keeps clients, authorization codes and refresh tokens. Consume
+// methods must be atomic so a code or refresh token is only used once,
+// and must leave it untouched when it belongs to another client.
+type Store interface {
+	GetClient(ctx context.Context, id uuid.UUID) (Client, error)
+	CreateCode(ctx context.Context, code AuthorizationCode) error
+	ConsumeCode(ctx context.Context, codeHash string, clientID uuid.UUID) (AuthorizationCode, error)
+	CreateRefreshToken(ctx context.Context, token RefreshToken) error
+	ConsumeRefreshToken(ctx context.Context, token string, clientID uuid.UUID) (RefreshToken, error)
+	GetRefreshToken(ctx context.Context, token string) (RefreshToken, error)
+}
+
+// LoginFunc checks the credentials typed into the consent page and returns
+// the user they belong to. code is the optional second factor.
+type LoginFunc func(req *http.Request, email, password, code string) (uuid.UUID, error)
+
+type Server struct {
+	Store Store
+	Keys  *auth.KeySet
+	Login LoginFunc
+	// Scopes are the scopes clients may ask for. profile:write is left out
+	// by default since it allows changing the account's email and password,
+	// and the messages scopes since private messages are not for every app.
+	Scopes          []string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	CodeTTL         time.Duration
+	Now             func() time.Time
+}
+
+func NewServer(store Store, keys *auth.KeySet, login LoginFunc) *Server {
+	return &Server{
+		Store : store,
+		Keys : keys,
+		Login : login,
+		Scopes : []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite, auth.ScopeWebhooksWrite},
+		AccessTokenTTL : 15 * time.Minute,
+		RefreshTokenTTL : 60 * 24 * time.Hour,
+		CodeTTL : time.Minute,
+		Now : time.Now,
+	}
+}
+
+// Error is an OAuth error response as defined in RFC 6749 section 5.2.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+func (e *Error) status() int {
+	switch e.Code {
+	case "invalid_client":
+		return 401
+	case "server_error":
+		return 500
+	default:
+		return 400
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	dat, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(dat)
+}
+
+func writeError(w http.ResponseWriter, req *http.Request, oerr *Error) {
+	if oerr.Code == "invalid_client" {
+		if _, _, ok := req.BasicAuth(); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		}
+	}
+	writeJSON(w, oerr.status(), oerr)
+}
+
+func serverError(err error) *Error {
+	log.Printf("Error in OAuth request: %s", err)
+	return &Error{Code : "server_error"}
+}
+
+// ValidRedirectURI accepts https URLs, and plain http only for loopback
+// addresses used by native apps. Fragments are not allowed.
+func ValidRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Fragment != "" || u.Host == "" {
+		return fmt.Errorf("Redirect URI must be absolute and have no fragment")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return nil
+		}
+	}
+	return fmt.Errorf("Redirect URI must use https, or http on a loopback address")
+}
+
+// VerifyPKCE checks an S256 code verifier against the challenge sent to the
+// authorization endpoint.
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+type authorizeRequest struct {
+	Client        Client
+	RedirectURI   string
+	// RedirectURIGiven is false when RedirectURI fell back to the client's
+	// only registered URI.
+	RedirectURIGiven bool
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// parseAuthorize validates an authorization request. Errors about the
+// client or redirect URI are returned with redirect false, since sending
+// the user to an unverified URI would make Chirpy an open redirector.
+func (s *Server) parseAuthorize(ctx context.Context, form url.Values) (authorizeRequest, *Error, bool) {
+	ar := authorizeRequest{
+		State : form.Get("state"),
+	}
+	clientID, err := uuid.Parse(form.Get("client_id"))
+	if err != nil {
+		return ar, &Error{Code : "invalid_request", Description : "Unknown client"}, false
+	}
+	ar.Client, err = s.Store.GetClient(ctx, clientID)
+	if errors.Is(err, ErrNotFound) {
+		return ar, &Error{Code : "invalid_request", Description : "Unknown client"}, false
+	}
+	if err != nil {
+		return ar, serverError(err), false
+	}
+
+	ar.RedirectURI = form.Get("redirect_uri")
+	ar.RedirectURIGiven = ar.RedirectURI != ""
+	if ar.RedirectURI == "" && len(ar.Client.RedirectURIs) == 1 {
+		ar.RedirectURI = ar.Client.RedirectURIs[0]
+	}
+	if !slices.Contains(ar.Client.RedirectURIs, ar.RedirectURI) {
+		return ar, &Error{Code : "invalid_request", Description : "Redirect URI is not registered for this client"}, false
+	}
+
+	if form.Get("response_type") != "code" {
+		return ar, &Error{Code : "unsupported_response_type"}, true
+	}
+	ar.CodeChallenge = form.Get("code_challenge")
+	if ar.CodeChallenge == "" || form.Get("code_challenge_method") != "S256" {
+		return ar, &Error{Code : "invalid_request", Description : "PKCE with S256 is required"}, true
+	}
+	ar.Scopes, err = auth.ParseScopes(strings.Fields(form.Get("scope")))
+	if err != nil {
+		return ar, &Error{Code : "invalid_scope", Description : err.Error()}, true
+	}
+	for _, scope := range ar.Scopes {
+		if !slices.Contains(s.Scopes, scope) {
+			return ar, &Error{Code : "invalid_scope", Description : fmt.Sprintf("Scope %q is not available to OAuth clients", scope)}, true
+		}
+	}
+	return ar, nil, true
+}
+
+func redirectTo(w http.ResponseWriter, req *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+func redirectWithError(w http.ResponseWriter, req *http.Request, ar authorizeRequest, oerr *Error) {
+	params := url.Values{}
+	params.Set("error", oerr.Code)
+	if oerr.Description != "" {
+		params.Set("error_description", oerr.Description)
+	}
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+	redirectTo(w, req, ar.RedirectURI, params)
+}
+
+// HandleAuthorize shows the consent page on GET and processes it on POST.
+// The page asks for the user's credentials since Chirpy has no browser
+// sessions.
+func (s *Server) HandleAuthorize(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		renderError(w, 400, "Malformed request")
+		return
+	}
+	ar, oerr, redirect := s.parseAuthorize(req.Context(), req.Form)
+	if oerr != nil && !redirect {
+		renderError(w, oerr.status(), oerr.Description)
+		return
+	}
+	if oerr != nil {
+		redirectWithError(w, req, ar, oerr)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		renderConsent(w, 200, ar, "")
+		return
+	}
+	if req.PostForm.Get("decision") != "allow" {
+		redirectWithError(w, req, ar, &Error{Code : "access_denied"})
+		return
+	}
+
+	userID, err := s.Login(req, req.PostForm.Get("email"), req.PostForm.Get("password"), req.PostForm.Get("code"))
+	if errors.Is(err, ErrLoginThrottled) {
+		renderConsent(w, 429, ar, "Too many failed login attempts, try again later")
+		return
+	}
+	if err != nil {
+		renderConsent(w, 401, ar, "Incorrect email, password or code")
+		return
+	}
+
+	code, err := auth.MakeOneTimeToken()
+	if err != nil {
+		redirectWithError(w, req, ar, serverError(err))
+		return
+	}
+	codeRedirectURI := ""
+	if ar.RedirectURIGiven {
+		codeRedirectURI = ar.RedirectURI
+	}
+	err = s.Store.CreateCode(req.Context(), AuthorizationCode{
+		CodeHash : auth.HashToken(code),
+		ClientID : ar.Client.ID,
+		UserID : userID,
+		RedirectURI : codeRedirectURI,
+		Scopes : ar.Scopes,
+		CodeChallenge : ar.CodeChallenge,
+		ExpiresAt : s.Now().Add(s.CodeTTL),
+	})
+	if err != nil {
+		redirectWithError(w, req, ar, serverError(err))
+		return
+	}
+
+	params := url.Values{}
+	params.Set("code", code)
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+	redirectTo(w, req, ar.RedirectURI, params)
+}
+
+// authenticateClient accepts client_secret_basic, client_secret_post, or
+// just a client_id for public clients.
+func (s *Server) authenticateClient(req *http.Request) (Client, *Error) {
+	clientID, secret, basic := req.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+
+	id, err := uuid.Parse(clientID)
+	if err != nil {
+		return Client{}, &Error{Code : "invalid_client"}
+	}
+	client, err := s.Store.GetClient(req.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		return Client{}, &Error{Code : "invalid_client"}
+	}
+	if err != nil {
+		return Client{}, serverError(err)
+	}
+	if client.SecretHash == "" {
+		if secret != "" {
+			return Client{}, &Error{Code : "invalid_client"}
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return Client{}, &Error{Code : "invalid_client"}
+	}
+	return client, nil
+}
+
+func (s *Server) HandleToken(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		writeError(w, req, &Error{Code : "invalid_request"})
+		return
+	}
+	client, oerr := s.authenticateClient(req)
+	if oerr != nil {
+		writeError(w, req, oerr)
+		return
+	}
+
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		oerr = s.exchangeCode(w, req, client)
+	case "refresh_token":
+		oerr = s.refresh(w, req, client)
+	default:
+		oerr = &Error{Code : "unsupported_grant_type"}
+	}
+	if oerr != nil {
+		writeError(w, req, oerr)
+	}
+}
+
+// exchangeCode redeems an authorization code. The store only consumes a
+// code issued to this client, so another client guessing or stealing it
+// cannot burn it. redirect_uri must match only if the authorization
+// request included one (RFC 6749 section 4.1.3).
+func (s *Server) exchangeCode(w http.ResponseWriter, req *http.Request, client Client) *Error {
+	code, err := s.Store.ConsumeCode(req.Context(), auth.HashToken(req.PostForm.Get("code")), client.ID)
+	if errors.Is(err, ErrNotFound) {
+		return &Error{Code : "invalid_grant", Description : "Unknown or used authorization code"}
+	}
+	if err != nil {
+		return serverError(err)
+	}
+	if (code.RedirectURI != "" && code.RedirectURI != req.PostForm.Get("redirect_uri")) || s.Now().After(code.ExpiresAt) {
+		return &Error{Code : "invalid_grant", Description : "Authorization code is invalid or expired"}
+	}
+	if !VerifyPKCE(req.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		return &Error{Code : "invalid_grant", Description : "Code verifier does not match"}
+	}
+	return s.issueTokens(w, req.Context(), client, code.UserID, code.Scopes, code.Scopes)
+}
+
+// refresh rotates the refresh token. The client may ask for fewer scopes
+// on the new access token, but never more than were granted.
+func (s *Server) refresh(w http.ResponseWriter, req *http.Request, client Client) *Error {
+	token, err := s.Store.ConsumeRefreshToken(req.Context(), req.PostForm.Get("refresh_token"), client.ID)
+	if errors.Is(err, ErrNotFound) {
+		return &Error{Code : "invalid_grant", Description : "Unknown or revoked refresh token"}
+	}
+	if err != nil {
+		return serverError(err)
+	}
+	if s.Now().After(token.ExpiresAt) {
+		return &Error{Code : "invalid_grant", Description : "Refresh token is expired"}
+	}
+
+	scopes := token.Scopes
+	if requested := strings.Fields(req.PostForm.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(token.Scopes, scope) {
+				return &Error{Code : "invalid_scope", Description : fmt.Sprintf("Scope %q was not granted", scope)}
+			}
+		}
+		scopes = requested
+	}
+	return s.issueTokens(w, req.Context(), client, token.UserID, scopes, token.Scopes)
+}
+
+func (s *Server) issueTokens(w http.ResponseWriter, ctx context.Context, client Client, userID uuid.UUID, scopes, granted []string) *Error {
+	type tokenResp struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+
+	accessToken, err := s.Keys.MakeScopedJWT(auth.ScopedClaims{
+		UserID : userID,
+		ClientID : client.ID.String(),
+		Scopes : scopes,
+	}, AccessTokenAudience, s.AccessTokenTTL)
+	if err != nil {
+		return serverError(err)
+	}
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return serverError(err)
+	}
+	err = s.Store.CreateRefreshToken(ctx, RefreshToken{
+		Token : refreshToken,
+		ClientID : client.ID,
+		UserID : userID,
+		Scopes : granted,
+		ExpiresAt : s.Now().Add(s.RefreshTokenTTL),
+	})
+	if err != nil {
+		return serverError(err)
+	}
+
+	writeJSON(w, 200, tokenResp{
+		AccessToken : accessToken,
+		TokenType : "Bearer",
+		ExpiresIn : int(s.AccessTokenTTL.Seconds()),
+		RefreshToken : refreshToken,
+		Scope : strings.Join(scopes, " "),
+	})
+	return nil
+}
+
+// HandleRevoke implements RFC 7009 for refresh tokens. Access tokens are
+// short-lived JWTs and cannot be revoked, but the request still succeeds
+// as the RFC requires.
+func (s *Server) HandleRevoke(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil || req.PostForm.Get("token") == "" {
+		writeError(w, req, &Error{Code : "invalid_request"})
+		return
+	}
+	client, oerr := s.authenticateClient(req)
+	if oerr != nil {
+		writeError(w, req, oerr)
+		return
+	}
+
+	_, err = s.Store.ConsumeRefreshToken(req.Context(), req.PostForm.Get("token"), client.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		writeError(w, req, serverError(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+}
+
+// HandleIntrospect implements RFC 7662. Clients can only introspect
+// tokens that were issued to them.
+func (s *Server) HandleIntrospect(w http.ResponseWriter, req *http.Request) {
+	type introspectResp struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		writeError(w, req, &Error{Code : "invalid_request"})
+		return
+	}
+	client, oerr := s.authenticateClient(req)
+	if oerr != nil {
+		writeError(w, req, oerr)
+		return
+	}
+	token := req.PostForm.Get("token")
+
+	claims, err := s.Keys.ValidateScopedJWT(token, AccessTokenAudience)
+	if err == nil && claims.ClientID == client.ID.String() {
+		writeJSON(w, 200, introspectResp{
+			Active : true,
+			Scope : strings.Join(claims.Scopes, " "),
+			ClientID : claims.ClientID,
+			Subject : claims.UserID.String(),
+			ExpiresAt : claims.ExpiresAt.Unix(),
+			TokenType : "Bearer",
+		})
+		return
+	}
+
+	refresh, err := s.Store.GetRefreshToken(req.Context(), token)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		writeError(w, req, serverError(err))
+		return
+	}
+	if err == nil && refresh.ClientID == client.ID && !refresh.Revoked && s.Now().Before(refresh.ExpiresAt) {
+		writeJSON(w, 200, introspectResp{
+			Active : true,
+			Scope : strings.Join(refresh.Scopes, " "),
+			ClientID : client.ID.String(),
+			Subject : refresh.UserID.String(),
+			ExpiresAt : refresh.ExpiresAt.Unix(),
+		})
+		return
+	}
+	writeJSON(w, 200, introspectResp{Active : false})
+}
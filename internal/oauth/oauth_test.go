@@ -0,0 +1,378 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+type testEnv struct {
+	server   *httptest.Server
+	store    *MemoryStore
+	keys     *auth.KeySet
+	client   Client
+	secret   string
+	userID   uuid.UUID
+	redirect string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	env := &testEnv{
+		store : NewMemoryStore(),
+		keys : auth.NewHMACKeySet("secret"),
+		secret : "client-secret",
+		userID : uuid.New(),
+		redirect : "https://app.example.com/callback",
+	}
+	env.client = Client{
+		ID : uuid.New(),
+		Name : "Test App",
+		RedirectURIs : []string{env.redirect},
+		SecretHash : auth.HashToken(env.secret),
+	}
+	env.store.AddClient(env.client)
+
+	login := func(req *http.Request, email, password, code string) (uuid.UUID, error) {
+		if email == "test@test.com" && password == "password" {
+			return env.userID, nil
+		}
+		return uuid.Nil, errors.New("bad credentials")
+	}
+	srv := NewServer(env.store, env.keys, login)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/authorize", srv.HandleAuthorize)
+	mux.HandleFunc("POST /oauth/token", srv.HandleToken)
+	mux.HandleFunc("POST /oauth/revoke", srv.HandleRevoke)
+	mux.HandleFunc("POST /oauth/introspect", srv.HandleIntrospect)
+	env.server = httptest.NewServer(mux)
+	t.Cleanup(env.server.Close)
+	return env
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (env *testEnv) authorizeParams() url.Values {
+	return url.Values{
+		"response_type" : {"code"},
+		"client_id" : {env.client.ID.String()},
+		"redirect_uri" : {env.redirect},
+		"scope" : {"chirps:read chirps:write"},
+		"state" : {"xyz"},
+		"code_challenge" : {challenge(testVerifier)},
+		"code_challenge_method" : {"S256"},
+	}
+}
+
+func noRedirects() *http.Client {
+	return &http.Client{
+		CheckRedirect : func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// authorize submits the consent form and returns the redirect location.
+func (env *testEnv) authorize(t *testing.T, params url.Values) *url.URL {
+	t.Helper()
+	resp, err := noRedirects().PostForm(env.server.URL + "/oauth/authorize", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func (env *testEnv) post(t *testing.T, path string, form url.Values) (int, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", env.server.URL + path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(env.client.ID.String(), env.secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]any{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func (env *testEnv) code(t *testing.T) string {
+	t.Helper()
+	params := env.authorizeParams()
+	params.Set("decision", "allow")
+	params.Set("email", "test@test.com")
+	params.Set("password", "password")
+	location := env.authorize(t, params)
+	if location.Query().Get("state") != "xyz" {
+		t.Errorf("state not passed back: %s", location)
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in redirect %s", location)
+	}
+	return code
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, err := http.Get(env.server.URL + "/oauth/authorize?" + env.authorizeParams().Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("expected consent page, got %d", resp.StatusCode)
+	}
+
+	code := env.code(t)
+	status, body := env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {code},
+		"redirect_uri" : {env.redirect},
+		"code_verifier" : {testVerifier},
+	})
+	if status != 200 {
+		t.Fatalf("token exchange failed: %d %v", status, body)
+	}
+	accessToken, _ := body["access_token"].(string)
+	refreshToken, _ := body["refresh_token"].(string)
+	if body["scope"] != "chirps:read chirps:write" || body["token_type"] != "Bearer" {
+		t.Errorf("unexpected token response %v", body)
+	}
+
+	claims, err := env.keys.ValidateScopedJWT(accessToken, AccessTokenAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != env.userID || claims.ClientID != env.client.ID.String() {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	_, err = env.keys.ValidateJWT(accessToken)
+	if err == nil {
+		t.Errorf("OAuth token accepted as a first-party access token")
+	}
+
+	status, body = env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {code},
+		"redirect_uri" : {env.redirect},
+		"code_verifier" : {testVerifier},
+	})
+	if status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("expected code reuse to fail, got %d %v", status, body)
+	}
+
+	status, body = env.post(t, "/oauth/introspect", url.Values{"token" : {accessToken}})
+	if status != 200 || body["active"] != true || body["sub"] != env.userID.String() {
+		t.Errorf("unexpected introspection %d %v", status, body)
+	}
+
+	status, body = env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"refresh_token"},
+		"refresh_token" : {refreshToken},
+		"scope" : {"chirps:read"},
+	})
+	if status != 200 || body["scope"] != "chirps:read" {
+		t.Fatalf("refresh failed: %d %v", status, body)
+	}
+	rotated, _ := body["refresh_token"].(string)
+
+	status, body = env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"refresh_token"},
+		"refresh_token" : {refreshToken},
+	})
+	if status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("expected rotated refresh token to be rejected, got %d %v", status, body)
+	}
+
+	status, _ = env.post(t, "/oauth/revoke", url.Values{"token" : {rotated}})
+	if status != 200 {
+		t.Errorf("revoke failed: %d", status)
+	}
+	status, body = env.post(t, "/oauth/introspect", url.Values{"token" : {rotated}})
+	if status != 200 || body["active"] != false {
+		t.Errorf("revoked token still active: %v", body)
+	}
+	status, body = env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"refresh_token"},
+		"refresh_token" : {rotated},
+	})
+	if status != 400 {
+		t.Errorf("expected revoked refresh token to be rejected, got %d %v", status, body)
+	}
+}
+
+func TestTokenRejectsWrongVerifierAndClient(t *testing.T) {
+	env := newTestEnv(t)
+
+	status, body := env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {env.code(t)},
+		"redirect_uri" : {env.redirect},
+		"code_verifier" : {strings.Repeat("a", 43)},
+	})
+	if status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("expected PKCE failure, got %d %v", status, body)
+	}
+
+	code := env.code(t)
+	env.secret = "wrong"
+	status, body = env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {code},
+		"redirect_uri" : {env.redirect},
+		"code_verifier" : {testVerifier},
+	})
+	if status != 401 || body["error"] != "invalid_client" {
+		t.Errorf("expected client authentication failure, got %d %v", status, body)
+	}
+
+	env.secret = "client-secret"
+	code = env.code(t)
+	owner := env.client
+	env.client = Client{
+		ID : uuid.New(),
+		Name : "Other App",
+		RedirectURIs : []string{env.redirect},
+		SecretHash : auth.HashToken(env.secret),
+	}
+	env.store.AddClient(env.client)
+	exchange := url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {code},
+		"redirect_uri" : {env.redirect},
+		"code_verifier" : {testVerifier},
+	}
+	status, body = env.post(t, "/oauth/token", exchange)
+	if status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("expected another client's code to be rejected, got %d %v", status, body)
+	}
+	env.client = owner
+	status, body = env.post(t, "/oauth/token", exchange)
+	if status != 200 {
+		t.Errorf("expected code to survive another client's attempt, got %d %v", status, body)
+	}
+}
+
+func TestTokenRedirectURIOnlyRequiredWhenGiven(t *testing.T) {
+	env := newTestEnv(t)
+
+	params := env.authorizeParams()
+	params.Del("redirect_uri")
+	params.Set("decision", "allow")
+	params.Set("email", "test@test.com")
+	params.Set("password", "password")
+	location := env.authorize(t, params)
+	if location.Host != "app.example.com" || location.Query().Get("code") == "" {
+		t.Fatalf("expected code at the registered redirect URI, got %s", location)
+	}
+	status, body := env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {location.Query().Get("code")},
+		"code_verifier" : {testVerifier},
+	})
+	if status != 200 {
+		t.Errorf("expected exchange without redirect_uri to succeed, got %d %v", status, body)
+	}
+
+	status, body = env.post(t, "/oauth/token", url.Values{
+		"grant_type" : {"authorization_code"},
+		"code" : {env.code(t)},
+		"code_verifier" : {testVerifier},
+	})
+	if status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("expected missing redirect_uri to be rejected when it was sent to authorize, got %d %v", status, body)
+	}
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	params := env.authorizeParams()
+	params.Set("redirect_uri", "https://evil.example.com/callback")
+	resp, err := noRedirects().Get(env.server.URL + "/oauth/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("expected unregistered redirect URI to be refused without redirecting, got %d", resp.StatusCode)
+	}
+
+	params = env.authorizeParams()
+	params.Del("code_challenge")
+	location := env.authorize(t, params)
+	if location.Query().Get("error") != "invalid_request" {
+		t.Errorf("expected PKCE to be required, got %s", location)
+	}
+
+	params = env.authorizeParams()
+	params.Set("scope", "profile:write")
+	location = env.authorize(t, params)
+	if location.Query().Get("error") != "invalid_scope" {
+		t.Errorf("expected profile:write to be refused, got %s", location)
+	}
+
+	params = env.authorizeParams()
+	params.Set("decision", "deny")
+	location = env.authorize(t, params)
+	if location.Query().Get("error") != "access_denied" || location.Query().Get("state") != "xyz" {
+		t.Errorf("expected access_denied, got %s", location)
+	}
+
+	params = env.authorizeParams()
+	params.Set("decision", "allow")
+	params.Set("email", "test@test.com")
+	params.Set("password", "wrong")
+	resp, err = noRedirects().PostForm(env.server.URL + "/oauth/authorize", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Errorf("expected wrong password to re-render the consent page, got %d", resp.StatusCode)
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri string
+		ok  bool
+	}{
+		{"https://app.example.com/cb", true},
+		{"http://127.0.0.1:8000/cb", true},
+		{"http://localhost/cb", true},
+		{"http://app.example.com/cb", false},
+		{"https://app.example.com/cb#frag", false},
+		{"/relative", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		err := ValidRedirectURI(tt.uri)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidRedirectURI(%q): expected ok=%v, got %v", tt.uri, tt.ok, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package oauth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// PostgresStore keeps OAuth state in the database. Refresh tokens share the
+// refresh_tokens table with first-party sessions and are told apart by
+// their client_id.
+type PostgresStore struct {
+	db *database.Queries
+}
+
+func NewPostgresStore(db *database.Queries) *PostgresStore {
+	return &PostgresStore{
+		db : db,
+	}
+}
+
+func toClient(client database.OauthClient) Client {
+	return Client{
+		ID : client.ID,
+		Name : client.Name,
+		RedirectURIs : client.RedirectUris,
+		SecretHash : client.SecretHash.String,
+	}
+}
+
+func toRefreshToken(token database.RefreshToken) RefreshToken {
+	return RefreshToken{
+		Token : token.Token,
+		ClientID : token.ClientID.UUID,
+		UserID : token.UserID,
+		Scopes : token.Scopes,
+		ExpiresAt : token.ExpiresAt,
+		Revoked : token.RevokedAt.Valid,
+	}
+}
+
+func (p *PostgresStore) GetClient(ctx context.Context, id uuid.UUID) (Client, error) {
+	client, err := p.db.GetOAuthClient(ctx, id)
+	if err == sql.ErrNoRows {
+		return Client{}, ErrNotFound
+	}
+	if err != nil {
+		return Client{}, err
+	}
+	return toClient(client), nil
+}
+
+func (p *PostgresStore) CreateCode(ctx context.Context, code AuthorizationCode) error {
+	return p.db.CreateOAuthAuthorizationCode(ctx, database.CreateOAuthAuthorizationCodeParams{
+		CodeHash : code.CodeHash,
+		ClientID : code.ClientID,
+		UserID : code.UserID,
+		RedirectUri : code.RedirectURI,
+		Scopes : code.Scopes,
+		CodeChallenge : code.CodeChallenge,
+		ExpiresAt : code.ExpiresAt,
+	})
+}
+
+func (p *PostgresStore) ConsumeCode(ctx context.Context, codeHash string, clientID uuid.UUID) (AuthorizationCode, error) {
+	code, err := p.db.ConsumeOAuthAuthorizationCode(ctx, database.ConsumeOAuthAuthorizationCodeParams{
+		CodeHash : codeHash,
+		ClientID : clientID,
+	})
+	if err == sql.ErrNoRows {
+		return AuthorizationCode{}, ErrNotFound
+	}
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	return AuthorizationCode{
+		CodeHash : code.CodeHash,
+		ClientID : code.ClientID,
+		UserID : code.UserID,
+		RedirectURI : code.RedirectUri,
+		Scopes : code.Scopes,
+		CodeChallenge : code.CodeChallenge,
+		ExpiresAt : code.ExpiresAt,
+	}, nil
+}
+
+func (p *PostgresStore) CreateRefreshToken(ctx context.Context, token RefreshToken) error {
+	return p.db.CreateOAuthRefreshToken(ctx, database.CreateOAuthRefreshTokenParams{
+		Token : token.Token,
+		UserID : token.UserID,
+		ExpiresAt : token.ExpiresAt,
+		ClientID : uuid.NullUUID{
+			UUID : token.ClientID,
+			Valid : true,
+		},
+		Scopes : token.Scopes,
+	})
+}
+
+func (p *PostgresStore) ConsumeRefreshToken(ctx context.Context, token string, clientID uuid.UUID) (RefreshToken, error) {
+	rt, err := p.db.ConsumeOAuthRefreshToken(ctx, database.ConsumeOAuthRefreshTokenParams{
+		Token : token,
+		ClientID : uuid.NullUUID{
+			UUID : clientID,
+			Valid : true,
+		},
+	})
+	if err == sql.ErrNoRows {
+		return RefreshToken{}, ErrNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return toRefreshToken(rt), nil
+}
+
+// GetRefreshToken only finds tokens issued to OAuth clients, never a
+// user's own session tokens.
+func (p *PostgresStore) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	rt, err := p.db.FindRefreshToken(ctx, token)
+	if err == sql.ErrNoRows || (err == nil && !rt.ClientID.Valid) {
+		return RefreshToken{}, ErrNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return toRefreshToken(rt), nil
+}
@@ -0,0 +1,87 @@
+package oauth
+
+import (
+	"context"
+	"sync"
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps everything in process memory. It is meant for tests
+// and single instance development setups.
+type MemoryStore struct {
+	mu      sync.Mutex
+	clients map[uuid.UUID]Client
+	codes   map[string]AuthorizationCode
+	tokens  map[string]RefreshToken
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		clients : map[uuid.UUID]Client{},
+		codes : map[string]AuthorizationCode{},
+		tokens : map[string]RefreshToken{},
+	}
+}
+
+func (m *MemoryStore) AddClient(client Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[client.ID] = client
+}
+
+func (m *MemoryStore) GetClient(ctx context.Context, id uuid.UUID) (Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client, ok := m.clients[id]
+	if !ok {
+		return Client{}, ErrNotFound
+	}
+	return client, nil
+}
+
+func (m *MemoryStore) CreateCode(ctx context.Context, code AuthorizationCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code.CodeHash] = code
+	return nil
+}
+
+func (m *MemoryStore) ConsumeCode(ctx context.Context, codeHash string, clientID uuid.UUID) (AuthorizationCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code, ok := m.codes[codeHash]
+	if !ok || code.ClientID != clientID {
+		return AuthorizationCode{}, ErrNotFound
+	}
+	delete(m.codes, codeHash)
+	return code, nil
+}
+
+func (m *MemoryStore) CreateRefreshToken(ctx context.Context, token RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[token.Token] = token
+	return nil
+}
+
+func (m *MemoryStore) ConsumeRefreshToken(ctx context.Context, token string, clientID uuid.UUID) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rt, ok := m.tokens[token]
+	if !ok || rt.ClientID != clientID || rt.Revoked {
+		return RefreshToken{}, ErrNotFound
+	}
+	rt.Revoked = true
+	m.tokens[token] = rt
+	return rt, nil
+}
+
+func (m *MemoryStore) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rt, ok := m.tokens[token]
+	if !ok {
+		return RefreshToken{}, ErrNotFound
+	}
+	return rt, nil
+}
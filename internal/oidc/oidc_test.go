@@ -0,0 +1,241 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID = "chirpy"
+	testSecret   = "secret"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// fakeProvider is a minimal OpenID Connect provider. Each code it accepts
+// maps to the claims of the ID token it hands out for it.
+type fakeProvider struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+	kid    string
+	codes  map[string]jwt.MapClaims
+	jwks   int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{
+		key : key,
+		kid : "key-1",
+		codes : map[string]jwt.MapClaims{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(Provider{
+			Issuer : p.server.URL,
+			AuthorizationEndpoint : p.server.URL + "/authorize",
+			TokenEndpoint : p.server.URL + "/token",
+			JWKSURI : p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, req *http.Request) {
+		p.jwks++
+		pad := func(b *big.Int) string {
+			buf := make([]byte, 32)
+			return base64.RawURLEncoding.EncodeToString(b.FillBytes(buf))
+		}
+		json.NewEncoder(w).Encode(jwks{Keys : []jwk{{
+			Kty : "EC",
+			Use : "sig",
+			Kid : p.kid,
+			Crv : "P-256",
+			X : pad(p.key.X),
+			Y : pad(p.key.Y),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, req *http.Request) {
+		id, secret, ok := req.BasicAuth()
+		if !ok || id != testClientID || secret != testSecret {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(map[string]string{"error" : "invalid_client"})
+			return
+		}
+		req.ParseForm()
+		claims, ok := p.codes[req.PostForm.Get("code")]
+		if !ok || S256Challenge(req.PostForm.Get("code_verifier")) != claims["_challenge"] {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error" : "invalid_grant"})
+			return
+		}
+		delete(p.codes, req.PostForm.Get("code"))
+		delete(claims, "_challenge")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token" : "unused",
+			"token_type" : "Bearer",
+			"id_token" : p.sign(t, claims),
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = p.kid
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (p *fakeProvider) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss" : p.server.URL,
+		"sub" : "user-123",
+		"aud" : testClientID,
+		"exp" : time.Now().Add(time.Minute).Unix(),
+		"iat" : time.Now().Unix(),
+		"nonce" : nonce,
+		"email" : "test@test.com",
+		"email_verified" : true,
+	}
+}
+
+func (p *fakeProvider) client() *Client {
+	return NewClient(Config{
+		Issuer : p.server.URL,
+		ClientID : testClientID,
+		ClientSecret : testSecret,
+		RedirectURL : "http://localhost:8080/api/oidc/callback",
+	}, p.server.Client())
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newFakeProvider(t)
+	raw, err := p.client().AuthCodeURL(context.Background(), "state", "nonce", S256Challenge(testVerifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(raw)
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("client_id") != testClientID || q.Get("state") != "state" || q.Get("nonce") != "nonce" || q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid email" {
+		t.Errorf("unexpected authorization URL %s", raw)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	ctx := context.Background()
+	p := newFakeProvider(t)
+	c := p.client()
+
+	claims := p.claims("nonce-1")
+	claims["_challenge"] = S256Challenge(testVerifier)
+	p.codes["code-1"] = claims
+	got, err := c.Exchange(ctx, "code-1", testVerifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != "user-123" || got.Email != "test@test.com" || !got.EmailVerified || got.Issuer != p.server.URL {
+		t.Errorf("unexpected claims %+v", got)
+	}
+
+	_, err = c.Exchange(ctx, "code-1", testVerifier, "nonce-1")
+	if !errors.Is(err, ErrExchange) {
+		t.Errorf("expected reused code to fail, got %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejections(t *testing.T) {
+	ctx := context.Background()
+	p := newFakeProvider(t)
+	c := p.client()
+
+	tests := []struct {
+		name   string
+		modify func(jwt.MapClaims)
+		nonce  string
+	}{
+		{"wrong nonce", func(jwt.MapClaims) {}, "other"},
+		{"wrong audience", func(cl jwt.MapClaims) { cl["aud"] = "someone-else" }, "n"},
+		{"wrong issuer", func(cl jwt.MapClaims) { cl["iss"] = "https://evil.example.com" }, "n"},
+		{"expired", func(cl jwt.MapClaims) { cl["exp"] = time.Now().Add(-time.Hour).Unix() }, "n"},
+		{"azp mismatch", func(cl jwt.MapClaims) {
+			cl["aud"] = []string{testClientID, "other"}
+			cl["azp"] = "other"
+		}, "n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := p.claims("n")
+			tt.modify(claims)
+			_, err := c.VerifyIDToken(ctx, p.sign(t, claims), tt.nonce)
+			if !errors.Is(err, ErrIDToken) {
+				t.Errorf("expected ErrIDToken, got %v", err)
+			}
+		})
+	}
+
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, p.claims("n")).SignedString([]byte(testSecret))
+	_, err := c.VerifyIDToken(ctx, hmacToken, "n")
+	if !errors.Is(err, ErrIDToken) {
+		t.Errorf("expected HS256 token to be rejected, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	p := newFakeProvider(t)
+	c := p.client()
+	now := time.Now()
+	c.Now = func() time.Time { return now }
+
+	_, err := c.VerifyIDToken(ctx, p.sign(t, p.claims("n")), "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p.key = key
+	p.kid = "key-2"
+	_, err = c.VerifyIDToken(ctx, p.sign(t, p.claims("n")), "n")
+	if err == nil {
+		t.Fatalf("expected rotated key to be unknown within the refresh interval")
+	}
+
+	now = now.Add(keyRefreshInterval)
+	_, err = c.VerifyIDToken(ctx, p.sign(t, p.claims("n")), "n")
+	if err != nil {
+		t.Fatalf("expected rotated key to be fetched: %v", err)
+	}
+	if p.jwks != 2 {
+		t.Errorf("expected 2 JWKS fetches, got %d", p.jwks)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	p := newFakeProvider(t)
+	c := NewClient(Config{
+		Issuer : p.server.URL + "/",
+		ClientID : testClientID,
+	}, p.server.Client())
+	_, err := c.Discover(context.Background())
+	if !errors.Is(err, ErrDiscovery) {
+		t.Errorf("expected issuer mismatch, got %v", err)
+	}
+}
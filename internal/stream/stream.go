@@ -0,0 +1,140 @@
+// Package stream fans events out to long-lived client connections and
+// writes them in the Server-Sent Events format.
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"github.com/google/uuid"
+)
+
+// Event is one message on the stream. ID increases with every event, so
+// a client that reconnects can ask for the ones after the last it saw.
+// Ephemeral signals, such as typing, are not stored and have no ID.
+type Event struct {
+	ID       int64
+	Type     string
+	// UserID is who the event is about: the author of a chirp, or the
+	// recipient of a notification.
+	UserID   uuid.UUID
+	// ChirpID is the chirp the event is about, if any.
+	ChirpID  uuid.UUID
+	Hashtags []string
+	Data     json.RawMessage
+}
+
+// Hub hands every published event to the subscriptions whose filter
+// accepts it. Publish never blocks: a subscription that has fallen
+// Buffer events behind is closed, and its client is expected to
+// reconnect and resume from the last event it received.
+type Hub struct {
+	Buffer int
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	// C receives the subscription's events. It is closed when the
+	// subscription is closed, including when it fell too far behind.
+	C <-chan Event
+
+	c      chan Event
+	filter func(Event) bool
+	hub    *Hub
+}
+
+func NewHub(buffer int) *Hub {
+	return &Hub{
+		Buffer : buffer,
+		subs : map[*Subscription]struct{}{},
+	}
+}
+
+func (h *Hub) Subscribe(filter func(Event) bool) *Subscription {
+	c := make(chan Event, h.Buffer)
+	sub := &Subscription{
+		C : c,
+		c : c,
+		filter : filter,
+		hub : h,
+	}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			delete(h.subs, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Len returns the number of open subscriptions.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Close stops the subscription. It is safe to call after the hub has
+// already closed it.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+var hashtagPattern = regexp.MustCompile(`#(\w+)`)
+
+// Hashtags returns the distinct hashtags in a chirp, lower-cased and
+// without the #.
+func Hashtags(body string) []string {
+	tags := []string{}
+	for _, match := range hashtagPattern.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(match[1])
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// WriteEvent writes e as an SSE message. Data that spans lines is split
+// into one data field per line, which the client joins back together.
+func WriteEvent(w io.Writer, e Event) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %d\nevent: %s\n", e.ID, e.Type)
+	for _, line := range strings.Split(string(e.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteComment writes a line clients ignore, used as a heartbeat so
+// proxies and clients can tell an idle stream from a dead one.
+func WriteComment(w io.Writer, comment string) error {
+	_, err := fmt.Fprintf(w, ": %s\n\n", comment)
+	return err
+}
@@ -0,0 +1,75 @@
+package stream
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"github.com/google/uuid"
+)
+
+func TestHubFiltersEvents(t *testing.T) {
+	hub := NewHub(4)
+	author := uuid.New()
+	mine := hub.Subscribe(func(e Event) bool { return e.UserID == author })
+	all := hub.Subscribe(func(e Event) bool { return true })
+	defer mine.Close()
+	defer all.Close()
+
+	hub.Publish(Event{ID : 1, UserID : uuid.New()})
+	hub.Publish(Event{ID : 2, UserID : author})
+
+	if e := <-mine.C; e.ID != 2 {
+		t.Errorf("expected event 2, got %d", e.ID)
+	}
+	if len(mine.C) != 0 {
+		t.Errorf("expected no more events, got %d", len(mine.C))
+	}
+	if len(all.C) != 2 {
+		t.Errorf("expected 2 events, got %d", len(all.C))
+	}
+}
+
+func TestHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewHub(2)
+	slow := hub.Subscribe(func(e Event) bool { return true })
+
+	for i := int64(1); i <= 3; i++ {
+		hub.Publish(Event{ID : i})
+	}
+	if hub.Len() != 0 {
+		t.Fatalf("expected slow subscriber to be dropped, %d left", hub.Len())
+	}
+
+	ids := []int64{}
+	for e := range slow.C {
+		ids = append(ids, e.ID)
+	}
+	if !slices.Equal(ids, []int64{1, 2}) {
+		t.Errorf("expected buffered events 1 and 2, got %v", ids)
+	}
+	// Closing after the hub dropped it must not panic.
+	slow.Close()
+}
+
+func TestHashtags(t *testing.T) {
+	got := Hashtags("Go #GoLang and #golang, #chirpy_dev! #")
+	if !slices.Equal(got, []string{"golang", "chirpy_dev"}) {
+		t.Errorf("unexpected hashtags %v", got)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var b strings.Builder
+	err := WriteEvent(&b, Event{
+		ID : 7,
+		Type : "chirp.created",
+		Data : []byte("{\"a\":1}\n{\"b\":2}"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "id: 7\nevent: chirp.created\ndata: {\"a\":1}\ndata: {\"b\":2}\n\n"
+	if b.String() != want {
+		t.Errorf("expected %q, got %q", want, b.String())
+	}
+}
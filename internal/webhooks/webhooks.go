@@ -0,0 +1,155 @@
+// Package webhooks delivers signed event notifications to endpoints that
+// developers register, and decides when failed deliveries are retried.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/auth"
+)
+
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpDeleted = "chirp.deleted"
+)
+
+// Events lists every event an endpoint can subscribe to.
+var Events = []string{
+	EventChirpCreated,
+	EventChirpDeleted,
+}
+
+const (
+	// MaxAttempts failed attempts move a delivery to the dead-letter state.
+	MaxAttempts      = 8
+	baseBackoff      = 30 * time.Second
+	maxBackoff       = 6 * time.Hour
+	maxResponseBytes = 64 << 10
+)
+
+var (
+	ErrPrivateAddress = errors.New("webhook URL points at a private address")
+	ErrInvalidURL     = errors.New("webhook URL must be an absolute https URL")
+)
+
+// Backoff is how long to wait before retrying after the attempt-th failed
+// attempt. It doubles every time, from 30 seconds up to 6 hours.
+func Backoff(attempt int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// ValidateURL checks an endpoint URL before it is stored. Plain http is
+// only accepted when private addresses are, which is meant for
+// development.
+func ValidateURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil {
+		return ErrInvalidURL
+	}
+	if u.Scheme != "https" && !(allowPrivate && u.Scheme == "http") {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+type Delivery struct {
+	ID      string
+	EventID string
+	Event   string
+	URL     string
+	Secret  []byte
+	Payload []byte
+}
+
+type Sender struct {
+	Client *http.Client
+	Now    func() time.Time
+}
+
+// NewSender returns a Sender whose requests give up after timeout. Unless
+// allowPrivate is set, connections to loopback, private and link-local
+// addresses are refused when they are dialled, so an endpoint cannot be
+// used to reach internal services even through DNS tricks.
+func NewSender(timeout time.Duration, allowPrivate bool) *Sender {
+	dialer := &net.Dialer{
+		Timeout : timeout,
+	}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivate(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &Sender{
+		Client : &http.Client{
+			Timeout : timeout,
+			Transport : &http.Transport{
+				DialContext : dialer.DialContext,
+				TLSHandshakeTimeout : timeout,
+				MaxIdleConnsPerHost : 2,
+			},
+			// A redirect would be a way around the URL that was
+			// validated, so it counts as a failed delivery.
+			CheckRedirect : func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Now : time.Now,
+	}
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// Send posts one delivery. It returns the response status, or 0 if there
+// was no response, and an error unless the endpoint answered with 2xx.
+func (s *Sender) Send(ctx context.Context, d Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	now := s.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1.0")
+	req.Header.Set("X-Chirpy-Event", d.Event)
+	req.Header.Set("X-Chirpy-Event-ID", d.EventID)
+	req.Header.Set("X-Chirpy-Delivery", d.ID)
+	req.Header.Set("X-Chirpy-Timestamp", fmt.Sprint(now.Unix()))
+	req.Header.Set("X-Chirpy-Signature", auth.SignWebhook(d.Secret, now, d.Payload))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
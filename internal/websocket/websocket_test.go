@@ -0,0 +1,221 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient speaks just enough of the client side to drive a Conn.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dial(t *testing.T, server *httptest.Server) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	err = req.Write(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %q", got)
+	}
+	return &testClient{t : t, conn : conn, br : br}
+}
+
+func (c *testClient) send(b0 byte, payload []byte, masked bool) {
+	c.t.Helper()
+	frame := []byte{b0}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	if len(payload) <= 125 {
+		frame = append(frame, maskBit | byte(len(payload)))
+	} else {
+		frame = append(frame, maskBit | 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	data := append([]byte{}, payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i % 4]
+		}
+	}
+	_, err := c.conn.Write(append(frame, data...))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() (int, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(c.br, header[:])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if header[1] & 0x80 != 0 {
+		c.t.Fatal("server frame is masked")
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.br, payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return int(header[0] & 0x0f), payload
+}
+
+func (c *testClient) expectClose(code int) {
+	c.t.Helper()
+	opcode, payload := c.read()
+	if opcode != CloseMessage || len(payload) < 2 {
+		c.t.Fatalf("expected close frame, got opcode %d %q", opcode, payload)
+	}
+	if got := int(binary.BigEndian.Uint16(payload)); got != code {
+		c.t.Fatalf("expected close code %d, got %d", code, got)
+	}
+}
+
+// echoServer echoes messages back until ReadMessage fails, and reports
+// that error.
+func echoServer(t *testing.T) (*httptest.Server, chan error) {
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.MaxMessageSize = 200
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			conn.WriteMessage(messageType, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, errs
+}
+
+func TestEcho(t *testing.T) {
+	server, errs := echoServer(t)
+	client := dial(t, server)
+
+	client.send(0x80 | TextMessage, []byte(`{"type":"hello"}`), true)
+	if opcode, payload := client.read(); opcode != TextMessage || string(payload) != `{"type":"hello"}` {
+		t.Fatalf("unexpected echo %d %q", opcode, payload)
+	}
+
+	// A fragmented message with a ping in the middle.
+	client.send(TextMessage, []byte("Hel"), true)
+	client.send(0x80 | PingMessage, []byte("p"), true)
+	client.send(0x80 | continuationFrame, []byte("lo"), true)
+	if opcode, payload := client.read(); opcode != PongMessage || string(payload) != "p" {
+		t.Fatalf("expected pong, got %d %q", opcode, payload)
+	}
+	if opcode, payload := client.read(); opcode != TextMessage || string(payload) != "Hello" {
+		t.Fatalf("unexpected echo %d %q", opcode, payload)
+	}
+
+	client.send(0x80 | CloseMessage, binary.BigEndian.AppendUint16(nil, CloseNormal), true)
+	client.expectClose(CloseNormal)
+	var closeErr *CloseError
+	if err := <-errs; !errors.As(err, &closeErr) || closeErr.Code != CloseNormal {
+		t.Fatalf("expected normal close, got %v", err)
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	tests := []struct {
+		name   string
+		b0     byte
+		data   []byte
+		masked bool
+		code   int
+	}{
+		{"unmasked", 0x80 | TextMessage, []byte("hi"), false, CloseProtocolError},
+		{"too big", 0x80 | TextMessage, make([]byte, 201), true, CloseMessageTooBig},
+		{"invalid utf-8", 0x80 | TextMessage, []byte{0xff, 0xfe}, true, CloseInvalidPayload},
+		{"reserved bits", 0xc0 | TextMessage, []byte("hi"), true, CloseProtocolError},
+		{"stray continuation", 0x80 | continuationFrame, []byte("hi"), true, CloseProtocolError},
+		{"fragmented ping", PingMessage, []byte("hi"), true, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, errs := echoServer(t)
+			client := dial(t, server)
+			client.send(tt.b0, tt.data, tt.masked)
+			client.expectClose(tt.code)
+			var closeErr *CloseError
+			if err := <-errs; !errors.As(err, &closeErr) || closeErr.Code != tt.code {
+				t.Fatalf("expected close %d, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	server, _ := echoServer(t)
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 426 || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("expected 426 with version 13, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/lockout"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+)
+
+const (
+	tokenPurposeUnlockAccount = "unlock_account"
+	unlockAccountTokenTTL     = time.Hour
+)
+
+// ipLoginPolicy is looser than the per-email policy since many users can
+// share one address behind a NAT.
+func ipLoginPolicy() lockout.Policy {
+	policy := lockout.DefaultPolicy()
+	policy.FreeAttempts = 20
+	policy.MaxDelay = 10 * time.Second
+	policy.LockAfter = 100
+	return policy
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func loginEmailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginIPKey(req *http.Request) string {
+	return "ip:" + clientIP(req)
+}
+
+// loginRetryAfter is how long the client has to wait before another login
+// attempt for this email from this IP will be considered.
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, req *http.Request, email string) (time.Duration, error) {
+	emailWait, _, err := cfg.loginEmailLimiter.Check(ctx, loginEmailKey(email))
+	if err != nil {
+		return 0, err
+	}
+	ipWait, _, err := cfg.loginIPLimiter.Check(ctx, loginIPKey(req))
+	if err != nil {
+		return 0, err
+	}
+	return max(emailWait, ipWait), nil
+}
+
+// recordLoginFailure counts a failed attempt to prove who the user is,
+// whether at login or when re-authenticating for a sensitive action.
+func (cfg *apiConfig) recordLoginFailure(ctx context.Context, req *http.Request, email string) {
+	user, err := cfg.db.GetUserByEmail(ctx, email)
+	known := err == nil
+	cfg.recordAudit(ctx, req, auditEntry{
+		UserID : user.ID,
+		ActorType : actorAnonymous,
+		Event : "user.login_failed",
+		Metadata : map[string]string{
+			"email" : email,
+		},
+	})
+
+	_, err = cfg.loginIPLimiter.Fail(ctx, loginIPKey(req))
+	if err != nil {
+		log.Printf("Error recording login failure: %s", err)
+	}
+	locked, err := cfg.loginEmailLimiter.Fail(ctx, loginEmailKey(email))
+	if err != nil {
+		log.Printf("Error recording login failure: %s", err)
+		return
+	}
+	if !locked || !known {
+		return
+	}
+
+	cfg.recordAudit(ctx, req, auditEntry{
+		UserID : user.ID,
+		ActorType : actorSystem,
+		Event : "user.locked",
+	})
+	if !user.EmailVerifiedAt.Valid {
+		return
+	}
+	err = cfg.sendUnlockEmail(ctx, user)
+	if err != nil {
+		log.Printf("Error sending unlock email: %s", err)
+	}
+}
+
+func (cfg *apiConfig) recordLoginSuccess(ctx context.Context, email string) {
+	err := cfg.loginEmailLimiter.Reset(ctx, loginEmailKey(email))
+	if err != nil {
+		log.Printf("Error resetting login attempts: %s", err)
+	}
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+}
+
+func (cfg *apiConfig) sendUnlockEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.issueUserToken(ctx, user.ID, tokenPurposeUnlockAccount, unlockAccountTokenTTL)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/api/users/unlock?token=%s", cfg.baseURL, url.QueryEscape(token))
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : user.Email,
+		Subject : "Your Chirpy account has been locked",
+		Body : fmt.Sprintf("We locked your Chirpy account after too many failed login attempts.\n\nIf these attempts were yours, you can unlock it right away by opening this link within one hour:\n\n%s\n\nOtherwise the lock expires on its own. If you don't recognise this activity, consider resetting your password.\n", link),
+	})
+}
+
+func (cfg *apiConfig) handleUnlockAccount(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("Missing unlock token"))
+		return
+	}
+
+	userToken, err := cfg.consumeUserToken(req.Context(), token, tokenPurposeUnlockAccount)
+	if err != nil {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("This unlock link is invalid or has expired"))
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userToken.UserID)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	err = cfg.loginEmailLimiter.Reset(req.Context(), loginEmailKey(user.Email))
+	if err != nil {
+		log.Printf("Error unlocking account: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, user.ID, "user.unlocked")
+
+	w.WriteHeader(200)
+	_, _ = w.Write([]byte("Your account has been unlocked"))
+}
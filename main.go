@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"fmt"
 	"log"
@@ -8,11 +9,20 @@ import (
 	"strings"
 	"time"
 	"sort"
+	"strconv"
 	"net/http"
 	"sync/atomic"
 	"encoding/json"
+	"errors"
 	"github.com/andrei-himself/chirpy/internal/database"
 	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+	"github.com/andrei-himself/chirpy/internal/lockout"
+	"github.com/andrei-himself/chirpy/internal/entitlements"
+	"github.com/andrei-himself/chirpy/internal/webhooks"
+	"github.com/andrei-himself/chirpy/internal/stream"
+	"github.com/andrei-himself/chirpy/internal/oauth"
+	"github.com/andrei-himself/chirpy/internal/oidc"
 	"github.com/joho/godotenv"   
 	"github.com/google/uuid"
 )
@@ -22,8 +32,28 @@ type apiConfig struct {
 	fileserverHits atomic.Int32
 	db *database.Queries
 	platform string
-	secret string
+	keys *auth.KeySet
 	polkaKey string
+	polkaSecrets [][]byte
+	polkaTolerance time.Duration
+	mailer mailer.Mailer
+	baseURL string
+	loginEmailLimiter *lockout.Limiter
+	loginIPLimiter *lockout.Limiter
+	rateTracker lockout.Tracker
+	entitlements *entitlements.Config
+	passwordPolicy *auth.PasswordPolicy
+	hashParams auth.PasswordHashParams
+	oauth *oauth.Server
+	oidc *oidc.Client
+	deletionGracePeriod time.Duration
+	exportKey []byte
+	exportWake chan struct{}
+	webhookSender *webhooks.Sender
+	webhookWake chan struct{}
+	sqlDB *sql.DB
+	outboxWake chan struct{}
+	streamHub *stream.Hub
 }
 
 type User struct {
@@ -34,6 +64,8 @@ type User struct {
 	Token 		   string `json:"token"`
 	RefreshToken   string `json:"refresh_token"`
 	IsChirpyRed    bool `json:"is_chirpy_red"`
+	EmailVerified  bool `json:"email_verified"`
+	PendingEmail   string `json:"pending_email,omitempty"`
 }
 
 type Chirp struct {
@@ -66,7 +98,12 @@ func (cfg *apiConfig) handleMetrics(w http.ResponseWriter, req *http.Request) {
 func (cfg *apiConfig) handleReset(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if cfg.platform != "dev" {
+		cfg.recordAudit(req.Context(), req, auditEntry{
+			ActorType : actorAnonymous,
+			Event : "admin.reset_denied",
+		})
 		w.WriteHeader(403)
+		return
 	}
 	_ = cfg.fileserverHits.Swap(0)
 	err := cfg.db.DeleteUsers(req.Context())
@@ -81,6 +118,10 @@ func (cfg *apiConfig) handleReset(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
+	cfg.recordAudit(req.Context(), req, auditEntry{
+		ActorType : actorAdmin,
+		Event : "admin.reset",
+	})
 }
 
 func (cfg *apiConfig) handleChirps(w http.ResponseWriter, req *http.Request) {
@@ -111,10 +152,11 @@ func (cfg *apiConfig) handleChirps(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token, err := auth.GetBearerToken(req.Header)
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsWrite)
 	if err != nil {
+		status, message := authFailure(w, err)
 		respBody := errResp{
-			Error : "Something went wrong",
+			Error : message,
 		}
 		dat, err2 := json.Marshal(respBody)
 		if err2 != nil {
@@ -122,12 +164,12 @@ func (cfg *apiConfig) handleChirps(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(401)
+		w.WriteHeader(status)
 		w.Write(dat)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.secret)
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
 	if err != nil {
 		respBody := errResp{
 			Error : "Something went wrong",
@@ -143,7 +185,22 @@ func (cfg *apiConfig) handleChirps(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if len(params.Body) > 140 {
+	if !user.EmailVerifiedAt.Valid {
+		respBody := errResp{
+			Error : "Email address not verified",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(403)
+		w.Write(dat)
+		return
+	}
+
+	if limit := cfg.userLimit(user, entitlements.ChirpLength); limit > 0 && len(params.Body) > limit {
 		respBody := errResp{
 			Error : "Chirp is too long",
 		}
@@ -158,12 +215,52 @@ func (cfg *apiConfig) handleChirps(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	retryAfter, err := cfg.chirpRetryAfter(req.Context(), user)
+	if err != nil {
+		log.Printf("Error checking chirp rate: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
+		respBody := errResp{
+			Error : "Too many chirps, try again later",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(429)
+		w.Write(dat)
+		return
+	}
+
 	replaced := censorString(params.Body)
 	createChirpParams := database.CreateChirpParams{
 		Body : replaced,
 		UserID : userID,
 	}
-	chirp, err := cfg.db.CreateChirp(req.Context(), createChirpParams)
+	var chirp database.Chirp
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		chirp, err = q.CreateChirp(req.Context(), createChirpParams)
+		if err != nil {
+			return err
+		}
+		err = notifyMentions(req.Context(), q, chirp)
+		if err != nil {
+			return err
+		}
+		return writeOutboxEvent(req.Context(), q, userID, webhooks.EventChirpCreated, Chirp{
+			ID : chirp.ID,
+			CreatedAt : chirp.CreatedAt,
+			UpdatedAt : chirp.UpdatedAt,
+			Body : chirp.Body,
+			UserID : chirp.UserID,
+		})
+	})
 	if err != nil {
 		respBody := errResp{
 			Error : "Something went wrong",
@@ -204,6 +301,7 @@ func (cfg *apiConfig) handleUsers(w http.ResponseWriter, req *http.Request) {
 	}
 	type errResp struct {
 		Error string `json:"error"`
+		Violations []string `json:"violations,omitempty"`
 	}
 	w.Header().Set("Content-Type", "application/json")
 	decoder := json.NewDecoder(req.Body)
@@ -224,7 +322,30 @@ func (cfg *apiConfig) handleUsers(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	hashed, err := auth.HashPassword(params.Password)
+	err = cfg.passwordPolicy.Check(params.Password)
+	if err != nil {
+		var policyErr *auth.PasswordPolicyError
+		if !errors.As(err, &policyErr) {
+			log.Printf("Error checking password policy: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		respBody := errResp{
+			Error : "Password does not meet requirements",
+			Violations : policyErr.Violations,
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	hashed, err := auth.HashPasswordWithParams(params.Password, cfg.hashParams)
 	if err != nil {
 		respBody := errResp{
 			Error : "Something went wrong",
@@ -262,12 +383,18 @@ func (cfg *apiConfig) handleUsers(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	err = cfg.sendVerificationEmail(req.Context(), user)
+	if err != nil {
+		log.Printf("Error sending verification email: %s", err)
+	}
+
 	mapped := User{
 		ID : user.ID,
 		CreatedAt : user.CreatedAt,
 		UpdatedAt : user.UpdatedAt,
 		Email : user.Email,
 		IsChirpyRed : user.IsChirpyRed,
+		EmailVerified : user.EmailVerifiedAt.Valid,
 	}
 	dat, err := json.Marshal(mapped)
 	if err != nil {
@@ -408,10 +535,16 @@ func (cfg *apiConfig) handleLogin(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(req.Context(), params.Email)
+	retryAfter, err := cfg.loginRetryAfter(req.Context(), req, params.Email)
 	if err != nil {
+		log.Printf("Error checking login attempts: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
 		respBody := errResp{
-			Error : "Something went wrong",
+			Error : "Too many failed login attempts, try again later",
 		}
 		dat, err2 := json.Marshal(respBody)
 		if err2 != nil {
@@ -419,13 +552,14 @@ func (cfg *apiConfig) handleLogin(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(401)
+		w.WriteHeader(429)
 		w.Write(dat)
 		return
 	}
 
-	pwMatch, err := auth.CheckPasswordHash(params.Password, user.HashedPassword.String)
-	if err != nil || pwMatch == false {
+	user, err := cfg.db.GetUserByEmail(req.Context(), params.Email)
+	if err != nil {
+		cfg.recordLoginFailure(req.Context(), req, params.Email)
 		respBody := errResp{
 			Error : "Something went wrong",
 		}
@@ -440,8 +574,9 @@ func (cfg *apiConfig) handleLogin(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token, err := auth.MakeJWT(user.ID, cfg.secret, 3600 * time.Second)
-	if err != nil || token == "" {
+	pwMatch, err := auth.CheckPasswordHash(params.Password, user.HashedPassword.String)
+	if err != nil || pwMatch == false {
+		cfg.recordLoginFailure(req.Context(), req, params.Email)
 		respBody := errResp{
 			Error : "Something went wrong",
 		}
@@ -455,9 +590,22 @@ func (cfg *apiConfig) handleLogin(w http.ResponseWriter, req *http.Request) {
 		w.Write(dat)
 		return
 	}
+	cfg.upgradePasswordHash(req.Context(), user, params.Password)
 
-	refreshTokenString, err := auth.MakeRefreshToken()
-	if err != nil || token == "" {
+	_, hasTOTP, err := cfg.userHasTOTP(req.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error loading TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if hasTOTP {
+		cfg.respondWithMFAChallenge(w, user.ID)
+		return
+	}
+
+	cfg.recordLoginSuccess(req.Context(), user.Email)
+	mapped, err := cfg.issueSession(req.Context(), user)
+	if err != nil {
 		respBody := errResp{
 			Error : "Something went wrong",
 		}
@@ -471,28 +619,74 @@ func (cfg *apiConfig) handleLogin(w http.ResponseWriter, req *http.Request) {
 		w.Write(dat)
 		return
 	}
+	cfg.recordLogin(req.Context(), req, user.ID, "password")
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
+
+// upgradePasswordHash re-hashes a correct password whose stored hash was
+// made with older argon2id parameters. Failures only mean the upgrade is
+// retried on the next login, so they are logged rather than returned.
+func (cfg *apiConfig) upgradePasswordHash(ctx context.Context, user database.User, password string) {
+	outdated, err := auth.PasswordHashNeedsUpgrade(user.HashedPassword.String, cfg.hashParams)
+	if err != nil || !outdated {
+		return
+	}
+	hashed, err := auth.HashPasswordWithParams(password, cfg.hashParams)
+	if err != nil {
+		log.Printf("Error upgrading password hash: %s", err)
+		return
+	}
+	// Only replace the hash we checked, so a password changed in the
+	// meantime is not overwritten with the old one.
+	err = cfg.db.RehashUserPassword(ctx, database.RehashUserPasswordParams{
+		ID : user.ID,
+		HashedPassword : sql.NullString{
+			String : hashed,
+			Valid : true,
+		},
+		HashedPassword_2 : user.HashedPassword,
+	})
+	if err != nil {
+		log.Printf("Error upgrading password hash: %s", err)
+	}
+}
+
+// issueSession mints the access and refresh token pair handed out after a
+// successful login. Logging in also cancels a scheduled account deletion.
+func (cfg *apiConfig) issueSession(ctx context.Context, user database.User) (User, error) {
+	err := cfg.cancelScheduledDeletion(ctx, user)
+	if err != nil {
+		return User{}, err
+	}
 
-	params2 := database.CreateRefreshTokenParams{
+	token, err := cfg.keys.MakeJWT(user.ID, 3600 * time.Second)
+	if err != nil {
+		return User{}, err
+	}
+
+	refreshTokenString, err := auth.MakeRefreshToken()
+	if err != nil {
+		return User{}, err
+	}
+
+	params := database.CreateRefreshTokenParams{
 		Token : refreshTokenString,
 		UserID : user.ID,
 	}
-	refreshToken, err := cfg.db.CreateRefreshToken(req.Context(), params2)
-	if err != nil || refreshToken.Token == "" {
-		respBody := errResp{
-			Error : "Something went wrong",
-		}
-		dat, err2 := json.Marshal(respBody)
-		if err2 != nil {
-			log.Printf("Error marshalling JSON: %s", err2)
-			w.WriteHeader(500)
-			return
-		}
-		w.WriteHeader(401)
-		w.Write(dat)
-		return
+	refreshToken, err := cfg.db.CreateRefreshToken(ctx, params)
+	if err != nil {
+		return User{}, err
 	}
 
-	mapped := User{
+	return User{
 		ID : user.ID,
 		CreatedAt : user.CreatedAt,
 		UpdatedAt : user.UpdatedAt,
@@ -500,16 +694,8 @@ func (cfg *apiConfig) handleLogin(w http.ResponseWriter, req *http.Request) {
 		Token : token,
 		RefreshToken : refreshToken.Token,
 		IsChirpyRed : user.IsChirpyRed,
-	}
-	dat, err := json.Marshal(mapped)
-	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
-		w.WriteHeader(500)
-		return
-	}
-	w.WriteHeader(200)
-	w.Write(dat)
-	return
+		EmailVerified : user.EmailVerifiedAt.Valid,
+	}, nil
 }
 
 func (cfg *apiConfig) handleRefresh(w http.ResponseWriter, req *http.Request) {
@@ -538,7 +724,9 @@ func (cfg *apiConfig) handleRefresh(w http.ResponseWriter, req *http.Request) {
 	}
 
 	refTokenEntry, err := cfg.db.FindRefreshToken(req.Context(), refreshToken)
-	if err != nil || refTokenEntry.ExpiresAt.Compare(time.Now()) == -1 || refTokenEntry.RevokedAt.Valid == true {
+	// Refresh tokens issued to OAuth clients are only usable at /oauth/token,
+	// or a third-party app could trade one for an unscoped access token.
+	if err != nil || refTokenEntry.ExpiresAt.Compare(time.Now()) == -1 || refTokenEntry.RevokedAt.Valid == true || refTokenEntry.ClientID.Valid {
 		respBody := errResp{
 			Error : "Something went wrong",
 		}
@@ -553,7 +741,7 @@ func (cfg *apiConfig) handleRefresh(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token, err := auth.MakeJWT(refTokenEntry.UserID, cfg.secret, 3600 * time.Second)
+	token, err := cfg.keys.MakeJWT(refTokenEntry.UserID, 3600 * time.Second)
 	if err != nil || token == "" {
 		respBody := errResp{
 			Error : "Something went wrong",
@@ -569,6 +757,8 @@ func (cfg *apiConfig) handleRefresh(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	cfg.recordAuditEvent(req.Context(), req, refTokenEntry.UserID, "token.refreshed")
+
 	resp := okResp{
 		Token : token,
 	}
@@ -605,6 +795,7 @@ func (cfg *apiConfig) handleRevoke(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	refTokenEntry, findErr := cfg.db.FindRefreshToken(req.Context(), refreshToken)
 	err = cfg.db.RevokeRefreshToken(req.Context(), refreshToken)
 	if err != nil {
 		respBody := errResp{
@@ -620,6 +811,9 @@ func (cfg *apiConfig) handleRevoke(w http.ResponseWriter, req *http.Request) {
 		w.Write(dat)
 		return
 	}
+	if findErr == nil && !refTokenEntry.RevokedAt.Valid {
+		cfg.recordAuditEvent(req.Context(), req, refTokenEntry.UserID, "token.revoked")
+	}
 
 	w.WriteHeader(204)
 	return
@@ -629,16 +823,21 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
 	}
 	type errResp struct {
 		Error string `json:"error"`
+		Violations []string `json:"violations,omitempty"`
 	}
 	w.Header().Set("Content-Type", "application/json")
 
-	accessToken, err := auth.GetBearerToken(req.Header)
-	if err != nil || accessToken == "" {
+	userID, err := cfg.authenticate(req, auth.ScopeProfileWrite)
+	if err != nil {
+		status, message := authFailure(w, err)
 		respBody := errResp{
-			Error : "Something went wrong",
+			Error : message,
 		}
 		dat, err2 := json.Marshal(respBody)
 		if err2 != nil {
@@ -646,12 +845,14 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(401)
+		w.WriteHeader(status)
 		w.Write(dat)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(accessToken, cfg.secret)
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
 	if err != nil {
 		respBody := errResp{
 			Error : "Something went wrong",
@@ -662,17 +863,23 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(401)
+		w.WriteHeader(400)
 		w.Write(dat)
 		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
 	if err != nil {
+		log.Printf("Error loading user: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	changePassword := params.Password != ""
+	changeEmail := params.Email != "" && params.Email != user.Email
+	if !changePassword && !changeEmail {
 		respBody := errResp{
-			Error : "Something went wrong",
+			Error : "Nothing to update",
 		}
 		dat, err2 := json.Marshal(respBody)
 		if err2 != nil {
@@ -685,10 +892,16 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	hashed, err := auth.HashPassword(params.Password)
+	retryAfter, err := cfg.loginRetryAfter(req.Context(), req, user.Email)
 	if err != nil {
+		log.Printf("Error checking login attempts: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
 		respBody := errResp{
-			Error : "Something went wrong",
+			Error : "Too many failed attempts, try again later",
 		}
 		dat, err2 := json.Marshal(respBody)
 		if err2 != nil {
@@ -696,23 +909,37 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(400)
+		w.WriteHeader(429)
 		w.Write(dat)
 		return
 	}
 
-	updateParams := database.UpdateUserPwAndEmailParams{
-		ID : userID,
-		HashedPassword : sql.NullString{
-			String : hashed,
-			Valid : true,
-		},
-		Email : params.Email,
-	}
-	updatedUser, err := cfg.db.UpdateUserPwAndEmail(req.Context(), updateParams)
+	// A bearer token alone is not enough to take over the account, so
+	// the user proves who they are again with every factor they have.
+	totp, hasTOTP, err := cfg.userHasTOTP(req.Context(), userID)
 	if err != nil {
+		log.Printf("Error loading TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	reauthErr := ""
+	if !user.HashedPassword.Valid && !hasTOTP {
+		reauthErr = "Set a password with a password reset before changing your email or password"
+	} else if user.HashedPassword.Valid {
+		pwMatch, err := auth.CheckPasswordHash(params.CurrentPassword, user.HashedPassword.String)
+		if err != nil || !pwMatch {
+			reauthErr = "Incorrect password"
+		}
+	}
+	if reauthErr == "" && hasTOTP && !cfg.verifySecondFactor(req.Context(), totp, params.Code, params.RecoveryCode) {
+		reauthErr = "Invalid code"
+	}
+	if reauthErr != "" {
+		if user.HashedPassword.Valid || hasTOTP {
+			cfg.recordLoginFailure(req.Context(), req, user.Email)
+		}
 		respBody := errResp{
-			Error : "Something went wrong",
+			Error : reauthErr,
 		}
 		dat, err2 := json.Marshal(respBody)
 		if err2 != nil {
@@ -720,17 +947,92 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(500)
 			return
 		}
-		w.WriteHeader(400)
+		w.WriteHeader(403)
 		w.Write(dat)
 		return
 	}
 
+	if changePassword {
+		err = cfg.passwordPolicy.Check(params.Password)
+		if err != nil {
+			var policyErr *auth.PasswordPolicyError
+			if !errors.As(err, &policyErr) {
+				log.Printf("Error checking password policy: %s", err)
+				w.WriteHeader(500)
+				return
+			}
+			respBody := errResp{
+				Error : "Password does not meet requirements",
+				Violations : policyErr.Violations,
+			}
+			dat, err2 := json.Marshal(respBody)
+			if err2 != nil {
+				log.Printf("Error marshalling JSON: %s", err2)
+				w.WriteHeader(500)
+				return
+			}
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+
+		hashed, err := auth.HashPasswordWithParams(params.Password, cfg.hashParams)
+		if err != nil {
+			log.Printf("Error hashing password: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+
+		err = cfg.db.UpdateUserPassword(req.Context(), database.UpdateUserPasswordParams{
+			ID : userID,
+			HashedPassword : sql.NullString{
+				String : hashed,
+				Valid : true,
+			},
+		})
+		if err != nil {
+			log.Printf("Error updating password: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		cfg.recordAuditEvent(req.Context(), req, userID, "user.password_changed")
+	}
+
+	pendingEmail := ""
+	if changeEmail {
+		err = cfg.requestEmailChange(req.Context(), user, params.Email)
+		if err != nil {
+			log.Printf("Error requesting email change: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		cfg.recordAudit(req.Context(), req, auditEntry{
+			UserID : userID,
+			ActorType : actorUser,
+			ActorID : userID,
+			Event : "user.email_change_requested",
+			Metadata : map[string]string{
+				"new_email" : params.Email,
+			},
+		})
+		pendingEmail = params.Email
+	}
+
+	updatedUser, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading user: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
 	mapped := User{
 		ID : updatedUser.ID,
 		CreatedAt : updatedUser.CreatedAt,
 		UpdatedAt : updatedUser.UpdatedAt,
 		Email : updatedUser.Email,
 		IsChirpyRed : updatedUser.IsChirpyRed,
+		EmailVerified : updatedUser.EmailVerifiedAt.Valid,
+		PendingEmail : pendingEmail,
 	}
 	dat, err := json.Marshal(mapped)
 	if err != nil {
@@ -744,15 +1046,10 @@ func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, req *http.Request) {
 }
 
 func (cfg *apiConfig) handleDeleteChirp(w http.ResponseWriter, req *http.Request) {
-	accessToken, err := auth.GetBearerToken(req.Header)
-	if err != nil || accessToken == "" {
-		w.WriteHeader(401)
-		return
-	}
-
-	userID, err := auth.ValidateJWT(accessToken, cfg.secret)
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsWrite)
 	if err != nil {
-		w.WriteHeader(401)
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
 		return
 	}
 
@@ -768,7 +1065,19 @@ func (cfg *apiConfig) handleDeleteChirp(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	err = cfg.db.DeleteChirpByID(req.Context(), chirpID)
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		err := q.DeleteChirpByID(req.Context(), chirpID)
+		if err != nil {
+			return err
+		}
+		return writeOutboxEvent(req.Context(), q, userID, webhooks.EventChirpDeleted, Chirp{
+			ID : chirp.ID,
+			CreatedAt : chirp.CreatedAt,
+			UpdatedAt : chirp.UpdatedAt,
+			Body : chirp.Body,
+			UserID : chirp.UserID,
+		})
+	})
 	if err != nil {
 		w.WriteHeader(400)
 		return
@@ -778,43 +1087,37 @@ func (cfg *apiConfig) handleDeleteChirp(w http.ResponseWriter, req *http.Request
 	return
 }
 
-func (cfg *apiConfig) handlePolkaWebhook(w http.ResponseWriter, req *http.Request) {
-	type data struct {
-		UserID string `json:"user_id"`
-	}
-	type parameters struct {
-		Event string `json:"event"`
-		Data  data   `json:"data"`
-	}
-
-	polkaKey, err := auth.GetAPIKey(req.Header)
-	if err != nil || polkaKey != cfg.polkaKey {
-		w.WriteHeader(401)
-		return
-	}
-
-	decoder := json.NewDecoder(req.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+func (cfg *apiConfig) handleJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dat, err := json.Marshal(cfg.keys.JWKS())
 	if err != nil {
-		w.WriteHeader(400)
-		return
-	}
-
-	if params.Event != "user.upgraded" {
-		w.WriteHeader(204)
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
 		return
 	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
 
-	chirpUUID, err := uuid.Parse(params.Data.UserID)
-	err = cfg.db.UpgradeUser(req.Context(), chirpUUID)
-	if err != nil {
-		w.WriteHeader(404)
-		return
+func tokenErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		return "Token expired"
+	case errors.Is(err, auth.ErrTokenNotYetValid):
+		return "Token not valid yet"
+	case errors.Is(err, auth.ErrTokenAudience):
+		return "Token not intended for this API"
+	case errors.Is(err, auth.ErrTokenMalformed):
+		return "Malformed token"
+	default:
+		return "Invalid token"
 	}
+}
 
-	w.WriteHeader(204)
-	return
+func bearerChallenge(err error) string {
+	return fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, tokenErrorMessage(err))
 }
 
 func censorString(s string) string {
@@ -839,6 +1142,14 @@ func main () {
 	platform := os.Getenv("PLATFORM")
 	secret := os.Getenv("SECRET")
 	polkaKey := os.Getenv("POLKA_KEY")
+	signingKeyFile := os.Getenv("JWT_SIGNING_KEY")
+	verificationKeyFiles := os.Getenv("JWT_VERIFICATION_KEYS")
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	jwtLeeway := os.Getenv("JWT_LEEWAY")
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		fmt.Println(err)
@@ -846,14 +1157,210 @@ func main () {
 	}
 	dbQueries := database.New(db)
 	apiCfg.db = dbQueries
+	apiCfg.sqlDB = db
 	apiCfg.platform = platform
-	apiCfg.secret = secret
+	if signingKeyFile == "" {
+		apiCfg.keys = auth.NewHMACKeySet(secret)
+	} else {
+		verificationKeys := []string{}
+		if verificationKeyFiles != "" {
+			verificationKeys = strings.Split(verificationKeyFiles, ",")
+		}
+		apiCfg.keys, err = auth.LoadKeySet(signingKeyFile, verificationKeys)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	validationOpts := auth.DefaultValidationOptions()
+	validationOpts.Audience = jwtAudience
+	if jwtLeeway != "" {
+		validationOpts.Leeway, err = time.ParseDuration(jwtLeeway)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	apiCfg.keys.SetValidationOptions(validationOpts)
+	apiCfg.baseURL = strings.TrimSuffix(baseURL, "/")
+	apiCfg.mailer, err = mailer.New(mailer.Config{
+		Backend : os.Getenv("MAILER"),
+		From : os.Getenv("MAIL_FROM"),
+		SMTPAddr : os.Getenv("SMTP_ADDR"),
+		Username : os.Getenv("SMTP_USERNAME"),
+		Password : os.Getenv("SMTP_PASSWORD"),
+		Dir : os.Getenv("MAIL_DIR"),
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	apiCfg.polkaKey = polkaKey
 
+	var loginTracker lockout.Tracker
+	switch os.Getenv("LOGIN_ATTEMPTS_BACKEND") {
+	case "memory":
+		loginTracker = lockout.NewMemoryTracker()
+	default:
+		loginTracker = lockout.NewPostgresTracker(dbQueries)
+	}
+	apiCfg.loginEmailLimiter = lockout.NewLimiter(loginTracker, lockout.DefaultPolicy())
+	apiCfg.loginIPLimiter = lockout.NewLimiter(loginTracker, ipLoginPolicy())
+	apiCfg.rateTracker = loginTracker
+
+	apiCfg.entitlements = entitlements.Default()
+	if v := os.Getenv("ENTITLEMENTS_FILE"); v != "" {
+		apiCfg.entitlements, err = entitlements.Load(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	apiCfg.passwordPolicy = auth.DefaultPasswordPolicy()
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		apiCfg.passwordPolicy.MinLength, err = strconv.Atoi(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if v := os.Getenv("PASSWORD_MAX_LENGTH"); v != "" {
+		apiCfg.passwordPolicy.MaxLength, err = strconv.Atoi(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if v := os.Getenv("PASSWORD_BANNED_FILE"); v != "" {
+		err = apiCfg.passwordPolicy.LoadBannedPasswords(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if v := os.Getenv("BREACH_CORPUS_DIR"); v != "" {
+		apiCfg.passwordPolicy.Breaches = &auth.BreachCorpus{
+			Dir : v,
+			MinCount : 1,
+		}
+		err = apiCfg.passwordPolicy.Breaches.Check()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	apiCfg.hashParams = auth.DefaultPasswordHashParams()
+	if v := os.Getenv("ARGON2_MEMORY"); v != "" {
+		memory, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		apiCfg.hashParams.Memory = uint32(memory)
+	}
+	if v := os.Getenv("ARGON2_ITERATIONS"); v != "" {
+		iterations, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		apiCfg.hashParams.Iterations = uint32(iterations)
+	}
+	if v := os.Getenv("ARGON2_PARALLELISM"); v != "" {
+		parallelism, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		apiCfg.hashParams.Parallelism = uint8(parallelism)
+	}
+	err = apiCfg.hashParams.Validate()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	apiCfg.oauth = oauth.NewServer(oauth.NewPostgresStore(dbQueries), apiCfg.keys, apiCfg.oauthLogin)
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+		if redirectURL == "" {
+			redirectURL = apiCfg.baseURL + "/api/oidc/callback"
+		}
+		apiCfg.oidc = oidc.NewClient(oidc.Config{
+			Issuer : issuer,
+			ClientID : os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret : os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL : redirectURL,
+		}, nil)
+	}
+
+	// Several comma separated secrets can be active at once while Polka
+	// rotates from one to the next.
+	for _, v := range strings.Split(os.Getenv("POLKA_WEBHOOK_SECRETS"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			apiCfg.polkaSecrets = append(apiCfg.polkaSecrets, []byte(v))
+		}
+	}
+	apiCfg.polkaTolerance = defaultPolkaTolerance
+	if v := os.Getenv("POLKA_WEBHOOK_TOLERANCE"); v != "" {
+		apiCfg.polkaTolerance, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	apiCfg.deletionGracePeriod = defaultDeletionGracePeriod
+	if v := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); v != "" {
+		apiCfg.deletionGracePeriod, err = time.ParseDuration(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	go apiCfg.runAccountDeletion(accountDeletionSweepInterval)
+	go apiCfg.runSubscriptionExpiry(subscriptionSweepInterval)
+
+	// Export download URLs are signed with EXPORT_SIGNING_KEY, or a key
+	// derived from SECRET so the JWT key is not used for both. Without
+	// either, dev uses a random key: URLs then only work on the replica
+	// that signed them, until it restarts.
+	switch {
+	case os.Getenv("EXPORT_SIGNING_KEY") != "":
+		apiCfg.exportKey = []byte(os.Getenv("EXPORT_SIGNING_KEY"))
+	case secret != "":
+		apiCfg.exportKey = auth.DeriveKey(secret, "export-url")
+	case platform == "dev":
+		exportKey, err := auth.MakeOneTimeToken()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		apiCfg.exportKey = []byte(exportKey)
+	default:
+		fmt.Println("EXPORT_SIGNING_KEY or SECRET must be set")
+		os.Exit(1)
+	}
+	apiCfg.exportWake = make(chan struct{}, 1)
+	go apiCfg.runDataExports(dataExportSweepInterval)
+
+	// Private addresses are only reachable in dev, so webhook URLs cannot
+	// be used to probe the network the server runs in.
+	apiCfg.webhookSender = webhooks.NewSender(webhookTimeout, platform == "dev")
+	apiCfg.webhookWake = make(chan struct{}, 1)
+	go apiCfg.runWebhookDeliveries(webhookSweepInterval)
+	apiCfg.outboxWake = make(chan struct{}, 1)
+	go apiCfg.runOutboxDispatcher(outboxSweepInterval)
+	apiCfg.streamHub = stream.NewHub(streamBuffer)
+	go apiCfg.runEventStream(dbURL)
+
 	serveMux := http.NewServeMux()
 	server := http.Server{
 		Addr : ":8080",
-		Handler : serveMux,
+		Handler : middlewareRequestID(serveMux),
 	}
 
 	serveMux.Handle("/app/", apiCfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
@@ -864,12 +1371,71 @@ func main () {
 	serveMux.HandleFunc("POST /api/users", apiCfg.handleUsers)
 	serveMux.HandleFunc("GET /api/chirps", apiCfg.handleGetChirps)
 	serveMux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.handleGetChirp)
+	serveMux.HandleFunc("GET /api/stream", apiCfg.handleStream)
+	serveMux.HandleFunc("GET /api/ws", apiCfg.handleWebSocket)
 	serveMux.HandleFunc("POST /api/login", apiCfg.handleLogin)
 	serveMux.HandleFunc("POST /api/refresh", apiCfg.handleRefresh)
 	serveMux.HandleFunc("POST /api/revoke", apiCfg.handleRevoke)
 	serveMux.HandleFunc("PUT /api/users", apiCfg.handlePutUsers)
+	serveMux.HandleFunc("DELETE /api/users/me", apiCfg.handleDeleteUser)
+	serveMux.HandleFunc("GET /api/users/me/entitlements", apiCfg.handleGetEntitlements)
+	serveMux.HandleFunc("POST /api/users/me/exports", apiCfg.handleCreateDataExport)
+	serveMux.HandleFunc("GET /api/users/me/exports/{exportID}", apiCfg.handleGetDataExport)
+	serveMux.HandleFunc("GET /api/exports/{exportID}/download", apiCfg.handleDownloadDataExport)
+	serveMux.HandleFunc("GET /api/users/me/security-events", apiCfg.handleListSecurityEvents)
+	serveMux.HandleFunc("GET /api/admin/audit-events", apiCfg.handleListAuditEvents)
+	serveMux.HandleFunc("GET /api/admin/webhook-events", apiCfg.handleListWebhookEvents)
+	serveMux.HandleFunc("POST /api/admin/webhook-events/{eventID}/replay", apiCfg.handleReplayWebhookEvent)
 	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handleDeleteChirp)
 	serveMux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlePolkaWebhook)
+	serveMux.HandleFunc("GET /.well-known/jwks.json", apiCfg.handleJWKS)
+	serveMux.HandleFunc("GET /api/users/verify", apiCfg.handleVerifyEmail)
+	serveMux.HandleFunc("POST /api/users/verify/resend", apiCfg.handleResendVerification)
+	serveMux.HandleFunc("GET /api/users/email/confirm", apiCfg.handleConfirmEmailChange)
+	serveMux.HandleFunc("GET /api/users/email/revert", apiCfg.handleRevertEmailChangePage)
+	serveMux.HandleFunc("POST /api/users/email/revert", apiCfg.handleRevertEmailChange)
+	serveMux.HandleFunc("POST /api/password-reset/request", apiCfg.handlePasswordResetRequest)
+	serveMux.HandleFunc("POST /api/password-reset/confirm", apiCfg.handlePasswordResetConfirm)
+	serveMux.HandleFunc("POST /api/login/totp", apiCfg.handleLoginTOTP)
+	serveMux.HandleFunc("POST /api/users/me/totp", apiCfg.handleEnrollTOTP)
+	serveMux.HandleFunc("POST /api/users/me/totp/confirm", apiCfg.handleConfirmTOTP)
+	serveMux.HandleFunc("DELETE /api/users/me/totp", apiCfg.handleDeleteTOTP)
+	serveMux.HandleFunc("GET /api/users/unlock", apiCfg.handleUnlockAccount)
+	serveMux.HandleFunc("POST /api/users/me/api-keys", apiCfg.handleCreateAPIKey)
+	serveMux.HandleFunc("GET /api/users/me/api-keys", apiCfg.handleListAPIKeys)
+	serveMux.HandleFunc("DELETE /api/users/me/api-keys/{keyID}", apiCfg.handleRevokeAPIKey)
+	serveMux.HandleFunc("GET /api/notifications", apiCfg.handleListNotifications)
+	serveMux.HandleFunc("POST /api/notifications/read", apiCfg.handleMarkAllNotificationsRead)
+	serveMux.HandleFunc("POST /api/notifications/{notificationID}/read", apiCfg.handleMarkNotificationRead)
+	serveMux.HandleFunc("GET /api/users/me/notification-preferences", apiCfg.handleGetNotificationPreferences)
+	serveMux.HandleFunc("PUT /api/users/me/notification-preferences", apiCfg.handlePutNotificationPreferences)
+	serveMux.HandleFunc("POST /api/conversations", apiCfg.handleCreateConversation)
+	serveMux.HandleFunc("GET /api/conversations", apiCfg.handleListConversations)
+	serveMux.HandleFunc("GET /api/conversations/{conversationID}", apiCfg.handleGetConversation)
+	serveMux.HandleFunc("POST /api/conversations/{conversationID}/leave", apiCfg.handleLeaveConversation)
+	serveMux.HandleFunc("POST /api/conversations/{conversationID}/read", apiCfg.handleMarkConversationRead)
+	serveMux.HandleFunc("GET /api/conversations/{conversationID}/messages", apiCfg.handleListMessages)
+	serveMux.HandleFunc("POST /api/conversations/{conversationID}/messages", apiCfg.handleSendMessage)
+	serveMux.HandleFunc("DELETE /api/conversations/{conversationID}/messages/{messageID}", apiCfg.handleDeleteMessage)
+	serveMux.HandleFunc("GET /api/users/me/blocks", apiCfg.handleListBlockedUsers)
+	serveMux.HandleFunc("PUT /api/users/me/blocks/{userID}", apiCfg.handleBlockUser)
+	serveMux.HandleFunc("DELETE /api/users/me/blocks/{userID}", apiCfg.handleUnblockUser)
+	serveMux.HandleFunc("POST /api/webhooks", apiCfg.handleCreateWebhookEndpoint)
+	serveMux.HandleFunc("GET /api/webhooks", apiCfg.handleListWebhookEndpoints)
+	serveMux.HandleFunc("DELETE /api/webhooks/{endpointID}", apiCfg.handleDeleteWebhookEndpoint)
+	serveMux.HandleFunc("GET /api/webhooks/{endpointID}/deliveries", apiCfg.handleListWebhookDeliveries)
+	serveMux.HandleFunc("POST /api/webhooks/{endpointID}/deliveries/{deliveryID}/retry", apiCfg.handleRetryWebhookDelivery)
+	serveMux.HandleFunc("POST /api/oauth/clients", apiCfg.handleCreateOAuthClient)
+	serveMux.HandleFunc("GET /api/oauth/clients", apiCfg.handleListOAuthClients)
+	serveMux.HandleFunc("DELETE /api/oauth/clients/{clientID}", apiCfg.handleDeleteOAuthClient)
+	serveMux.HandleFunc("GET /oauth/authorize", apiCfg.oauth.HandleAuthorize)
+	serveMux.HandleFunc("POST /oauth/authorize", apiCfg.oauth.HandleAuthorize)
+	serveMux.HandleFunc("POST /oauth/token", apiCfg.oauth.HandleToken)
+	serveMux.HandleFunc("POST /oauth/revoke", apiCfg.oauth.HandleRevoke)
+	serveMux.HandleFunc("POST /oauth/introspect", apiCfg.oauth.HandleIntrospect)
+	serveMux.HandleFunc("GET /api/oidc/login", apiCfg.handleOIDCLogin)
+	serveMux.HandleFunc("POST /api/oidc/link", apiCfg.handleOIDCLink)
+	serveMux.HandleFunc("GET /api/oidc/callback", apiCfg.handleOIDCCallback)
 
 	err = server.ListenAndServe()
 	if err != nil {
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+// Notification types, which are also the categories users can turn off.
+// Follows, likes, replies and rechirps will add their own types along with
+// the features that produce them.
+const (
+	notificationMention = "mention"
+)
+
+var notificationTypes = []string{
+	notificationMention,
+}
+
+// maxNotificationActors is how many of a group's actors are listed, newest
+// first. actor_count still counts all of them.
+const maxNotificationActors = 3
+
+const eventNotificationCreated = "notification.created"
+
+// Users have no handles, so a chirp mentions someone by email address,
+// like "@alice@example.com". Only the first maxMentions are notified.
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([\w.+-]+@[\w-]+(?:\.[\w-]+)+)`)
+
+const maxMentions = 10
+
+type Notification struct {
+	ID         uuid.UUID   `json:"id"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	Type       string      `json:"type"`
+	ChirpID    *uuid.UUID  `json:"chirp_id"`
+	ActorIDs   []uuid.UUID `json:"actor_ids"`
+	ActorCount int         `json:"actor_count"`
+	Read       bool        `json:"read"`
+}
+
+func mapNotification(notification database.Notification) Notification {
+	mapped := Notification{
+		ID : notification.ID,
+		CreatedAt : notification.CreatedAt,
+		UpdatedAt : notification.UpdatedAt,
+		Type : notification.Type,
+		ActorIDs : notification.ActorIds[:min(len(notification.ActorIds), maxNotificationActors)],
+		ActorCount : len(notification.ActorIds),
+		Read : notification.ReadAt.Valid,
+	}
+	if notification.ChirpID.Valid {
+		mapped.ChirpID = &notification.ChirpID.UUID
+	}
+	return mapped
+}
+
+// notify tells userID that actorID did something, grouping it with an
+// unread notification of the same type on the same chirp. It takes the
+// Queries of the transaction that makes the change, and does nothing for
+// the user's own actions or a type they turned off.
+func notify(ctx context.Context, q *database.Queries, userID uuid.UUID, notificationType string, actorID uuid.UUID, chirpID uuid.NullUUID) error {
+	if userID == actorID {
+		return nil
+	}
+	notification, err := q.CreateNotification(ctx, database.CreateNotificationParams{
+		UserID : userID,
+		Type : notificationType,
+		ChirpID : chirpID,
+		ActorID : actorID,
+	})
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeOutboxEvent(ctx, q, userID, eventNotificationCreated, mapNotification(notification))
+}
+
+// notifyMentions notifies the users a new chirp mentions, skipping
+// addresses with no account and anyone on either side of a block with the
+// author. Like notify, it runs in the transaction that creates the chirp.
+func notifyMentions(ctx context.Context, q *database.Queries, chirp database.Chirp) error {
+	emails := []string{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(chirp.Body, -1) {
+		if !slices.Contains(emails, match[1]) && len(emails) < maxMentions {
+			emails = append(emails, match[1])
+		}
+	}
+	for _, email := range emails {
+		user, err := q.GetUserByEmail(ctx, email)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		blocked, err := q.HasBlockBetween(ctx, database.HasBlockBetweenParams{
+			UserID : chirp.UserID,
+			OtherIds : []uuid.UUID{user.ID},
+		})
+		if err != nil {
+			return err
+		}
+		if blocked {
+			continue
+		}
+		err = notify(ctx, q, user.ID, notificationMention, chirp.UserID, uuid.NullUUID{
+			UUID : chirp.ID,
+			Valid : true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handleListNotifications(w http.ResponseWriter, req *http.Request) {
+	type notificationsResp struct {
+		UnreadCount   int64          `json:"unread_count"`
+		Notifications []Notification `json:"notifications"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsRead)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	limit, before, ok := auditPage(req)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	notifications, err := cfg.db.ListNotifications(req.Context(), database.ListNotificationsParams{
+		UserID : userID,
+		UnreadOnly : req.URL.Query().Get("unread") == "true",
+		Before : before,
+		Limit : limit,
+	})
+	if err != nil {
+		log.Printf("Error listing notifications: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	unread, err := cfg.db.CountUnreadNotifications(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error counting notifications: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	resp := notificationsResp{
+		UnreadCount : unread,
+		Notifications : []Notification{},
+	}
+	for _, notification := range notifications {
+		resp.Notifications = append(resp.Notifications, mapNotification(notification))
+	}
+	dat, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handleMarkNotificationRead(w http.ResponseWriter, req *http.Request) {
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	notificationID, err := uuid.Parse(req.PathValue("notificationID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	rows, err := cfg.db.MarkNotificationRead(req.Context(), database.MarkNotificationReadParams{
+		ID : notificationID,
+		UserID : userID,
+	})
+	if err != nil {
+		log.Printf("Error marking notification read: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if rows == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleMarkAllNotificationsRead(w http.ResponseWriter, req *http.Request) {
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	err = cfg.db.MarkAllNotificationsRead(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error marking notifications read: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// notificationPreferences returns whether each type is on. Only types a
+// user has changed are stored; the rest are on.
+func (cfg *apiConfig) notificationPreferences(ctx context.Context, userID uuid.UUID) (map[string]bool, error) {
+	stored, err := cfg.db.ListNotificationPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	prefs := map[string]bool{}
+	for _, notificationType := range notificationTypes {
+		prefs[notificationType] = true
+	}
+	for _, pref := range stored {
+		if slices.Contains(notificationTypes, pref.Type) {
+			prefs[pref.Type] = pref.Enabled
+		}
+	}
+	return prefs, nil
+}
+
+func (cfg *apiConfig) handleGetNotificationPreferences(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeChirpsRead)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	prefs, err := cfg.notificationPreferences(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(prefs)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handlePutNotificationPreferences turns types on or off. Types left out
+// of the request keep their setting.
+func (cfg *apiConfig) handlePutNotificationPreferences(w http.ResponseWriter, req *http.Request) {
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeProfileWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := map[string]bool{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	for notificationType := range params {
+		if !slices.Contains(notificationTypes, notificationType) {
+			dat, err := json.Marshal(errResp{
+				Error : fmt.Sprintf("Unknown notification type %q", notificationType),
+			})
+			if err != nil {
+				log.Printf("Error marshalling JSON: %s", err)
+				w.WriteHeader(500)
+				return
+			}
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+	}
+
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		for notificationType, enabled := range params {
+			err := q.SetNotificationPreference(req.Context(), database.SetNotificationPreferenceParams{
+				UserID : userID,
+				Type : notificationType,
+				Enabled : enabled,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error saving notification preferences: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	prefs, err := cfg.notificationPreferences(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(prefs)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
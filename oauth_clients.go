@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/oauth"
+	"github.com/google/uuid"
+)
+
+const (
+	maxOAuthClientNameLength = 100
+	maxOAuthRedirectURIs     = 10
+)
+
+type OAuthClient struct {
+	ID           uuid.UUID `json:"client_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	Secret       string    `json:"client_secret,omitempty"`
+}
+
+func mapOAuthClient(client database.OauthClient) OAuthClient {
+	return OAuthClient{
+		ID : client.ID,
+		CreatedAt : client.CreatedAt,
+		Name : client.Name,
+		RedirectURIs : client.RedirectUris,
+		Confidential : client.SecretHash.Valid,
+	}
+}
+
+// oauthLogin checks the credentials typed into the OAuth consent page with
+// the same brute-force protection and second factor as handleLogin.
+func (cfg *apiConfig) oauthLogin(req *http.Request, email, password, code string) (uuid.UUID, error) {
+	retryAfter, err := cfg.loginRetryAfter(req.Context(), req, email)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if retryAfter > 0 {
+		return uuid.Nil, oauth.ErrLoginThrottled
+	}
+
+	user, err := cfg.db.GetUserByEmail(req.Context(), email)
+	if err != nil {
+		cfg.recordLoginFailure(req.Context(), req, email)
+		return uuid.Nil, err
+	}
+	pwMatch, err := auth.CheckPasswordHash(password, user.HashedPassword.String)
+	if err != nil || !pwMatch {
+		cfg.recordLoginFailure(req.Context(), req, email)
+		return uuid.Nil, errors.New("incorrect password")
+	}
+
+	totp, hasTOTP, err := cfg.userHasTOTP(req.Context(), user.ID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if hasTOTP {
+		if !cfg.verifySecondFactor(req.Context(), totp, code, "") && !cfg.verifySecondFactor(req.Context(), totp, "", code) {
+			cfg.recordLoginFailure(req.Context(), req, email)
+			return uuid.Nil, errors.New("incorrect second factor")
+		}
+	}
+
+	cfg.recordLoginSuccess(req.Context(), user.Email)
+	cfg.recordLogin(req.Context(), req, user.ID, "oauth_consent")
+	return user.ID, nil
+}
+
+func (cfg *apiConfig) handleCreateOAuthClient(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool `json:"confidential"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > maxOAuthClientNameLength {
+		err = fmt.Errorf("Name must be between 1 and %d characters", maxOAuthClientNameLength)
+	} else if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxOAuthRedirectURIs {
+		err = fmt.Errorf("Between 1 and %d redirect URIs are required", maxOAuthRedirectURIs)
+	}
+	for _, uri := range params.RedirectURIs {
+		if err != nil {
+			break
+		}
+		err = oauth.ValidRedirectURI(uri)
+	}
+	if err != nil {
+		respBody := errResp{
+			Error : err.Error(),
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	secret := ""
+	secretHash := sql.NullString{}
+	if params.Confidential {
+		secret, err = auth.MakeOneTimeToken()
+		if err != nil {
+			log.Printf("Error generating client secret: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		secretHash = sql.NullString{
+			String : auth.HashToken(secret),
+			Valid : true,
+		}
+	}
+
+	client, err := cfg.db.CreateOAuthClient(req.Context(), database.CreateOAuthClientParams{
+		UserID : userID,
+		Name : name,
+		RedirectUris : params.RedirectURIs,
+		SecretHash : secretHash,
+	})
+	if err != nil {
+		log.Printf("Error creating OAuth client: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "oauth_client.created")
+
+	// The secret is only ever shown in this response.
+	mapped := mapOAuthClient(client)
+	mapped.Secret = secret
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(201)
+	w.Write(dat)
+	return
+}
+
+func (cfg *apiConfig) handleListOAuthClients(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	clients, err := cfg.db.ListOAuthClients(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing OAuth clients: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped := []OAuthClient{}
+	for _, client := range clients {
+		mapped = append(mapped, mapOAuthClient(client))
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
+
+// handleDeleteOAuthClient also removes the client's codes and refresh
+// tokens through ON DELETE CASCADE. Access tokens it already holds stay
+// valid until they expire.
+func (cfg *apiConfig) handleDeleteOAuthClient(w http.ResponseWriter, req *http.Request) {
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	clientID, err := uuid.Parse(req.PathValue("clientID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	rows, err := cfg.db.DeleteOAuthClient(req.Context(), database.DeleteOAuthClientParams{
+		ID : clientID,
+		UserID : userID,
+	})
+	if err != nil {
+		log.Printf("Error deleting OAuth client: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if rows == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "oauth_client.deleted")
+
+	w.WriteHeader(204)
+	return
+}
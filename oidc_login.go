@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/oidc"
+	"github.com/google/uuid"
+)
+
+const (
+	oidcStateCookie = "chirpy_oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+var errOIDCAccountExists = errors.New("an unverified account already uses this email")
+
+// startOIDCLogin stores the state, nonce and PKCE verifier for a new
+// sign-in, binds the state to this browser with a cookie, and returns the
+// provider URL to send the user to.
+func (cfg *apiConfig) startOIDCLogin(w http.ResponseWriter, req *http.Request, linkUserID uuid.UUID) (string, error) {
+	state, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = cfg.db.DeleteExpiredOIDCLoginStates(req.Context())
+	if err != nil {
+		log.Printf("Error deleting expired OIDC states: %s", err)
+	}
+	err = cfg.db.CreateOIDCLoginState(req.Context(), database.CreateOIDCLoginStateParams{
+		StateHash : auth.HashToken(state),
+		Nonce : nonce,
+		CodeVerifier : verifier,
+		LinkUserID : uuid.NullUUID{
+			UUID : linkUserID,
+			Valid : linkUserID != uuid.Nil,
+		},
+		ExpiresAt : time.Now().Add(oidcStateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name : oidcStateCookie,
+		Value : state,
+		Path : "/api/oidc/callback",
+		MaxAge : int(oidcStateTTL.Seconds()),
+		HttpOnly : true,
+		Secure : strings.HasPrefix(cfg.baseURL, "https://"),
+		SameSite : http.SameSiteLaxMode,
+	})
+	return cfg.oidc.AuthCodeURL(req.Context(), state, nonce, oidc.S256Challenge(verifier))
+}
+
+func (cfg *apiConfig) handleOIDCLogin(w http.ResponseWriter, req *http.Request) {
+	if cfg.oidc == nil {
+		w.WriteHeader(404)
+		return
+	}
+	authURL, err := cfg.startOIDCLogin(w, req, uuid.Nil)
+	if err != nil {
+		log.Printf("Error starting OIDC login: %s", err)
+		w.WriteHeader(502)
+		return
+	}
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// handleOIDCLink starts the same flow for a signed in user. It returns the
+// URL instead of redirecting since the request carries a bearer token,
+// which a browser navigation cannot.
+func (cfg *apiConfig) handleOIDCLink(w http.ResponseWriter, req *http.Request) {
+	type linkResp struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	if cfg.oidc == nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	authURL, err := cfg.startOIDCLogin(w, req, userID)
+	if err != nil {
+		log.Printf("Error starting OIDC link: %s", err)
+		w.WriteHeader(502)
+		return
+	}
+	dat, err := json.Marshal(linkResp{
+		AuthorizationURL : authURL,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
+
+// oidcUser finds the user for a verified identity. Unknown identities are
+// linked to an existing account only when both sides have verified the
+// email, so nobody can pre-register someone else's address and wait for
+// them to sign in. Otherwise a password-less account is created.
+func (cfg *apiConfig) oidcUser(ctx context.Context, claims oidc.Claims) (database.User, error) {
+	identity, err := cfg.db.GetUserIdentity(ctx, database.GetUserIdentityParams{
+		Issuer : claims.Issuer,
+		Subject : claims.Subject,
+	})
+	if err == nil {
+		return cfg.db.GetUserByID(ctx, identity.UserID)
+	}
+	if err != sql.ErrNoRows {
+		return database.User{}, err
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return database.User{}, errors.New("provider did not return a verified email")
+	}
+
+	user, err := cfg.db.GetUserByEmail(ctx, claims.Email)
+	if err == sql.ErrNoRows {
+		user, err = cfg.db.CreateUser(ctx, database.CreateUserParams{
+			Email : claims.Email,
+		})
+		if err != nil {
+			return database.User{}, err
+		}
+		err = cfg.db.VerifyUserEmail(ctx, user.ID)
+		if err != nil {
+			return database.User{}, err
+		}
+		user.EmailVerifiedAt = sql.NullTime{
+			Time : time.Now(),
+			Valid : true,
+		}
+	} else if err != nil {
+		return database.User{}, err
+	} else if !user.EmailVerifiedAt.Valid {
+		return database.User{}, errOIDCAccountExists
+	}
+
+	_, err = cfg.db.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+		UserID : user.ID,
+		Issuer : claims.Issuer,
+		Subject : claims.Subject,
+		Email : claims.Email,
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+func (cfg *apiConfig) handleOIDCCallback(w http.ResponseWriter, req *http.Request) {
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	if cfg.oidc == nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	fail := func(status int, message string) {
+		dat, err := json.Marshal(errResp{
+			Error : message,
+		})
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(dat)
+	}
+
+	query := req.URL.Query()
+	if query.Get("error") != "" {
+		fail(400, "Sign in was cancelled or failed at the provider")
+		return
+	}
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || query.Get("state") == "" || cookie.Value != query.Get("state") {
+		fail(400, "Sign in session is missing or does not match")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name : oidcStateCookie,
+		Path : "/api/oidc/callback",
+		MaxAge : -1,
+	})
+
+	state, err := cfg.db.ConsumeOIDCLoginState(req.Context(), auth.HashToken(cookie.Value))
+	if err != nil {
+		fail(400, "Sign in session has expired")
+		return
+	}
+
+	claims, err := cfg.oidc.Exchange(req.Context(), query.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("Error completing OIDC login: %s", err)
+		fail(401, "Could not verify the sign in with the provider")
+		return
+	}
+
+	if state.LinkUserID.Valid {
+		_, err = cfg.db.CreateUserIdentity(req.Context(), database.CreateUserIdentityParams{
+			UserID : state.LinkUserID.UUID,
+			Issuer : claims.Issuer,
+			Subject : claims.Subject,
+			Email : claims.Email,
+		})
+		if err != nil {
+			fail(409, "This identity is already linked to an account")
+			return
+		}
+		cfg.recordAuditEvent(req.Context(), req, state.LinkUserID.UUID, "user.identity_linked")
+		w.WriteHeader(204)
+		return
+	}
+
+	user, err := cfg.oidcUser(req.Context(), claims)
+	if errors.Is(err, errOIDCAccountExists) {
+		fail(409, "An account with this email exists. Verify it or log in with your password, then link the provider")
+		return
+	}
+	if err != nil {
+		log.Printf("Error finding OIDC user: %s", err)
+		fail(401, "Could not sign in with this identity")
+		return
+	}
+
+	_, hasTOTP, err := cfg.userHasTOTP(req.Context(), user.ID)
+	if err != nil {
+		log.Printf("Error loading TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if hasTOTP {
+		cfg.respondWithMFAChallenge(w, user.ID)
+		return
+	}
+
+	mapped, err := cfg.issueSession(req.Context(), user)
+	if err != nil {
+		log.Printf("Error issuing session: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordLogin(req.Context(), req, user.ID, "oidc")
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
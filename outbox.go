@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/webhooks"
+	"github.com/google/uuid"
+)
+
+const (
+	outboxSweepInterval = 15 * time.Second
+	maxOutboxBackoff    = 10 * time.Minute
+)
+
+// Events written to the outbox besides the webhook events.
+const (
+	eventSubscriptionStarted = "subscription.started"
+	eventSubscriptionExpired = "subscription.expired"
+)
+
+// inTx runs fn in a transaction and commits it if fn succeeds. Outbox
+// events written in fn are only visible once it commits, so the
+// dispatcher is woken afterwards.
+func (cfg *apiConfig) inTx(ctx context.Context, fn func(q *database.Queries) error) error {
+	tx, err := cfg.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(cfg.db.WithTx(tx))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	select {
+	case cfg.outboxWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeOutboxEvent records an event for the dispatcher. It must be called
+// with the Queries of the transaction that makes the change, so the event
+// exists exactly when the change does.
+func writeOutboxEvent(ctx context.Context, q *database.Queries, userID uuid.UUID, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return q.CreateOutboxEvent(ctx, database.CreateOutboxEventParams{
+		UserID : userID,
+		EventType : eventType,
+		Payload : payload,
+	})
+}
+
+// publishOutboxEvent hands an event to its consumers. Whatever they write
+// commits together with marking the event published, so a crash part way
+// through leaves the event to be published again rather than half done.
+func (cfg *apiConfig) publishOutboxEvent(ctx context.Context, event database.OutboxEvent) error {
+	queuedWebhooks := false
+	err := cfg.inTx(ctx, func(q *database.Queries) error {
+		if slices.Contains(webhooks.Events, event.EventType) {
+			err := queueWebhookDeliveries(ctx, q, event)
+			if err != nil {
+				return err
+			}
+			queuedWebhooks = true
+		}
+		// Transactions that took stream IDs from the sequence concurrently
+		// could commit out of order, and a stream client that had already
+		// seen the later ID would never see the earlier one. Publishing one
+		// at a time keeps the IDs in commit order.
+		err := q.LockStreamIDs(ctx)
+		if err != nil {
+			return err
+		}
+		err = q.PublishOutboxEvent(ctx, event.ID)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(streamEventTypes, event.EventType) {
+			return q.NotifyEventStream(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if queuedWebhooks {
+		select {
+		case cfg.webhookWake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// dispatchOutbox publishes every event that is due. An event is claimed
+// for a minute at a time, so one whose dispatcher died is picked up again,
+// and consumers may see an event more than once.
+func (cfg *apiConfig) dispatchOutbox(ctx context.Context) {
+	for {
+		event, err := cfg.db.ClaimOutboxEvent(ctx)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Error claiming outbox event: %s", err)
+			return
+		}
+
+		err = cfg.publishOutboxEvent(ctx, event)
+		if err == nil {
+			continue
+		}
+		log.Printf("Error publishing outbox event %s: %s", event.ID, err)
+		backoff := min(time.Second << min(event.Attempts, 10), maxOutboxBackoff)
+		err = cfg.db.FailOutboxEvent(ctx, database.FailOutboxEventParams{
+			ID : event.ID,
+			LastError : err.Error(),
+			NextAttemptAt : time.Now().Add(backoff),
+		})
+		if err != nil {
+			log.Printf("Error recording outbox failure: %s", err)
+		}
+	}
+}
+
+func (cfg *apiConfig) runOutboxDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastCleanup := time.Time{}
+	for {
+		cfg.dispatchOutbox(context.Background())
+		if time.Since(lastCleanup) > time.Hour {
+			err := cfg.db.DeleteOldOutboxEvents(context.Background())
+			if err != nil {
+				log.Printf("Error deleting old outbox events: %s", err)
+			}
+			lastCleanup = time.Now()
+		}
+		select {
+		case <-ticker.C:
+		case <-cfg.outboxWake:
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/mailer"
+)
+
+const (
+	tokenPurposePasswordReset = "password_reset"
+	passwordResetTokenTTL     = time.Hour
+)
+
+func (cfg *apiConfig) sendPasswordResetEmail(ctx context.Context, email string) error {
+	user, err := cfg.db.GetUserByEmail(ctx, email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, err := cfg.issueUserToken(ctx, user.ID, tokenPurposePasswordReset, passwordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To : user.Email,
+		Subject : "Reset your Chirpy password",
+		Body : fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\nUse this code within one hour to choose a new password:\n\n%s\n\nIf this wasn't you, you can ignore this email. Your password has not been changed.\n", token),
+	})
+}
+
+// passwordResetRetryAfter counts a reset request against the email and
+// the client IP, using the login limiters under their own keys so resets
+// do not lock anyone out of logging in, and returns how long to wait if
+// either is over.
+func (cfg *apiConfig) passwordResetRetryAfter(ctx context.Context, req *http.Request, email string) (time.Duration, error) {
+	emailKey := "reset:" + loginEmailKey(email)
+	ipKey := "reset:" + loginIPKey(req)
+	emailWait, _, err := cfg.loginEmailLimiter.Check(ctx, emailKey)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, _, err := cfg.loginIPLimiter.Check(ctx, ipKey)
+	if err != nil {
+		return 0, err
+	}
+	if wait := max(emailWait, ipWait); wait > 0 {
+		return wait, nil
+	}
+	_, err = cfg.loginEmailLimiter.Fail(ctx, emailKey)
+	if err != nil {
+		return 0, err
+	}
+	_, err = cfg.loginIPLimiter.Fail(ctx, ipKey)
+	return 0, err
+}
+
+func (cfg *apiConfig) handlePasswordResetRequest(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Email == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	// Requests are throttled per address and per client whether or not
+	// the address has an account, so the throttle reveals nothing either.
+	retryAfter, err := cfg.passwordResetRetryAfter(req.Context(), req, params.Email)
+	if err != nil {
+		log.Printf("Error checking password reset attempts: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
+		w.WriteHeader(429)
+		return
+	}
+
+	// The lookup and the email happen in the background so neither the
+	// response nor its timing reveals whether the address has an account.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+		defer cancel()
+		err := cfg.sendPasswordResetEmail(ctx, params.Email)
+		if err != nil {
+			log.Printf("Error sending password reset email: %s", err)
+		}
+	}()
+
+	w.WriteHeader(202)
+	return
+}
+
+func (cfg *apiConfig) handlePasswordResetConfirm(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+		Password string `json:"password"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+		Violations []string `json:"violations,omitempty"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Token == "" {
+		respBody := errResp{
+			Error : "Something went wrong",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	err = cfg.passwordPolicy.Check(params.Password)
+	if err != nil {
+		var policyErr *auth.PasswordPolicyError
+		if !errors.As(err, &policyErr) {
+			log.Printf("Error checking password policy: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		respBody := errResp{
+			Error : "Password does not meet requirements",
+			Violations : policyErr.Violations,
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	hashed, err := auth.HashPasswordWithParams(params.Password, cfg.hashParams)
+	if err != nil {
+		respBody := errResp{
+			Error : "Something went wrong",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	// The token is only spent if the password changes and every old
+	// session is revoked with it.
+	var userToken database.UserToken
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		var err error
+		userToken, err = q.ConsumeUserToken(req.Context(), database.ConsumeUserTokenParams{
+			TokenHash : auth.HashToken(params.Token),
+			Purpose : tokenPurposePasswordReset,
+		})
+		if err != nil {
+			return err
+		}
+		err = q.UpdateUserPassword(req.Context(), database.UpdateUserPasswordParams{
+			ID : userToken.UserID,
+			HashedPassword : sql.NullString{
+				String : hashed,
+				Valid : true,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = q.RevokeUserTokens(req.Context(), database.RevokeUserTokensParams{
+			UserID : userToken.UserID,
+			Purpose : tokenPurposePasswordReset,
+		})
+		if err != nil {
+			return err
+		}
+		return q.RevokeUserRefreshTokens(req.Context(), userToken.UserID)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		respBody := errResp{
+			Error : "Invalid or expired reset token",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	if err != nil {
+		log.Printf("Error resetting password: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	cfg.recordAudit(req.Context(), req, auditEntry{
+		UserID : userToken.UserID,
+		ActorType : actorUser,
+		ActorID : userToken.UserID,
+		Event : "user.password_reset",
+	})
+
+	w.WriteHeader(204)
+	return
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPolkaTolerance = 5 * time.Minute
+	maxPolkaBodyBytes     = 1 << 20
+)
+
+const polkaSource = "polka"
+
+var errPolkaUserNotFound = errors.New("user not found")
+
+type polkaEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserID    string     `json:"user_id"`
+		PeriodEnd *time.Time `json:"period_end"`
+	} `json:"data"`
+}
+
+// polkaEventID identifies a delivery for deduplication. Polka's payloads
+// usually have no id, and the body alone does not identify an event: an
+// upgrade after a downgrade looks exactly like the first upgrade. A signed
+// delivery is identified by its timestamp and signature, which a retry of
+// the same request repeats. Legacy unsigned deliveries are never treated
+// as duplicates.
+func polkaEventID(event polkaEvent, req *http.Request) string {
+	if event.ID != "" {
+		return event.ID
+	}
+	signature := req.Header.Get("X-Polka-Signature")
+	if signature == "" {
+		return "delivery:" + uuid.New().String()
+	}
+	sum := sha256.Sum256([]byte(signature))
+	return "signature:" + req.Header.Get("X-Polka-Timestamp") + ":" + hex.EncodeToString(sum[:])
+}
+
+// verifyPolkaRequest accepts a request signed with one of the webhook
+// secrets, or, as a legacy option while Polka is moved over, the static
+// POLKA_KEY. A request that carries a signature has to pass the signature
+// check; it never falls back to the key.
+func (cfg *apiConfig) verifyPolkaRequest(req *http.Request, body []byte) error {
+	timestamp := req.Header.Get("X-Polka-Timestamp")
+	signature := req.Header.Get("X-Polka-Signature")
+	if signature != "" || cfg.polkaKey == "" {
+		if len(cfg.polkaSecrets) == 0 {
+			return auth.ErrWebhookSignatureInvalid
+		}
+		return auth.VerifyWebhook(cfg.polkaSecrets, timestamp, signature, body, time.Now(), cfg.polkaTolerance)
+	}
+
+	polkaKey, err := auth.GetAPIKey(req.Header)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(polkaKey), []byte(cfg.polkaKey)) != 1 {
+		return auth.ErrWebhookSignatureInvalid
+	}
+	return nil
+}
+
+// processPolkaEvent applies a stored Polka event and returns the status it
+// should be recorded with. Events only change subscription periods;
+// is_chirpy_red follows from them.
+func (cfg *apiConfig) processPolkaEvent(ctx context.Context, req *http.Request, event database.WebhookEvent) (string, error) {
+	params := polkaEvent{}
+	err := json.Unmarshal(event.Payload, &params)
+	if err != nil {
+		return "", err
+	}
+
+	switch params.Event {
+	case "user.upgraded", "user.downgraded", "subscription.renewed", "payment.failed":
+	default:
+		return webhookEventIgnored, nil
+	}
+
+	userID, err := uuid.Parse(params.Data.UserID)
+	if err != nil {
+		return "", errPolkaUserNotFound
+	}
+	_, err = cfg.db.GetUserByID(ctx, userID)
+	if err == sql.ErrNoRows {
+		return "", errPolkaUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The periods and is_chirpy_red change together, so a failure leaves
+	// nothing behind for a retry to apply twice.
+	var changed []database.SyncChirpyRedRow
+	err = cfg.inTx(ctx, func(q *database.Queries) error {
+		var err error
+		switch params.Event {
+		case "user.upgraded":
+			err = extendSubscription(ctx, q, userID, event.ID, params.Data.PeriodEnd, false)
+		case "subscription.renewed":
+			err = extendSubscription(ctx, q, userID, event.ID, params.Data.PeriodEnd, true)
+		case "user.downgraded":
+			err = q.EndSubscriptionPeriods(ctx, userID)
+		case "payment.failed":
+			err = recordPaymentFailure(ctx, q, userID)
+		}
+		if err != nil {
+			return err
+		}
+		changed, err = syncChirpyRedTx(ctx, q, userID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	cfg.recordSubscriptionChanges(ctx, req, changed)
+
+	auditEvent := params.Event
+	if auditEvent == "payment.failed" {
+		auditEvent = "subscription.payment_failed"
+	}
+	cfg.recordAudit(ctx, req, auditEntry{
+		UserID : userID,
+		ActorType : actorPolka,
+		Event : auditEvent,
+		Metadata : map[string]string{
+			"webhook_event_id" : event.ID.String(),
+		},
+	})
+	return webhookEventProcessed, nil
+}
+
+func (cfg *apiConfig) handlePolkaWebhook(w http.ResponseWriter, req *http.Request) {
+	// The signature covers the exact bytes that were sent, so the body is
+	// read in full before it is decoded.
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPolkaBodyBytes))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	err = cfg.verifyPolkaRequest(req, body)
+	if err != nil {
+		log.Printf("Rejected Polka webhook: %s", err)
+		w.WriteHeader(401)
+		return
+	}
+
+	params := polkaEvent{}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	eventID := polkaEventID(params, req)
+	event, err := cfg.db.CreateWebhookEvent(req.Context(), database.CreateWebhookEventParams{
+		Source : polkaSource,
+		EventID : eventID,
+		EventType : params.Event,
+		Payload : body,
+	})
+	if err == sql.ErrNoRows {
+		// Polka retries until it gets a 2xx, so an event seen before is
+		// acknowledged and only processed again if the last attempt failed,
+		// or has been processing so long that it must have crashed.
+		var existing database.WebhookEvent
+		existing, err = cfg.db.GetWebhookEventByEventID(req.Context(), database.GetWebhookEventByEventIDParams{
+			Source : polkaSource,
+			EventID : eventID,
+		})
+		if err == nil {
+			event, err = cfg.db.ClaimWebhookEvent(req.Context(), existing.ID)
+			if err == sql.ErrNoRows {
+				w.WriteHeader(204)
+				return
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error recording webhook event: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	err = cfg.processWebhookEvent(req.Context(), req, event)
+	if errors.Is(err, errPolkaUserNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error processing webhook event %s: %s", event.ID, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(204)
+	return
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/stream"
+	"github.com/andrei-himself/chirpy/internal/webhooks"
+	"github.com/andrei-himself/chirpy/internal/websocket"
+	"github.com/google/uuid"
+)
+
+const (
+	signalChannel  = "chirpy_signals"
+	signalTyping   = "typing"
+	signalPresence = "presence"
+)
+
+const (
+	wsAuthTimeout    = 10 * time.Second
+	wsReadTimeout    = 60 * time.Second
+	wsPingInterval   = 25 * time.Second
+	wsWriteTimeout   = 10 * time.Second
+	wsMaxMessageSize = 16 * 1024
+	wsMaxChannels    = 50
+	wsTypingInterval = 2 * time.Second
+	// wsBlockCheckInterval is how long a connection trusts what it looked
+	// up about blocks between its user and a signal's sender.
+	wsBlockCheckInterval = 30 * time.Second
+	// wsCloseGrace is how long a peer has to answer our close frame before
+	// the connection is dropped.
+	wsCloseGrace     = 5 * time.Second
+)
+
+// Application close codes, in the range RFC 6455 leaves to applications.
+const (
+	wsCloseUnauthorized = 4001
+	wsCloseTokenExpired = 4002
+)
+
+type wsMessage struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Token   string    `json:"token,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	ChirpID uuid.UUID `json:"chirp_id,omitzero"`
+	Status  string    `json:"status,omitempty"`
+}
+
+type signal struct {
+	Type    string    `json:"type"`
+	UserID  uuid.UUID `json:"user_id"`
+	ChirpID uuid.UUID `json:"chirp_id,omitzero"`
+	Status  string    `json:"status,omitempty"`
+}
+
+// sendSignal shares a typing or presence signal with every replica. Signals
+// are not stored: a client that misses one just waits for the next.
+func (cfg *apiConfig) sendSignal(ctx context.Context, s signal) error {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return cfg.db.NotifySignal(ctx, string(payload))
+}
+
+func (cfg *apiConfig) forwardSignal(payload string) {
+	s := signal{}
+	err := json.Unmarshal([]byte(payload), &s)
+	if err != nil {
+		log.Printf("Error reading signal: %s", err)
+		return
+	}
+	cfg.streamHub.Publish(stream.Event{
+		Type : s.Type,
+		UserID : s.UserID,
+		ChirpID : s.ChirpID,
+		Data : []byte(payload),
+	})
+}
+
+// parseChannel checks a channel name and returns it in canonical form.
+// Channels are timeline, notifications, messages, chirp:<id> for a chirp's
+// thread and presence:<user id>.
+func parseChannel(channel string) (string, bool) {
+	if channel == "timeline" || channel == "notifications" || channel == "messages" {
+		return channel, true
+	}
+	kind, id, found := strings.Cut(channel, ":")
+	if !found || (kind != "chirp" && kind != "presence") {
+		return "", false
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", false
+	}
+	return kind + ":" + parsed.String(), true
+}
+
+func channelMatches(channel string, userID uuid.UUID, e stream.Event) bool {
+	switch channel {
+	case "timeline":
+		return e.Type == webhooks.EventChirpCreated || e.Type == webhooks.EventChirpDeleted
+	case "notifications":
+		return e.Type == eventNotificationCreated && e.UserID == userID
+	case "messages":
+		return slices.Contains(messageEventTypes, e.Type) && e.UserID == userID
+	}
+	kind, id, _ := strings.Cut(channel, ":")
+	switch kind {
+	case "chirp":
+		return (e.Type == webhooks.EventChirpDeleted || e.Type == signalTyping) && e.ChirpID.String() == id
+	case "presence":
+		return e.Type == signalPresence && e.UserID.String() == id
+	}
+	return false
+}
+
+// wsClient is one WebSocket connection. The reader goroutine changes its
+// user and channels; the hub reads them to pick the connection's events.
+type wsClient struct {
+	conn *websocket.Conn
+
+	mu         sync.Mutex
+	userID     uuid.UUID
+	channels   map[string]bool
+	// expiresAt is when the token, or for a connection that has not
+	// authenticated yet the time allowed to do so, runs out.
+	expiresAt  time.Time
+	expiry     *time.Timer
+	closing    bool
+	lastTyping time.Time
+	present    bool
+}
+
+func (c *wsClient) matchingChannels(e stream.Event) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	matches := []string{}
+	if time.Now().After(c.expiresAt) {
+		return matches
+	}
+	for channel := range c.channels {
+		if channelMatches(channel, c.userID, e) {
+			matches = append(matches, channel)
+		}
+	}
+	return matches
+}
+
+func (c *wsClient) send(v any) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		return
+	}
+	_ = c.conn.WriteMessage(websocket.TextMessage, dat)
+}
+
+func (c *wsClient) sendError(id, message string) {
+	c.send(struct {
+		Type  string `json:"type"`
+		ID    string `json:"id,omitempty"`
+		Error string `json:"error"`
+	}{"error", id, message})
+}
+
+// authenticate accepts the token for the connection's user and closes the
+// connection when it expires, unless the client sends a newer one first.
+// Once the connection is closing it is too late.
+func (c *wsClient) authenticate(userID uuid.UUID, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing || (c.userID != uuid.Nil && c.userID != userID) {
+		return false
+	}
+	c.userID = userID
+	c.closeAt(expiresAt, wsCloseTokenExpired, "token expired")
+	return true
+}
+
+// closeAt sends a close frame at t, and drops the connection wsCloseGrace
+// later so a client that ignores the frame cannot keep it open. c.mu must
+// be held.
+func (c *wsClient) closeAt(t time.Time, code int, text string) {
+	c.expiresAt = t
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+	c.expiry = time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.closing = true
+		c.mu.Unlock()
+		c.conn.WriteClose(code, text)
+		time.AfterFunc(wsCloseGrace, func() {
+			c.conn.Close()
+		})
+	})
+}
+
+// user returns the authenticated user, or uuid.Nil if there is none or
+// their token has expired.
+func (c *wsClient) user() uuid.UUID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().After(c.expiresAt) {
+		return uuid.Nil
+	}
+	return c.userID
+}
+
+// writeEvents sends the connection's events and keeps it alive with pings
+// until done is closed. Signals for which hidden returns true are dropped.
+func (c *wsClient) writeEvents(sub *stream.Subscription, hidden func(stream.Event) bool, done <-chan struct{}) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				c.conn.WriteClose(websocket.CloseTryAgainLater, "too far behind")
+				return
+			}
+			channels := c.matchingChannels(e)
+			if len(channels) > 0 && hidden(e) {
+				continue
+			}
+			for _, channel := range channels {
+				c.send(struct {
+					Type    string          `json:"type"`
+					Channel string          `json:"channel"`
+					Event   string          `json:"event"`
+					ID      int64           `json:"id,omitempty"`
+					Data    json.RawMessage `json:"data"`
+				}{"event", channel, e.Type, e.ID, e.Data})
+			}
+		case <-ping.C:
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// blockedSignals returns a filter, for one connection's writer, that hides
+// typing and presence from anyone on either side of a block with the
+// connection's user. Signals are frequent, so what it looks up is kept for
+// wsBlockCheckInterval per sender. If the lookup fails the signal is
+// hidden.
+func (cfg *apiConfig) blockedSignals(client *wsClient) func(stream.Event) bool {
+	type blockCheck struct {
+		blocked   bool
+		checkedAt time.Time
+	}
+	checks := map[uuid.UUID]blockCheck{}
+	return func(e stream.Event) bool {
+		if e.Type != signalTyping && e.Type != signalPresence {
+			return false
+		}
+		userID := client.user()
+		if userID == uuid.Nil || e.UserID == userID {
+			return false
+		}
+		check, ok := checks[e.UserID]
+		if ok && time.Since(check.checkedAt) < wsBlockCheckInterval {
+			return check.blocked
+		}
+		blocked, err := cfg.db.HasBlockBetween(context.Background(), database.HasBlockBetweenParams{
+			UserID : userID,
+			OtherIds : []uuid.UUID{e.UserID},
+		})
+		if err != nil {
+			log.Printf("Error checking blocks: %s", err)
+			return true
+		}
+		checks[e.UserID] = blockCheck{
+			blocked : blocked,
+			checkedAt : time.Now(),
+		}
+		return blocked
+	}
+}
+
+// handleWebSocket serves one multiplexed connection. It authenticates with
+// an access token, in the Authorization header or, for clients that cannot
+// set headers, an auth message sent first. Tokens are never read from the
+// URL, where they would end up in logs.
+func (cfg *apiConfig) handleWebSocket(w http.ResponseWriter, req *http.Request) {
+	userID := uuid.Nil
+	expiresAt := time.Now().Add(wsAuthTimeout)
+	if req.Header.Get("Authorization") != "" {
+		accessToken, err := auth.GetBearerToken(req.Header)
+		if err != nil || accessToken == "" {
+			w.WriteHeader(401)
+			return
+		}
+		userID, expiresAt, err = cfg.keys.ValidateJWTWithExpiry(accessToken)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+			w.WriteHeader(401)
+			return
+		}
+	}
+
+	conn, err := websocket.Upgrade(w, req)
+	if err != nil {
+		if !errors.Is(err, websocket.ErrBadHandshake) {
+			log.Printf("Error upgrading to WebSocket: %s", err)
+		}
+		return
+	}
+	defer conn.Close()
+	conn.MaxMessageSize = wsMaxMessageSize
+	conn.ReadTimeout = wsReadTimeout
+	conn.WriteTimeout = wsWriteTimeout
+
+	client := &wsClient{
+		conn : conn,
+		channels : map[string]bool{},
+	}
+	if userID != uuid.Nil {
+		client.authenticate(userID, expiresAt)
+	} else {
+		client.mu.Lock()
+		client.closeAt(expiresAt, wsCloseUnauthorized, "authentication required")
+		client.mu.Unlock()
+	}
+
+	sub := cfg.streamHub.Subscribe(func(e stream.Event) bool {
+		return len(client.matchingChannels(e)) > 0
+	})
+	done := make(chan struct{})
+	go client.writeEvents(sub, cfg.blockedSignals(client), done)
+	defer func() {
+		close(done)
+		sub.Close()
+		client.mu.Lock()
+		client.expiry.Stop()
+		present := client.present
+		presentUserID := client.userID
+		client.mu.Unlock()
+		if present {
+			err := cfg.sendSignal(context.Background(), signal{
+				Type : signalPresence,
+				UserID : presentUserID,
+				Status : "offline",
+			})
+			if err != nil {
+				log.Printf("Error sending presence: %s", err)
+			}
+		}
+	}()
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			conn.WriteClose(websocket.CloseUnsupportedData, "expected text messages")
+			continue
+		}
+		msg := wsMessage{}
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			client.sendError("", "Invalid JSON")
+			continue
+		}
+		cfg.handleWebSocketMessage(req.Context(), client, msg)
+	}
+}
+
+func (cfg *apiConfig) handleWebSocketMessage(ctx context.Context, client *wsClient, msg wsMessage) {
+	if msg.Type == "auth" {
+		userID, expiresAt, err := cfg.keys.ValidateJWTWithExpiry(msg.Token)
+		if err != nil {
+			client.sendError(msg.ID, tokenErrorMessage(err))
+			return
+		}
+		if !client.authenticate(userID, expiresAt) {
+			client.sendError(msg.ID, "Token is for a different user")
+			return
+		}
+		client.send(struct {
+			Type      string    `json:"type"`
+			ID        string    `json:"id,omitempty"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{"authenticated", msg.ID, expiresAt})
+		return
+	}
+
+	userID := client.user()
+	if userID == uuid.Nil {
+		client.sendError(msg.ID, "Authenticate first")
+		return
+	}
+
+	switch msg.Type {
+	case "subscribe", "unsubscribe":
+		channel, ok := parseChannel(msg.Channel)
+		if !ok {
+			client.sendError(msg.ID, "Unknown channel")
+			return
+		}
+		// Blocked users cannot watch each other's presence. Signals from
+		// them on other channels are dropped as they are sent.
+		kind, id, _ := strings.Cut(channel, ":")
+		if msg.Type == "subscribe" && kind == "presence" {
+			blocked, err := cfg.db.HasBlockBetween(ctx, database.HasBlockBetweenParams{
+				UserID : userID,
+				OtherIds : []uuid.UUID{uuid.MustParse(id)},
+			})
+			if err != nil {
+				log.Printf("Error checking blocks: %s", err)
+				client.sendError(msg.ID, "Something went wrong")
+				return
+			}
+			if blocked {
+				client.sendError(msg.ID, "Channel not available")
+				return
+			}
+		}
+		client.mu.Lock()
+		tooMany := msg.Type == "subscribe" && !client.channels[channel] && len(client.channels) >= wsMaxChannels
+		switch {
+		case msg.Type == "unsubscribe":
+			delete(client.channels, channel)
+		case !tooMany:
+			client.channels[channel] = true
+		}
+		client.mu.Unlock()
+		if tooMany {
+			client.sendError(msg.ID, "Too many channels")
+			return
+		}
+		client.send(struct {
+			Type    string `json:"type"`
+			ID      string `json:"id,omitempty"`
+			Channel string `json:"channel"`
+		}{msg.Type + "d", msg.ID, channel})
+
+	case signalTyping:
+		if msg.ChirpID == uuid.Nil {
+			client.sendError(msg.ID, "chirp_id is required")
+			return
+		}
+		// Typing is sent on every keystroke by some clients; passing on
+		// one every couple of seconds is enough to show the indicator.
+		client.mu.Lock()
+		skip := time.Since(client.lastTyping) < wsTypingInterval
+		if !skip {
+			client.lastTyping = time.Now()
+		}
+		client.mu.Unlock()
+		if skip {
+			return
+		}
+		err := cfg.sendSignal(ctx, signal{
+			Type : signalTyping,
+			UserID : userID,
+			ChirpID : msg.ChirpID,
+		})
+		if err != nil {
+			log.Printf("Error sending typing signal: %s", err)
+		}
+
+	case signalPresence:
+		if msg.Status != "online" && msg.Status != "away" {
+			client.sendError(msg.ID, "status must be online or away")
+			return
+		}
+		client.mu.Lock()
+		client.present = true
+		client.mu.Unlock()
+		err := cfg.sendSignal(ctx, signal{
+			Type : signalPresence,
+			UserID : userID,
+			Status : msg.Status,
+		})
+		if err != nil {
+			log.Printf("Error sending presence: %s", err)
+		}
+
+	default:
+		client.sendError(msg.ID, "Unknown message type")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"github.com/google/uuid"
+)
+
+type requestIDKey struct{}
+
+// validRequestID limits which incoming X-Request-ID values are kept, so a
+// client cannot put arbitrary text into logs and the audit trail.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// middlewareRequestID tags every request with an ID, reusing the one set
+// by a proxy in front of Chirpy when there is one, and echoes it back so
+// a user can quote it when reporting a problem.
+func middlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,38 @@
+-- name: CreateAuditEvent :exec
+INSERT INTO audit_events (id, created_at, user_id, event, ip, user_agent, actor_type, actor_id, request_id, metadata)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8
+);
+
+-- name: ListUserAuditEvents :many
+SELECT * FROM audit_events
+WHERE user_id = $1
+ORDER BY created_at ASC;
+
+-- name: ListAuditEvents :many
+SELECT * FROM audit_events
+WHERE (sqlc.narg('user_id')::uuid IS NULL OR user_id = sqlc.narg('user_id'))
+AND (sqlc.narg('actor_id')::uuid IS NULL OR actor_id = sqlc.narg('actor_id'))
+AND (sqlc.narg('event')::text IS NULL OR event = sqlc.narg('event'))
+AND (sqlc.narg('since')::timestamp IS NULL OR created_at >= sqlc.narg('since'))
+AND (sqlc.narg('before')::timestamp IS NULL OR created_at < sqlc.narg('before'))
+ORDER BY created_at DESC
+LIMIT sqlc.arg('limit');
+
+-- name: ClearScheduledUsersAuditMetadata :exec
+UPDATE audit_events
+SET metadata = '{}'
+WHERE user_id IN (
+    SELECT id FROM users
+    WHERE deletion_scheduled_at <= NOW()
+)
+AND metadata <> '{}';
@@ -0,0 +1,67 @@
+-- name: CreateConversation :one
+INSERT INTO conversations (id, created_at, updated_at, direct_key)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1
+)
+ON CONFLICT (direct_key) DO NOTHING
+RETURNING *;
+
+-- name: GetDirectConversation :one
+SELECT * FROM conversations
+WHERE direct_key = $1;
+
+-- name: GetConversationForUser :one
+SELECT conversations.* FROM conversations
+JOIN conversation_participants ON conversation_participants.conversation_id = conversations.id
+WHERE conversations.id = $1
+AND conversation_participants.user_id = $2;
+
+-- name: ListConversations :many
+SELECT conversations.* FROM conversations
+JOIN conversation_participants ON conversation_participants.conversation_id = conversations.id
+WHERE conversation_participants.user_id = sqlc.arg('user_id')
+AND (sqlc.narg('before')::timestamp IS NULL OR conversations.updated_at < sqlc.narg('before'))
+ORDER BY conversations.updated_at DESC
+LIMIT sqlc.arg('limit');
+
+-- name: TouchConversation :exec
+UPDATE conversations
+SET updated_at = NOW()
+WHERE id = $1;
+
+-- name: DeleteEmptyConversation :exec
+DELETE FROM conversations
+WHERE id = $1
+AND NOT EXISTS (
+    SELECT 1 FROM conversation_participants
+    WHERE conversation_id = $1
+);
+
+-- name: AddConversationParticipant :exec
+INSERT INTO conversation_participants (conversation_id, user_id, joined_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (conversation_id, user_id) DO NOTHING;
+
+-- name: ListConversationParticipants :many
+SELECT * FROM conversation_participants
+WHERE conversation_id = ANY(sqlc.arg('conversation_ids')::uuid[])
+ORDER BY joined_at ASC, user_id ASC;
+
+-- name: RemoveConversationParticipant :execrows
+DELETE FROM conversation_participants
+WHERE conversation_id = $1
+AND user_id = $2;
+
+-- name: MarkConversationRead :exec
+UPDATE conversation_participants
+SET last_read_message_id = messages.id,
+last_read_at = messages.created_at
+FROM messages
+WHERE conversation_participants.conversation_id = sqlc.arg('conversation_id')
+AND conversation_participants.user_id = sqlc.arg('user_id')
+AND messages.id = sqlc.arg('message_id')
+AND messages.conversation_id = conversation_participants.conversation_id
+AND (conversation_participants.last_read_at IS NULL OR messages.created_at > conversation_participants.last_read_at);
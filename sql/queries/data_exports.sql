@@ -0,0 +1,65 @@
+-- name: CreateDataExport :one
+INSERT INTO data_exports (id, created_at, user_id, status)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    'pending'
+)
+RETURNING *;
+
+-- name: GetDataExport :one
+SELECT * FROM data_exports
+WHERE id = $1
+AND user_id = $2;
+
+-- name: GetUnfinishedDataExport :one
+SELECT * FROM data_exports
+WHERE user_id = $1
+AND status IN ('pending', 'building')
+ORDER BY created_at DESC
+LIMIT 1;
+
+-- name: ClaimDataExport :one
+UPDATE data_exports
+SET
+status = 'building',
+started_at = NOW()
+WHERE id = (
+    SELECT id FROM data_exports
+    WHERE status = 'pending'
+    OR (status = 'building' AND started_at < NOW() - INTERVAL '10 minutes')
+    ORDER BY created_at ASC
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: SaveDataExportArchive :exec
+INSERT INTO data_export_archives (export_id, archive)
+VALUES ($1, $2)
+ON CONFLICT (export_id) DO UPDATE SET archive = EXCLUDED.archive;
+
+-- name: CompleteDataExport :exec
+UPDATE data_exports
+SET
+status = 'ready',
+completed_at = NOW(),
+expires_at = $2
+WHERE id = $1;
+
+-- name: FailDataExport :exec
+UPDATE data_exports
+SET
+status = 'failed',
+completed_at = NOW()
+WHERE id = $1;
+
+-- name: GetDataExportArchive :one
+SELECT archive FROM data_export_archives
+WHERE export_id = $1;
+
+-- name: DeleteExpiredDataExports :exec
+DELETE FROM data_exports
+WHERE expires_at < NOW()
+OR (status = 'failed' AND completed_at < NOW() - INTERVAL '7 days');
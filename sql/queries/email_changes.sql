@@ -0,0 +1,51 @@
+-- name: CreateEmailChange :one
+INSERT INTO email_changes (id, created_at, user_id, old_email, new_email, confirm_token_hash, confirm_expires_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+)
+RETURNING *;
+
+-- name: CancelEmailChanges :exec
+UPDATE email_changes
+SET confirm_expires_at = NOW()
+WHERE user_id = $1
+AND confirmed_at IS NULL
+AND confirm_expires_at > NOW();
+
+-- name: ConfirmEmailChange :one
+UPDATE email_changes
+SET
+confirmed_at = NOW(),
+revert_token_hash = $2,
+revert_expires_at = $3
+WHERE confirm_token_hash = $1
+AND confirmed_at IS NULL
+AND confirm_expires_at > NOW()
+RETURNING *;
+
+-- name: GetRevertableEmailChange :one
+SELECT * FROM email_changes
+WHERE revert_token_hash = $1
+AND reverted_at IS NULL
+AND revert_expires_at > NOW();
+
+-- name: RevertEmailChange :one
+UPDATE email_changes
+SET reverted_at = NOW()
+WHERE revert_token_hash = $1
+AND reverted_at IS NULL
+AND revert_expires_at > NOW()
+RETURNING *;
+
+-- name: ExpireEmailChangeReverts :exec
+UPDATE email_changes
+SET revert_expires_at = NOW()
+WHERE user_id = $1
+AND reverted_at IS NULL
+AND revert_expires_at > NOW();
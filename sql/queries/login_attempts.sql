@@ -0,0 +1,32 @@
+-- name: GetLoginAttempt :one
+SELECT * FROM login_attempts WHERE key = $1;
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_attempts (key, failures, window_started_at, last_failure_at)
+VALUES (
+    $1,
+    1,
+    NOW(),
+    NOW()
+)
+ON CONFLICT (key) DO UPDATE
+SET
+failures = CASE WHEN login_attempts.window_started_at < sqlc.arg(window_start) THEN 1 ELSE login_attempts.failures + 1 END,
+window_started_at = CASE WHEN login_attempts.window_started_at < sqlc.arg(window_start) THEN NOW() ELSE login_attempts.window_started_at END,
+last_failure_at = NOW()
+RETURNING *;
+
+-- name: LockLoginAttempt :exec
+INSERT INTO login_attempts (key, failures, window_started_at, last_failure_at, locked_until)
+VALUES (
+    $1,
+    0,
+    NOW(),
+    NOW(),
+    $2
+)
+ON CONFLICT (key) DO UPDATE
+SET locked_until = EXCLUDED.locked_until;
+
+-- name: DeleteLoginAttempt :exec
+DELETE FROM login_attempts WHERE key = $1;
\ No newline at end of file
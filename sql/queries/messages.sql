@@ -0,0 +1,69 @@
+-- name: CreateMessage :one
+INSERT INTO messages (id, created_at, updated_at, conversation_id, sender_id, body)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3
+)
+RETURNING *;
+
+-- name: GetMessage :one
+SELECT * FROM messages
+WHERE id = $1
+AND conversation_id = $2;
+
+-- name: GetLatestMessage :one
+SELECT * FROM messages
+WHERE conversation_id = $1
+ORDER BY created_at DESC, id DESC
+LIMIT 1;
+
+-- name: ListMessages :many
+SELECT * FROM messages
+WHERE conversation_id = sqlc.arg('conversation_id')
+AND NOT EXISTS (
+    SELECT 1 FROM user_blocks
+    WHERE blocker_id = sqlc.arg('reader_id')
+    AND blocked_id = messages.sender_id
+)
+AND (
+    sqlc.narg('before_id')::uuid IS NULL
+    OR (created_at, id) < (SELECT m.created_at, m.id FROM messages m WHERE m.id = sqlc.narg('before_id'))
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('limit');
+
+-- name: CountUnreadMessages :many
+SELECT conversation_participants.conversation_id, COUNT(messages.id) AS unread_count
+FROM conversation_participants
+JOIN messages ON messages.conversation_id = conversation_participants.conversation_id
+WHERE conversation_participants.user_id = sqlc.arg('user_id')
+AND conversation_participants.conversation_id = ANY(sqlc.arg('conversation_ids')::uuid[])
+AND messages.sender_id <> conversation_participants.user_id
+AND messages.deleted_at IS NULL
+AND (conversation_participants.last_read_at IS NULL OR messages.created_at > conversation_participants.last_read_at)
+AND NOT EXISTS (
+    SELECT 1 FROM user_blocks
+    WHERE blocker_id = conversation_participants.user_id
+    AND blocked_id = messages.sender_id
+)
+GROUP BY conversation_participants.conversation_id;
+
+-- name: ListMessagesBySender :many
+SELECT * FROM messages
+WHERE sender_id = $1
+AND deleted_at IS NULL
+ORDER BY created_at ASC;
+
+-- name: DeleteMessage :execrows
+UPDATE messages
+SET body = '',
+deleted_at = NOW(),
+updated_at = NOW()
+WHERE id = $1
+AND conversation_id = $2
+AND sender_id = $3
+AND deleted_at IS NULL;
@@ -0,0 +1,56 @@
+-- name: CreateNotification :one
+INSERT INTO notifications (id, created_at, updated_at, user_id, type, chirp_id, actor_ids)
+SELECT
+    gen_random_uuid(),
+    NOW(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    ARRAY[sqlc.arg('actor_id')::uuid]
+WHERE NOT EXISTS (
+    SELECT 1 FROM notification_preferences
+    WHERE user_id = $1
+    AND type = $2
+    AND NOT enabled
+)
+ON CONFLICT (user_id, type, COALESCE(chirp_id, '00000000-0000-0000-0000-000000000000')) WHERE read_at IS NULL
+DO UPDATE SET
+updated_at = NOW(),
+actor_ids = EXCLUDED.actor_ids || array_remove(notifications.actor_ids, EXCLUDED.actor_ids[1])
+RETURNING *;
+
+-- name: ListNotifications :many
+SELECT * FROM notifications
+WHERE user_id = $1
+AND (NOT sqlc.arg('unread_only')::boolean OR read_at IS NULL)
+AND (sqlc.narg('before')::timestamp IS NULL OR updated_at < sqlc.narg('before'))
+ORDER BY updated_at DESC
+LIMIT sqlc.arg('limit');
+
+-- name: CountUnreadNotifications :one
+SELECT COUNT(*) FROM notifications
+WHERE user_id = $1
+AND read_at IS NULL;
+
+-- name: MarkNotificationRead :execrows
+UPDATE notifications
+SET read_at = COALESCE(read_at, NOW())
+WHERE id = $1
+AND user_id = $2;
+
+-- name: MarkAllNotificationsRead :exec
+UPDATE notifications
+SET read_at = NOW()
+WHERE user_id = $1
+AND read_at IS NULL;
+
+-- name: ListNotificationPreferences :many
+SELECT * FROM notification_preferences
+WHERE user_id = $1;
+
+-- name: SetNotificationPreference :exec
+INSERT INTO notification_preferences (user_id, type, enabled)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id, type)
+DO UPDATE SET enabled = EXCLUDED.enabled;
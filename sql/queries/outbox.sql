@@ -0,0 +1,63 @@
+-- name: CreateOutboxEvent :exec
+INSERT INTO outbox_events (id, created_at, user_id, event_type, payload, next_attempt_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    NOW()
+);
+
+-- name: ClaimOutboxEvent :one
+UPDATE outbox_events
+SET
+attempts = attempts + 1,
+next_attempt_at = NOW() + INTERVAL '1 minute'
+WHERE id = (
+    SELECT id FROM outbox_events
+    WHERE published_at IS NULL
+    AND next_attempt_at <= NOW()
+    ORDER BY created_at ASC
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: LockStreamIDs :exec
+SELECT pg_advisory_xact_lock(hashtext('outbox_stream_seq'));
+
+-- name: PublishOutboxEvent :exec
+UPDATE outbox_events
+SET
+published_at = NOW(),
+stream_id = nextval('outbox_stream_seq'),
+last_error = ''
+WHERE id = $1;
+
+-- name: FailOutboxEvent :exec
+UPDATE outbox_events
+SET
+last_error = $2,
+next_attempt_at = $3
+WHERE id = $1;
+
+-- name: DeleteOldOutboxEvents :exec
+DELETE FROM outbox_events
+WHERE published_at < NOW() - INTERVAL '7 days';
+
+-- name: NotifyEventStream :exec
+SELECT pg_notify('chirpy_events', '');
+
+-- name: NotifySignal :exec
+SELECT pg_notify('chirpy_signals', sqlc.arg('payload')::text);
+
+-- name: GetLatestStreamID :one
+SELECT COALESCE(MAX(stream_id), 0)::bigint AS stream_id FROM outbox_events;
+
+-- name: ListStreamEvents :many
+SELECT * FROM outbox_events
+WHERE stream_id > sqlc.arg('after')::bigint
+AND event_type = ANY(sqlc.arg('event_types')::text[])
+ORDER BY stream_id ASC
+LIMIT sqlc.arg('limit');
@@ -17,4 +17,39 @@ UPDATE refresh_tokens
 SET 
 revoked_at = NOW(),
 updated_at = NOW()
-WHERE token = $1;
\ No newline at end of file
+WHERE token = $1;
+
+-- name: RevokeUserRefreshTokens :exec
+UPDATE refresh_tokens
+SET
+revoked_at = NOW(),
+updated_at = NOW()
+WHERE user_id = $1
+AND revoked_at IS NULL;
+
+-- name: CreateOAuthRefreshToken :exec
+INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at, client_id, scopes)
+VALUES (
+    $1,
+    NOW(),
+    NOW(),
+    $2,
+    $3,
+    $4,
+    $5
+);
+
+-- name: ConsumeOAuthRefreshToken :one
+UPDATE refresh_tokens
+SET
+revoked_at = NOW(),
+updated_at = NOW()
+WHERE token = $1
+AND client_id = $2
+AND revoked_at IS NULL
+RETURNING *;
+
+-- name: ListUserRefreshTokens :many
+SELECT * FROM refresh_tokens
+WHERE user_id = $1
+ORDER BY created_at ASC;
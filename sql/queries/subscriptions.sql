@@ -0,0 +1,50 @@
+-- name: CreateSubscriptionPeriod :one
+INSERT INTO subscription_periods (id, created_at, user_id, starts_at, ends_at, webhook_event_id)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4
+)
+ON CONFLICT (webhook_event_id) DO NOTHING
+RETURNING *;
+
+-- name: GetLatestSubscriptionPeriod :one
+SELECT * FROM subscription_periods
+WHERE user_id = $1
+ORDER BY ends_at DESC NULLS FIRST
+LIMIT 1;
+
+-- name: ListUserSubscriptionPeriods :many
+SELECT * FROM subscription_periods
+WHERE user_id = $1
+ORDER BY starts_at ASC;
+
+-- name: EndSubscriptionPeriods :exec
+UPDATE subscription_periods
+SET ends_at = GREATEST(starts_at, NOW())
+WHERE user_id = $1
+AND (ends_at IS NULL OR ends_at > NOW());
+
+-- name: MarkSubscriptionPaymentFailed :exec
+UPDATE subscription_periods
+SET
+payment_failed_at = NOW(),
+ends_at = $2
+WHERE id = $1;
+
+-- name: SyncChirpyRed :many
+UPDATE users
+SET
+is_chirpy_red = NOT is_chirpy_red,
+updated_at = NOW()
+WHERE is_chirpy_red <> EXISTS (
+    SELECT 1 FROM subscription_periods p
+    WHERE p.user_id = users.id
+    AND p.starts_at <= NOW()
+    AND (p.ends_at IS NULL OR p.ends_at > NOW())
+)
+AND (sqlc.narg('user_id')::uuid IS NULL OR id = sqlc.narg('user_id'))
+RETURNING id, is_chirpy_red;
@@ -0,0 +1,26 @@
+-- name: BlockUser :exec
+INSERT INTO user_blocks (blocker_id, blocked_id, created_at)
+VALUES ($1, $2, NOW())
+ON CONFLICT (blocker_id, blocked_id) DO NOTHING;
+
+-- name: UnblockUser :exec
+DELETE FROM user_blocks
+WHERE blocker_id = $1
+AND blocked_id = $2;
+
+-- name: ListBlockedUsers :many
+SELECT * FROM user_blocks
+WHERE blocker_id = $1
+ORDER BY created_at DESC;
+
+-- name: ListBlockersAmong :many
+SELECT blocker_id FROM user_blocks
+WHERE blocked_id = sqlc.arg('blocked_id')
+AND blocker_id = ANY(sqlc.arg('user_ids')::uuid[]);
+
+-- name: HasBlockBetween :one
+SELECT EXISTS (
+    SELECT 1 FROM user_blocks
+    WHERE (blocker_id = sqlc.arg('user_id') AND blocked_id = ANY(sqlc.arg('other_ids')::uuid[]))
+    OR (blocked_id = sqlc.arg('user_id') AND blocker_id = ANY(sqlc.arg('other_ids')::uuid[]))
+);
@@ -0,0 +1,26 @@
+-- name: CreateUserToken :one
+INSERT INTO user_tokens (token_hash, created_at, user_id, purpose, expires_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: ConsumeUserToken :one
+UPDATE user_tokens
+SET used_at = NOW()
+WHERE token_hash = $1
+AND purpose = $2
+AND used_at IS NULL
+AND expires_at > NOW()
+RETURNING *;
+
+-- name: RevokeUserTokens :exec
+UPDATE user_tokens
+SET used_at = NOW()
+WHERE user_id = $1
+AND purpose = $2
+AND used_at IS NULL;
\ No newline at end of file
@@ -15,16 +15,54 @@ DELETE FROM users;
 -- name: GetUserByEmail :one
 SELECT * FROM users WHERE email = $1;
 
--- name: UpdateUserPwAndEmail :one
+-- name: UpdateUserEmail :exec
 UPDATE users
-SET 
+SET
+email = $2,
+email_verified_at = NOW(),
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: GetUserByID :one
+SELECT * FROM users WHERE id = $1;
+
+-- name: VerifyUserEmail :exec
+UPDATE users
+SET
+email_verified_at = NOW(),
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET
 hashed_password = $2,
-email = $3,
 updated_at = NOW()
-WHERE id = $1
-RETURNING *;
+WHERE id = $1;
 
--- name: UpgradeUser :exec
+-- name: RehashUserPassword :exec
 UPDATE users
-SET is_chirpy_red = true
-WHERE id = $1;
\ No newline at end of file
+SET
+hashed_password = $2,
+updated_at = NOW()
+WHERE id = $1 AND hashed_password = $3;
+
+-- name: ScheduleUserDeletion :exec
+UPDATE users
+SET
+deletion_scheduled_at = $2,
+updated_at = NOW()
+WHERE id = $1;
+
+-- name: CancelUserDeletion :execrows
+UPDATE users
+SET
+deletion_scheduled_at = NULL,
+updated_at = NOW()
+WHERE id = $1
+AND deletion_scheduled_at IS NOT NULL;
+
+-- name: DeleteScheduledUsers :many
+DELETE FROM users
+WHERE deletion_scheduled_at <= NOW()
+RETURNING id, email;
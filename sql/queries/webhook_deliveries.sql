@@ -0,0 +1,61 @@
+-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_deliveries (id, created_at, endpoint_id, event_id, event_type, payload, status, next_attempt_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    'pending',
+    NOW()
+);
+
+-- name: ClaimWebhookDelivery :one
+UPDATE webhook_deliveries
+SET
+status = 'delivering',
+attempts = attempts + 1,
+last_attempt_at = NOW()
+WHERE id = (
+    SELECT id FROM webhook_deliveries
+    WHERE (status = 'pending' AND next_attempt_at <= NOW())
+    OR (status = 'delivering' AND last_attempt_at < NOW() - INTERVAL '5 minutes')
+    ORDER BY next_attempt_at ASC
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: FinishWebhookDelivery :exec
+UPDATE webhook_deliveries
+SET
+status = $2,
+response_status = $3,
+last_error = $4,
+next_attempt_at = $5,
+delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() END
+WHERE id = $1;
+
+-- name: ListWebhookDeliveries :many
+SELECT * FROM webhook_deliveries
+WHERE endpoint_id = $1
+AND (sqlc.narg('before')::timestamp IS NULL OR created_at < sqlc.narg('before'))
+ORDER BY created_at DESC
+LIMIT sqlc.arg('limit');
+
+-- name: RetryWebhookDelivery :one
+UPDATE webhook_deliveries
+SET
+status = 'pending',
+attempts = 0,
+next_attempt_at = NOW()
+WHERE id = $1
+AND endpoint_id = $2
+AND status = 'dead'
+RETURNING *;
+
+-- name: DeleteOldWebhookDeliveries :exec
+DELETE FROM webhook_deliveries
+WHERE created_at < NOW() - INTERVAL '30 days'
+AND status IN ('succeeded', 'dead');
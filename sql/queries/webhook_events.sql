@@ -0,0 +1,52 @@
+-- name: CreateWebhookEvent :one
+INSERT INTO webhook_events (id, received_at, source, event_id, event_type, payload, status, started_at)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4,
+    'processing',
+    NOW()
+)
+ON CONFLICT (source, event_id) DO NOTHING
+RETURNING *;
+
+-- name: GetWebhookEvent :one
+SELECT * FROM webhook_events
+WHERE id = $1;
+
+-- name: GetWebhookEventByEventID :one
+SELECT * FROM webhook_events
+WHERE source = $1
+AND event_id = $2;
+
+-- name: ClaimWebhookEvent :one
+UPDATE webhook_events
+SET
+status = 'processing',
+attempts = attempts + 1,
+error = '',
+started_at = NOW()
+WHERE id = $1
+AND (
+    status = 'failed'
+    OR (status = 'processing' AND started_at < NOW() - INTERVAL '10 minutes')
+)
+RETURNING *;
+
+-- name: FinishWebhookEvent :exec
+UPDATE webhook_events
+SET
+status = $2,
+error = $3,
+processed_at = NOW()
+WHERE id = $1;
+
+-- name: ListWebhookEvents :many
+SELECT * FROM webhook_events
+WHERE (sqlc.narg('status')::text IS NULL OR status = sqlc.narg('status'))
+AND (sqlc.narg('before')::timestamp IS NULL OR received_at < sqlc.narg('before'))
+ORDER BY received_at DESC
+LIMIT sqlc.arg('limit');
@@ -0,0 +1,28 @@
+-- +goose Up
+CREATE TABLE data_exports (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_user_id
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    status TEXT NOT NULL,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE TABLE data_export_archives (
+    export_id UUID PRIMARY KEY NOT NULL,
+    CONSTRAINT fk_export_id
+    FOREIGN KEY (export_id)
+    REFERENCES data_exports(id)
+    ON DELETE CASCADE,
+    archive BYTEA NOT NULL
+);
+
+-- +goose Down
+DROP TABLE data_export_archives;
+
+DROP TABLE data_exports;
@@ -0,0 +1,58 @@
+-- +goose Up
+ALTER TABLE users
+ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE audit_events
+ADD COLUMN actor_type TEXT NOT NULL DEFAULT 'user',
+ADD COLUMN actor_id UUID,
+ADD CONSTRAINT fk_actor_id
+FOREIGN KEY (actor_id)
+REFERENCES users(id)
+ON DELETE SET NULL,
+ADD COLUMN request_id TEXT NOT NULL DEFAULT '',
+ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+
+UPDATE audit_events SET actor_id = user_id;
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id, created_at);
+
+-- Entries can never be changed or removed. The only exception is the
+-- ON DELETE SET NULL of a deleted user's ids.
+-- +goose StatementBegin
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+    AND (NEW.user_id IS NULL OR NEW.user_id = OLD.user_id)
+    AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+    AND (NEW.id, NEW.created_at, NEW.event, NEW.ip, NEW.user_agent, NEW.actor_type, NEW.request_id, NEW.metadata)
+    IS NOT DISTINCT FROM
+    (OLD.id, OLD.created_at, OLD.event, OLD.ip, OLD.user_agent, OLD.actor_type, OLD.request_id, OLD.metadata) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE ON audit_events
+FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+-- +goose Down
+DROP TRIGGER audit_events_append_only ON audit_events;
+
+DROP FUNCTION audit_events_append_only();
+
+DROP INDEX audit_events_user_id_idx;
+
+DROP INDEX audit_events_created_at_idx;
+
+ALTER TABLE audit_events
+DROP COLUMN metadata,
+DROP COLUMN request_id,
+DROP COLUMN actor_id,
+DROP COLUMN actor_type;
+
+ALTER TABLE users
+DROP COLUMN is_admin;
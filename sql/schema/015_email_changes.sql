@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE email_changes (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_user_id
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    old_email TEXT NOT NULL,
+    new_email TEXT NOT NULL,
+    confirm_token_hash TEXT NOT NULL UNIQUE,
+    confirm_expires_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    revert_token_hash TEXT UNIQUE,
+    revert_expires_at TIMESTAMP,
+    reverted_at TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE email_changes;
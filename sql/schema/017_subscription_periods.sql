@@ -0,0 +1,31 @@
+-- +goose Up
+CREATE TABLE subscription_periods (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_user_id
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    starts_at TIMESTAMP NOT NULL,
+    -- NULL means the period runs until the subscription is cancelled.
+    ends_at TIMESTAMP,
+    payment_failed_at TIMESTAMP,
+    webhook_event_id UUID,
+    CONSTRAINT fk_webhook_event_id
+    FOREIGN KEY (webhook_event_id)
+    REFERENCES webhook_events(id)
+    ON DELETE SET NULL
+);
+
+CREATE INDEX subscription_periods_user_id_idx ON subscription_periods (user_id);
+
+-- Users upgraded before periods existed keep Chirpy Red until Polka
+-- downgrades them.
+INSERT INTO subscription_periods (id, created_at, user_id, starts_at)
+SELECT gen_random_uuid(), NOW(), id, updated_at
+FROM users
+WHERE is_chirpy_red;
+
+-- +goose Down
+DROP TABLE subscription_periods;
@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE outbox_events (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+    event_type TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    published_at TIMESTAMP
+);
+
+CREATE INDEX outbox_events_unpublished_idx ON outbox_events (next_attempt_at) WHERE published_at IS NULL;
+
+-- +goose Down
+DROP TABLE outbox_events;
@@ -0,0 +1,43 @@
+-- +goose Up
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_user_id
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    chirp_id UUID,
+    CONSTRAINT fk_chirp_id
+    FOREIGN KEY (chirp_id)
+    REFERENCES chirps(id)
+    ON DELETE CASCADE,
+    -- Everyone who did this, newest first.
+    actor_ids UUID[] NOT NULL,
+    read_at TIMESTAMP
+);
+
+-- Unread notifications of the same type on the same chirp are grouped
+-- into one row. Follows have no chirp and are grouped together.
+CREATE UNIQUE INDEX notifications_unread_group_idx ON notifications (user_id, type, COALESCE(chirp_id, '00000000-0000-0000-0000-000000000000'))
+WHERE read_at IS NULL;
+
+CREATE INDEX notifications_user_id_idx ON notifications (user_id, updated_at);
+
+CREATE TABLE notification_preferences (
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_user_id
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    PRIMARY KEY (user_id, type)
+);
+
+-- +goose Down
+DROP TABLE notification_preferences;
+
+DROP TABLE notifications;
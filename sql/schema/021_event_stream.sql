@@ -0,0 +1,13 @@
+-- +goose Up
+-- Published outbox events are numbered in the order they are published,
+-- so stream clients can resume after the last event they received.
+CREATE SEQUENCE outbox_stream_seq;
+
+ALTER TABLE outbox_events ADD COLUMN stream_id BIGINT;
+
+CREATE UNIQUE INDEX outbox_events_stream_id_idx ON outbox_events (stream_id);
+
+-- +goose Down
+ALTER TABLE outbox_events DROP COLUMN stream_id;
+
+DROP SEQUENCE outbox_stream_seq;
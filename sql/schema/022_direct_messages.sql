@@ -0,0 +1,79 @@
+-- +goose Up
+CREATE TABLE user_blocks (
+    blocker_id UUID NOT NULL,
+    CONSTRAINT fk_blocker_id
+    FOREIGN KEY (blocker_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    blocked_id UUID NOT NULL,
+    CONSTRAINT fk_blocked_id
+    FOREIGN KEY (blocked_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id)
+);
+
+CREATE INDEX user_blocks_blocked_id_idx ON user_blocks (blocked_id);
+
+CREATE TABLE conversations (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    -- Moved forward by every message, so recent conversations sort first.
+    updated_at TIMESTAMP NOT NULL,
+    -- The two user IDs of a one-to-one conversation, in order, so each
+    -- pair has only one. NULL for groups.
+    direct_key TEXT UNIQUE
+);
+
+CREATE TABLE conversation_participants (
+    conversation_id UUID NOT NULL,
+    CONSTRAINT fk_conversation_id
+    FOREIGN KEY (conversation_id)
+    REFERENCES conversations(id)
+    ON DELETE CASCADE,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_user_id
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    joined_at TIMESTAMP NOT NULL,
+    -- The newest message the user has read, and when it was sent.
+    last_read_message_id UUID,
+    last_read_at TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX conversation_participants_user_id_idx ON conversation_participants (user_id);
+
+CREATE TABLE messages (
+    id UUID PRIMARY KEY NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    conversation_id UUID NOT NULL,
+    CONSTRAINT fk_conversation_id
+    FOREIGN KEY (conversation_id)
+    REFERENCES conversations(id)
+    ON DELETE CASCADE,
+    sender_id UUID NOT NULL,
+    CONSTRAINT fk_sender_id
+    FOREIGN KEY (sender_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    -- Emptied when the message is deleted; the row stays so the history
+    -- shows where it was.
+    body TEXT NOT NULL,
+    deleted_at TIMESTAMP
+);
+
+CREATE INDEX messages_conversation_id_idx ON messages (conversation_id, created_at, id);
+CREATE INDEX messages_sender_id_idx ON messages (sender_id);
+
+-- +goose Down
+DROP TABLE messages;
+
+DROP TABLE conversation_participants;
+
+DROP TABLE conversations;
+
+DROP TABLE user_blocks;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- When processing last began, so an event left in 'processing' by a crash
+-- can be claimed again.
+ALTER TABLE webhook_events
+ADD COLUMN started_at TIMESTAMP;
+
+UPDATE webhook_events SET started_at = received_at;
+
+ALTER TABLE webhook_events
+ALTER COLUMN started_at SET NOT NULL;
+
+-- +goose Down
+ALTER TABLE webhook_events
+DROP COLUMN started_at;
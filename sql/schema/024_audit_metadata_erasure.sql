@@ -0,0 +1,36 @@
+-- +goose Up
+-- Metadata holds email addresses, so when an account is deleted its
+-- entries' metadata may be emptied as well. Nothing else changes.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+    AND (NEW.user_id IS NULL OR NEW.user_id = OLD.user_id)
+    AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+    AND (NEW.metadata = '{}' OR NEW.metadata = OLD.metadata)
+    AND (NEW.id, NEW.created_at, NEW.event, NEW.ip, NEW.user_agent, NEW.actor_type, NEW.request_id)
+    IS NOT DISTINCT FROM
+    (OLD.id, OLD.created_at, OLD.event, OLD.ip, OLD.user_agent, OLD.actor_type, OLD.request_id) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE'
+    AND (NEW.user_id IS NULL OR NEW.user_id = OLD.user_id)
+    AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+    AND (NEW.id, NEW.created_at, NEW.event, NEW.ip, NEW.user_agent, NEW.actor_type, NEW.request_id, NEW.metadata)
+    IS NOT DISTINCT FROM
+    (OLD.id, OLD.created_at, OLD.event, OLD.ip, OLD.user_agent, OLD.actor_type, OLD.request_id, OLD.metadata) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
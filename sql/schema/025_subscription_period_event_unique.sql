@@ -0,0 +1,18 @@
+-- +goose Up
+-- A webhook event adds at most one period, however often it is retried.
+-- Periods already added twice keep their dates but only the first keeps
+-- the event.
+UPDATE subscription_periods p
+SET webhook_event_id = NULL
+WHERE EXISTS (
+    SELECT 1 FROM subscription_periods earlier
+    WHERE earlier.webhook_event_id = p.webhook_event_id
+    AND (earlier.created_at, earlier.id) < (p.created_at, p.id)
+);
+
+ALTER TABLE subscription_periods
+ADD CONSTRAINT subscription_periods_webhook_event_id_key UNIQUE (webhook_event_id);
+
+-- +goose Down
+ALTER TABLE subscription_periods
+DROP CONSTRAINT subscription_periods_webhook_event_id_key;
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSubscriptionPeriod = 30 * 24 * time.Hour
+	paymentGracePeriod        = 3 * 24 * time.Hour
+	subscriptionSweepInterval = 5 * time.Minute
+)
+
+// extendSubscription adds a period after the user's latest one, or from
+// now if that has ended. Without a periodEnd from Polka, an upgrade runs
+// until the user is downgraded, as upgrades always did, and a renewal adds
+// the default period. An event that already added its period adds nothing.
+func extendSubscription(ctx context.Context, q *database.Queries, userID uuid.UUID, webhookEventID uuid.UUID, periodEnd *time.Time, renewal bool) error {
+	start := time.Now()
+	latest, err := q.GetLatestSubscriptionPeriod(ctx, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		if !latest.EndsAt.Valid {
+			return nil
+		}
+		if latest.EndsAt.Time.After(start) {
+			start = latest.EndsAt.Time
+		}
+	}
+
+	end := sql.NullTime{}
+	switch {
+	case periodEnd != nil:
+		if !periodEnd.After(start) {
+			return nil
+		}
+		end = sql.NullTime{Time : *periodEnd, Valid : true}
+	case renewal:
+		end = sql.NullTime{Time : start.Add(defaultSubscriptionPeriod), Valid : true}
+	}
+
+	_, err = q.CreateSubscriptionPeriod(ctx, database.CreateSubscriptionPeriodParams{
+		UserID : userID,
+		StartsAt : start,
+		EndsAt : end,
+		WebhookEventID : uuid.NullUUID{
+			UUID : webhookEventID,
+			Valid : true,
+		},
+	})
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// recordPaymentFailure flags the latest period. A membership that is
+// ending or has just ended is kept for a grace period, while Polka retries
+// the payment; one that lapsed longer ago is not brought back. An
+// open-ended one gets an end, so it lapses unless a renewal follows.
+func recordPaymentFailure(ctx context.Context, q *database.Queries, userID uuid.UUID) error {
+	latest, err := q.GetLatestSubscriptionPeriod(ctx, userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if latest.EndsAt.Valid && latest.EndsAt.Time.Before(now.Add(-paymentGracePeriod)) {
+		return nil
+	}
+	end := latest.EndsAt
+	if !end.Valid || end.Time.Before(now.Add(paymentGracePeriod)) {
+		end = sql.NullTime{Time : now.Add(paymentGracePeriod), Valid : true}
+	}
+	return q.MarkSubscriptionPaymentFailed(ctx, database.MarkSubscriptionPaymentFailedParams{
+		ID : latest.ID,
+		EndsAt : end,
+	})
+}
+
+// syncChirpyRedTx recomputes is_chirpy_red from the active periods, for
+// one user or, with uuid.Nil, everyone, and returns the users it changed.
+// The column is only a cache of the periods so reads of users stay cheap,
+// which is why it must run in the transaction that changes the periods.
+func syncChirpyRedTx(ctx context.Context, q *database.Queries, userID uuid.UUID) ([]database.SyncChirpyRedRow, error) {
+	changed, err := q.SyncChirpyRed(ctx, uuid.NullUUID{
+		UUID : userID,
+		Valid : userID != uuid.Nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range changed {
+		err = writeOutboxEvent(ctx, q, user.ID, subscriptionEvent(user.IsChirpyRed), struct {
+			UserID      uuid.UUID `json:"user_id"`
+			IsChirpyRed bool      `json:"is_chirpy_red"`
+		}{user.ID, user.IsChirpyRed})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
+
+// recordSubscriptionChanges audits the changes syncChirpyRedTx made, once
+// its transaction has committed.
+func (cfg *apiConfig) recordSubscriptionChanges(ctx context.Context, req *http.Request, changed []database.SyncChirpyRedRow) {
+	for _, user := range changed {
+		cfg.recordAudit(ctx, req, auditEntry{
+			UserID : user.ID,
+			ActorType : actorSystem,
+			Event : subscriptionEvent(user.IsChirpyRed),
+		})
+	}
+}
+
+// syncChirpyRed turns is_chirpy_red off for everyone whose last period has
+// lapsed.
+func (cfg *apiConfig) syncChirpyRed(ctx context.Context) error {
+	var changed []database.SyncChirpyRedRow
+	err := cfg.inTx(ctx, func(q *database.Queries) error {
+		var err error
+		changed, err = syncChirpyRedTx(ctx, q, uuid.Nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cfg.recordSubscriptionChanges(ctx, nil, changed)
+	return nil
+}
+
+func subscriptionEvent(isChirpyRed bool) string {
+	if isChirpyRed {
+		return eventSubscriptionStarted
+	}
+	return eventSubscriptionExpired
+}
+
+func (cfg *apiConfig) runSubscriptionExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := cfg.syncChirpyRed(context.Background())
+		if err != nil {
+			log.Printf("Error expiring subscriptions: %s", err)
+		}
+		<-ticker.C
+	}
+}
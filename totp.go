@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	mfaChallengeAudience = "chirpy-mfa"
+	mfaChallengeTTL      = 5 * time.Minute
+	recoveryCodeCount    = 10
+)
+
+// userHasTOTP reports whether the user has confirmed TOTP. Only a missing
+// row means no TOTP: any other error must stop the caller, or a database
+// failure would skip the second factor.
+func (cfg *apiConfig) userHasTOTP(ctx context.Context, userID uuid.UUID) (database.UserTotp, bool, error) {
+	totp, err := cfg.db.GetUserTOTP(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.UserTotp{}, false, nil
+	}
+	if err != nil {
+		return database.UserTotp{}, false, err
+	}
+	return totp, totp.ConfirmedAt.Valid, nil
+}
+
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, userID uuid.UUID) {
+	type challengeResp struct {
+		MFARequired    bool   `json:"mfa_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	challenge, err := cfg.keys.MakeJWTForAudience(userID, mfaChallengeAudience, mfaChallengeTTL)
+	if err != nil {
+		log.Printf("Error creating MFA challenge: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(challengeResp{
+		MFARequired : true,
+		ChallengeToken : challenge,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// verifySecondFactor accepts either a TOTP code, which may only be used
+// once, or one of the user's unused recovery codes.
+func (cfg *apiConfig) verifySecondFactor(ctx context.Context, totp database.UserTotp, code, recoveryCode string) bool {
+	if code != "" {
+		step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+		if !ok {
+			return false
+		}
+		rows, err := cfg.db.UseTOTPStep(ctx, database.UseTOTPStepParams{
+			UserID : totp.UserID,
+			LastUsedStep : step,
+		})
+		return err == nil && rows == 1
+	}
+	if recoveryCode != "" {
+		rows, err := cfg.db.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+			UserID : totp.UserID,
+			CodeHash : auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)),
+		})
+		return err == nil && rows == 1
+	}
+	return false
+}
+
+func (cfg *apiConfig) handleLoginTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respBody := errResp{
+			Error : "Something went wrong",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWTForAudience(params.ChallengeToken, mfaChallengeAudience)
+	if err != nil {
+		respBody := errResp{
+			Error : tokenErrorMessage(err),
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(401)
+		w.Write(dat)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(401)
+		return
+	}
+
+	retryAfter, err := cfg.loginRetryAfter(req.Context(), req, user.Email)
+	if err != nil {
+		log.Printf("Error checking login attempts: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if retryAfter > 0 {
+		setRetryAfter(w, retryAfter)
+		respBody := errResp{
+			Error : "Too many failed login attempts, try again later",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(429)
+		w.Write(dat)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(req.Context(), userID)
+	if err != nil || !totp.ConfirmedAt.Valid || !cfg.verifySecondFactor(req.Context(), totp, params.Code, params.RecoveryCode) {
+		cfg.recordLoginFailure(req.Context(), req, user.Email)
+		respBody := errResp{
+			Error : "Invalid code",
+		}
+		dat, err2 := json.Marshal(respBody)
+		if err2 != nil {
+			log.Printf("Error marshalling JSON: %s", err2)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(401)
+		w.Write(dat)
+		return
+	}
+
+	cfg.recordLoginSuccess(req.Context(), user.Email)
+	mapped, err := cfg.issueSession(req.Context(), user)
+	if err != nil {
+		log.Printf("Error issuing session: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordLogin(req.Context(), req, user.ID, "totp")
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+	return
+}
+
+func (cfg *apiConfig) handleEnrollTOTP(w http.ResponseWriter, req *http.Request) {
+	type enrollResp struct {
+		Secret string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	user, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	_, hasTOTP, err := cfg.userHasTOTP(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error loading TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if hasTOTP {
+		w.WriteHeader(409)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		log.Printf("Error generating TOTP secret: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	// The upsert leaves a confirmed secret alone, so a confirmation that
+	// lands after the check above is not undone.
+	err = cfg.inTx(req.Context(), func(q *database.Queries) error {
+		_, err := q.UpsertUserTOTP(req.Context(), database.UpsertUserTOTPParams{
+			UserID : userID,
+			Secret : secret,
+		})
+		if err != nil {
+			return err
+		}
+		err = q.DeleteRecoveryCodes(req.Context(), userID)
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			err = q.CreateRecoveryCode(req.Context(), database.CreateRecoveryCodeParams{
+				CodeHash : auth.HashToken(auth.NormalizeRecoveryCode(code)),
+				UserID : userID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(409)
+		return
+	}
+	if err != nil {
+		log.Printf("Error storing TOTP secret: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	dat, err := json.Marshal(enrollResp{
+		Secret : secret,
+		ProvisioningURI : auth.TOTPProvisioningURI("Chirpy", user.Email, secret),
+		RecoveryCodes : codes,
+	})
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(201)
+	w.Write(dat)
+	return
+}
+
+func (cfg *apiConfig) handleConfirmTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil || params.Code == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	if totp.ConfirmedAt.Valid {
+		w.WriteHeader(409)
+		return
+	}
+
+	if !cfg.verifySecondFactor(req.Context(), totp, params.Code, "") {
+		w.WriteHeader(400)
+		return
+	}
+
+	err = cfg.db.ConfirmUserTOTP(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error confirming TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "user.totp_enabled")
+
+	w.WriteHeader(204)
+	return
+}
+
+func (cfg *apiConfig) handleDeleteTOTP(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	accessToken, err := auth.GetBearerToken(req.Header)
+	if err != nil || accessToken == "" {
+		w.WriteHeader(401)
+		return
+	}
+
+	userID, err := cfg.keys.ValidateJWT(accessToken)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerChallenge(err))
+		w.WriteHeader(401)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(req.Context(), userID)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	if totp.ConfirmedAt.Valid && !cfg.verifySecondFactor(req.Context(), totp, params.Code, params.RecoveryCode) {
+		w.WriteHeader(403)
+		return
+	}
+
+	err = cfg.db.DeleteUserTOTP(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error deleting TOTP: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	err = cfg.db.DeleteRecoveryCodes(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error deleting recovery codes: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "user.totp_disabled")
+
+	w.WriteHeader(204)
+	return
+}
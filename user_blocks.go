@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/google/uuid"
+)
+
+type BlockedUser struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (cfg *apiConfig) handleListBlockedUsers(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeMessagesRead)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	blocks, err := cfg.db.ListBlockedUsers(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing blocked users: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped := []BlockedUser{}
+	for _, block := range blocks {
+		mapped = append(mapped, BlockedUser{
+			UserID : block.BlockedID,
+			CreatedAt : block.CreatedAt,
+		})
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handleBlockUser stops a user from messaging the caller, and the caller
+// from messaging them. Blocking someone already blocked does nothing.
+func (cfg *apiConfig) handleBlockUser(w http.ResponseWriter, req *http.Request) {
+	userID, err := cfg.authenticate(req, auth.ScopeMessagesWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	blockedID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	if blockedID == userID {
+		w.WriteHeader(400)
+		return
+	}
+	_, err = cfg.db.GetUserByID(req.Context(), blockedID)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading user: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	err = cfg.db.BlockUser(req.Context(), database.BlockUserParams{
+		BlockerID : userID,
+		BlockedID : blockedID,
+	})
+	if err != nil {
+		log.Printf("Error blocking user: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleUnblockUser(w http.ResponseWriter, req *http.Request) {
+	userID, err := cfg.authenticate(req, auth.ScopeMessagesWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	blockedID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	err = cfg.db.UnblockUser(req.Context(), database.UnblockUserParams{
+		BlockerID : userID,
+		BlockedID : blockedID,
+	})
+	if err != nil {
+		log.Printf("Error unblocking user: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/andrei-himself/chirpy/internal/auth"
+	"github.com/andrei-himself/chirpy/internal/webhooks"
+	"github.com/google/uuid"
+)
+
+const (
+	webhookTimeout       = 10 * time.Second
+	webhookSweepInterval = 15 * time.Second
+	maxWebhookEndpoints  = 10
+	webhookSecretPrefix  = "whsec_"
+)
+
+// A delivery is delivering while an attempt is in flight. A failed attempt
+// puts it back to pending with a later next_attempt_at, until it runs out
+// of attempts and is dead.
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliverySucceeded = "succeeded"
+	webhookDeliveryDead      = "dead"
+)
+
+type WebhookEndpoint struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description"`
+	Secret      string    `json:"secret,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             uuid.UUID       `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	EventID        uuid.UUID       `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int32           `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus *int32          `json:"response_status"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+func mapWebhookEndpoint(endpoint database.WebhookEndpoint) WebhookEndpoint {
+	return WebhookEndpoint{
+		ID : endpoint.ID,
+		CreatedAt : endpoint.CreatedAt,
+		URL : endpoint.Url,
+		Events : endpoint.Events,
+		Description : endpoint.Description,
+	}
+}
+
+func mapWebhookDelivery(delivery database.WebhookDelivery) WebhookDelivery {
+	mapped := WebhookDelivery{
+		ID : delivery.ID,
+		CreatedAt : delivery.CreatedAt,
+		EventID : delivery.EventID,
+		EventType : delivery.EventType,
+		Payload : delivery.Payload,
+		Status : delivery.Status,
+		Attempts : delivery.Attempts,
+		LastError : delivery.LastError,
+	}
+	if delivery.Status == webhookDeliveryPending {
+		mapped.NextAttemptAt = &delivery.NextAttemptAt
+	}
+	if delivery.LastAttemptAt.Valid {
+		mapped.LastAttemptAt = &delivery.LastAttemptAt.Time
+	}
+	if delivery.ResponseStatus.Valid {
+		mapped.ResponseStatus = &delivery.ResponseStatus.Int32
+	}
+	if delivery.DeliveredAt.Valid {
+		mapped.DeliveredAt = &delivery.DeliveredAt.Time
+	}
+	return mapped
+}
+
+// queueWebhookDeliveries creates a delivery of an outbox event to each of
+// the user's endpoints that subscribe to it. The outbox event's ID is the
+// webhook event ID, so receivers see the same one on every delivery.
+func queueWebhookDeliveries(ctx context.Context, q *database.Queries, event database.OutboxEvent) error {
+	endpoints, err := q.ListWebhookEndpointsForEvent(ctx, database.ListWebhookEndpointsForEventParams{
+		UserID : event.UserID,
+		Event : event.EventType,
+	})
+	if err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(struct {
+		ID        uuid.UUID       `json:"id"`
+		Type      string          `json:"type"`
+		CreatedAt time.Time       `json:"created_at"`
+		Data      json.RawMessage `json:"data"`
+	}{event.ID, event.EventType, event.CreatedAt.UTC(), event.Payload})
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		err = q.CreateWebhookDelivery(ctx, database.CreateWebhookDeliveryParams{
+			EndpointID : endpoint.ID,
+			EventID : event.ID,
+			EventType : event.EventType,
+			Payload : payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverWebhooks sends every delivery that is due. Claiming skips rows
+// other replicas hold, so several instances can run it at once.
+func (cfg *apiConfig) deliverWebhooks(ctx context.Context) {
+	for {
+		delivery, err := cfg.db.ClaimWebhookDelivery(ctx)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Printf("Error claiming webhook delivery: %s", err)
+			return
+		}
+		cfg.deliverWebhook(ctx, delivery)
+	}
+}
+
+func (cfg *apiConfig) deliverWebhook(ctx context.Context, delivery database.WebhookDelivery) {
+	endpoint, err := cfg.db.GetWebhookEndpointByID(ctx, delivery.EndpointID)
+	if err != nil {
+		log.Printf("Error loading webhook endpoint: %s", err)
+		return
+	}
+
+	status, err := cfg.webhookSender.Send(ctx, webhooks.Delivery{
+		ID : delivery.ID.String(),
+		EventID : delivery.EventID.String(),
+		Event : delivery.EventType,
+		URL : endpoint.Url,
+		Secret : []byte(endpoint.Secret),
+		Payload : delivery.Payload,
+	})
+	params := database.FinishWebhookDeliveryParams{
+		ID : delivery.ID,
+		Status : webhookDeliverySucceeded,
+		ResponseStatus : sql.NullInt32{
+			Int32 : int32(status),
+			Valid : status != 0,
+		},
+		NextAttemptAt : delivery.NextAttemptAt,
+	}
+	if err != nil {
+		params.LastError = err.Error()
+		params.Status = webhookDeliveryPending
+		params.NextAttemptAt = time.Now().Add(webhooks.Backoff(int(delivery.Attempts)))
+		if delivery.Attempts >= webhooks.MaxAttempts {
+			params.Status = webhookDeliveryDead
+		}
+	}
+	err = cfg.db.FinishWebhookDelivery(ctx, params)
+	if err != nil {
+		log.Printf("Error recording webhook delivery: %s", err)
+	}
+}
+
+func (cfg *apiConfig) runWebhookDeliveries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastCleanup := time.Time{}
+	for {
+		cfg.deliverWebhooks(context.Background())
+		if time.Since(lastCleanup) > time.Hour {
+			err := cfg.db.DeleteOldWebhookDeliveries(context.Background())
+			if err != nil {
+				log.Printf("Error deleting old webhook deliveries: %s", err)
+			}
+			lastCleanup = time.Now()
+		}
+		select {
+		case <-ticker.C:
+		case <-cfg.webhookWake:
+		}
+	}
+}
+
+func (cfg *apiConfig) handleCreateWebhookEndpoint(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+		Events []string `json:"events"`
+		Description string `json:"description"`
+	}
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeWebhooksWrite)
+	if err != nil {
+		status, message := authFailure(w, err)
+		dat, err := json.Marshal(errResp{
+			Error : message,
+		})
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(dat)
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	err = webhooks.ValidateURL(params.URL, cfg.platform == "dev")
+	if err != nil {
+		dat, err := json.Marshal(errResp{
+			Error : "url must be an absolute https URL",
+		})
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	if len(params.Events) == 0 {
+		dat, err := json.Marshal(errResp{
+			Error : "At least one event is required",
+		})
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+	for _, event := range params.Events {
+		if !slices.Contains(webhooks.Events, event) {
+			dat, err := json.Marshal(errResp{
+				Error : fmt.Sprintf("Unknown event %q", event),
+			})
+			if err != nil {
+				log.Printf("Error marshalling JSON: %s", err)
+				w.WriteHeader(500)
+				return
+			}
+			w.WriteHeader(400)
+			w.Write(dat)
+			return
+		}
+	}
+	slices.Sort(params.Events)
+	params.Events = slices.Compact(params.Events)
+
+	existing, err := cfg.db.ListWebhookEndpoints(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing webhook endpoints: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if len(existing) >= maxWebhookEndpoints {
+		dat, err := json.Marshal(errResp{
+			Error : fmt.Sprintf("At most %d webhook endpoints are allowed", maxWebhookEndpoints),
+		})
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(400)
+		w.Write(dat)
+		return
+	}
+
+	secret, err := auth.MakeOneTimeToken()
+	if err != nil {
+		log.Printf("Error making webhook secret: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	endpoint, err := cfg.db.CreateWebhookEndpoint(req.Context(), database.CreateWebhookEndpointParams{
+		UserID : userID,
+		Url : params.URL,
+		Secret : webhookSecretPrefix + secret,
+		Events : params.Events,
+		Description : params.Description,
+	})
+	if err != nil {
+		log.Printf("Error creating webhook endpoint: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "webhook_endpoint.created")
+
+	// The secret is shown once, when the endpoint is created.
+	mapped := mapWebhookEndpoint(endpoint)
+	mapped.Secret = endpoint.Secret
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(201)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handleListWebhookEndpoints(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := cfg.authenticate(req, auth.ScopeWebhooksWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	endpoints, err := cfg.db.ListWebhookEndpoints(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing webhook endpoints: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped := []WebhookEndpoint{}
+	for _, endpoint := range endpoints {
+		mapped = append(mapped, mapWebhookEndpoint(endpoint))
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handleDeleteWebhookEndpoint(w http.ResponseWriter, req *http.Request) {
+	userID, err := cfg.authenticate(req, auth.ScopeWebhooksWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	endpointID, err := uuid.Parse(req.PathValue("endpointID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	rows, err := cfg.db.DeleteWebhookEndpoint(req.Context(), database.DeleteWebhookEndpointParams{
+		ID : endpointID,
+		UserID : userID,
+	})
+	if err != nil {
+		log.Printf("Error deleting webhook endpoint: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	if rows == 0 {
+		w.WriteHeader(404)
+		return
+	}
+	cfg.recordAuditEvent(req.Context(), req, userID, "webhook_endpoint.deleted")
+	w.WriteHeader(204)
+}
+
+// userWebhookEndpoint loads an endpoint from the path for the
+// authenticated user, writing the error response if that fails.
+func (cfg *apiConfig) userWebhookEndpoint(w http.ResponseWriter, req *http.Request) (database.WebhookEndpoint, bool) {
+	userID, err := cfg.authenticate(req, auth.ScopeWebhooksWrite)
+	if err != nil {
+		status, _ := authFailure(w, err)
+		w.WriteHeader(status)
+		return database.WebhookEndpoint{}, false
+	}
+
+	endpointID, err := uuid.Parse(req.PathValue("endpointID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return database.WebhookEndpoint{}, false
+	}
+	endpoint, err := cfg.db.GetWebhookEndpoint(req.Context(), database.GetWebhookEndpointParams{
+		ID : endpointID,
+		UserID : userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(404)
+		return database.WebhookEndpoint{}, false
+	}
+	if err != nil {
+		log.Printf("Error loading webhook endpoint: %s", err)
+		w.WriteHeader(500)
+		return database.WebhookEndpoint{}, false
+	}
+	return endpoint, true
+}
+
+func (cfg *apiConfig) handleListWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	endpoint, ok := cfg.userWebhookEndpoint(w, req)
+	if !ok {
+		return
+	}
+
+	limit, before, ok := auditPage(req)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	deliveries, err := cfg.db.ListWebhookDeliveries(req.Context(), database.ListWebhookDeliveriesParams{
+		EndpointID : endpoint.ID,
+		Before : before,
+		Limit : limit,
+	})
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	mapped := []WebhookDelivery{}
+	for _, delivery := range deliveries {
+		mapped = append(mapped, mapWebhookDelivery(delivery))
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handleRetryWebhookDelivery takes a dead delivery out of the dead-letter
+// state and gives it a fresh set of attempts.
+func (cfg *apiConfig) handleRetryWebhookDelivery(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	endpoint, ok := cfg.userWebhookEndpoint(w, req)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := uuid.Parse(req.PathValue("deliveryID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	delivery, err := cfg.db.RetryWebhookDelivery(req.Context(), database.RetryWebhookDeliveryParams{
+		ID : deliveryID,
+		EndpointID : endpoint.ID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrying webhook delivery: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	select {
+	case cfg.webhookWake <- struct{}{}:
+	default:
+	}
+	dat, err := json.Marshal(mapWebhookDelivery(delivery))
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(202)
+	w.Write(dat)
+}
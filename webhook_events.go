@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"github.com/andrei-himself/chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// Every inbound webhook is stored as processing before it is handled, and
+// ends up with one of these. Only failed events are processed again;
+// deliveries of the others are acknowledged as duplicates.
+const (
+	webhookEventProcessed  = "processed"
+	webhookEventIgnored    = "ignored"
+	webhookEventFailed     = "failed"
+)
+
+type WebhookEvent struct {
+	ID          uuid.UUID       `json:"id"`
+	ReceivedAt  time.Time       `json:"received_at"`
+	Source      string          `json:"source"`
+	EventID     string          `json:"event_id"`
+	EventType   string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int32           `json:"attempts"`
+	Error       string          `json:"error,omitempty"`
+	ProcessedAt *time.Time      `json:"processed_at"`
+}
+
+func mapWebhookEvent(event database.WebhookEvent) WebhookEvent {
+	mapped := WebhookEvent{
+		ID : event.ID,
+		ReceivedAt : event.ReceivedAt,
+		Source : event.Source,
+		EventID : event.EventID,
+		EventType : event.EventType,
+		Payload : event.Payload,
+		Status : event.Status,
+		Attempts : event.Attempts,
+		Error : event.Error,
+	}
+	if event.ProcessedAt.Valid {
+		mapped.ProcessedAt = &event.ProcessedAt.Time
+	}
+	return mapped
+}
+
+// processWebhookEvent runs a claimed event and records how it went. The
+// returned error is the processing error, for the caller to report.
+func (cfg *apiConfig) processWebhookEvent(ctx context.Context, req *http.Request, event database.WebhookEvent) error {
+	var status string
+	var err error
+	switch event.Source {
+	case polkaSource:
+		status, err = cfg.processPolkaEvent(ctx, req, event)
+	default:
+		err = fmt.Errorf("unknown webhook source %q", event.Source)
+	}
+
+	params := database.FinishWebhookEventParams{
+		ID : event.ID,
+		Status : status,
+	}
+	if err != nil {
+		params.Status = webhookEventFailed
+		params.Error = err.Error()
+	}
+	finishErr := cfg.db.FinishWebhookEvent(ctx, params)
+	if finishErr != nil {
+		log.Printf("Error recording webhook event result: %s", finishErr)
+	}
+	return err
+}
+
+func (cfg *apiConfig) handleListWebhookEvents(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, ok := cfg.adminUser(w, req)
+	if !ok {
+		return
+	}
+
+	limit, before, ok := auditPage(req)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	status := req.URL.Query().Get("status")
+	events, err := cfg.db.ListWebhookEvents(req.Context(), database.ListWebhookEventsParams{
+		Status : sql.NullString{
+			String : status,
+			Valid : status != "",
+		},
+		Before : before,
+		Limit : limit,
+	})
+	if err != nil {
+		log.Printf("Error listing webhook events: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	mapped := []WebhookEvent{}
+	for _, event := range events {
+		mapped = append(mapped, mapWebhookEvent(event))
+	}
+	dat, err := json.Marshal(mapped)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}
+
+// handleReplayWebhookEvent processes a failed event again, for when the
+// cause has been fixed and the sender has stopped retrying. An event stuck
+// in processing for over 10 minutes counts as failed.
+func (cfg *apiConfig) handleReplayWebhookEvent(w http.ResponseWriter, req *http.Request) {
+	type errResp struct {
+		Error string `json:"error"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	admin, ok := cfg.adminUser(w, req)
+	if !ok {
+		return
+	}
+
+	eventID, err := uuid.Parse(req.PathValue("eventID"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	event, err := cfg.db.ClaimWebhookEvent(req.Context(), eventID)
+	if err == sql.ErrNoRows {
+		_, err = cfg.db.GetWebhookEvent(req.Context(), eventID)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading webhook event: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		dat, err := json.Marshal(errResp{
+			Error : "Only failed or stuck events can be replayed",
+		})
+		if err != nil {
+			log.Printf("Error marshalling JSON: %s", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(409)
+		w.Write(dat)
+		return
+	}
+	if err != nil {
+		log.Printf("Error claiming webhook event: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	cfg.recordAudit(req.Context(), req, auditEntry{
+		ActorType : actorAdmin,
+		ActorID : admin.ID,
+		Event : "admin.webhook_replayed",
+		Metadata : map[string]string{
+			"webhook_event_id" : event.ID.String(),
+		},
+	})
+	err = cfg.processWebhookEvent(req.Context(), req, event)
+	if err != nil {
+		log.Printf("Error replaying webhook event %s: %s", event.ID, err)
+	}
+
+	event, err = cfg.db.GetWebhookEvent(req.Context(), eventID)
+	if err != nil {
+		log.Printf("Error loading webhook event: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	dat, err := json.Marshal(mapWebhookEvent(event))
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(dat)
+}